@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of alert rule
+const (
+	AlertBand    = "band"
+	AlertFault   = "fault"
+	AlertOutput  = "output"
+	AlertRestart = "restart"
+)
+
+// Statuses of a notification
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// notificationBuffer is how many notifications can wait to be sent before more are dropped
+const notificationBuffer = 16
+
+// notifyTimeout limits how long a notifier may take to send, so one that's down doesn't hold up the rest
+var notifyTimeout = 30 * time.Second
+
+// alertCloseTimeout limits how long Close waits for notifications still waiting to be sent
+var alertCloseTimeout = time.Minute
+
+// AlertRule is a condition to notify someone about. Band alerts fire when the temperature has
+// been outside a sensor's band by more than Margin for Minutes, fault alerts when a sensor has
+// been faulted for Minutes, and output alerts when heating or cooling has been on for Minutes.
+// Restart alerts are sent each time TempGopher starts. Sensor limits a rule to one sensor, and
+// while an alert is active it is sent again every Repeat minutes.
+type AlertRule struct {
+	Name    string  `json:"name"    yaml:"name"`
+	Type    string  `json:"type"    yaml:"type"`
+	Sensor  string  `json:"sensor"  yaml:"sensor"`
+	Minutes float64 `json:"minutes" yaml:"minutes"`
+	Margin  float64 `json:"margin"  yaml:"margin"`
+	Repeat  float64 `json:"repeat"  yaml:"repeat"`
+}
+
+// SMTP defines a mail server to send alerts through
+type SMTP struct {
+	Addr     string   `json:"addr"     yaml:"addr"`
+	Username string   `json:"username" yaml:"username"`
+	Password string   `json:"-"        yaml:"password"`
+	From     string   `json:"from"     yaml:"from"`
+	To       []string `json:"to"       yaml:"to,omitempty"`
+}
+
+// Alerts defines the alert rules, and where to send notifications
+type Alerts struct {
+	Rules   []AlertRule `json:"rules"   yaml:"rules,omitempty"`
+	Webhook string      `json:"webhook" yaml:"webhook"`
+	SMTP    SMTP        `json:"smtp"    yaml:"smtp"`
+}
+
+// Alert is a rule whose condition holds for a sensor
+type Alert struct {
+	Rule     string    `json:"rule"`
+	Type     string    `json:"type"`
+	Alias    string    `json:"alias"`
+	Message  string    `json:"message"`
+	Since    time.Time `json:"since"`
+	Notified time.Time `json:"notified"`
+}
+
+// Notification is sent when an alert fires, repeats or is resolved
+type Notification struct {
+	Status string `json:"status"`
+	Alert  Alert  `json:"alert"`
+}
+
+// Notifier sends notifications somewhere
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// CheckAlerts returns an error if the alert rules or notifiers aren't valid
+func CheckAlerts(config Alerts, sensors []Sensor) error {
+	aliases := make(map[string]bool)
+	for _, s := range sensors {
+		aliases[s.Alias] = true
+	}
+
+	names := make(map[string]bool)
+	for _, r := range config.Rules {
+		if r.Name == "" || names[r.Name] {
+			return errors.New("Alert rule names must be unique and not blank")
+		}
+		names[r.Name] = true
+
+		switch r.Type {
+		case AlertBand, AlertFault, AlertOutput, AlertRestart:
+		default:
+			return fmt.Errorf("Unknown type for alert rule %s: %s", r.Name, r.Type)
+		}
+		if r.Sensor != "" && !aliases[r.Sensor] {
+			return fmt.Errorf("Unknown sensor for alert rule %s: %s", r.Name, r.Sensor)
+		}
+		if r.Minutes < 0 || r.Margin < 0 || r.Repeat < 0 {
+			return fmt.Errorf("The minutes, margin and repeat of alert rule %s cannot be negative", r.Name)
+		}
+	}
+
+	if len(config.SMTP.To) > 0 && (config.SMTP.Addr == "" || config.SMTP.From == "") {
+		return errors.New("Sending alerts by email needs an SMTP addr and from address")
+	}
+
+	return nil
+}
+
+// WebhookNotifier posts notifications as JSON to a URL
+type WebhookNotifier struct {
+	URL string
+}
+
+// Notify posts a notification to the webhook
+func (w WebhookNotifier) Notify(n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// sendMail sends an email, and is replaced in tests
+var sendMail = sendMailTimeout
+
+// sendMailTimeout sends an email like smtp.SendMail, but gives up after notifyTimeout, so a mail
+// server that never answers can't hold up the notifications behind it
+func sendMailTimeout(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(notifyTimeout)); err != nil {
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("SMTP server doesn't support AUTH")
+		}
+		if err = c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// SMTPNotifier emails notifications
+type SMTPNotifier struct {
+	Config SMTP
+}
+
+// Notify emails a notification to every recipient
+func (s SMTPNotifier) Notify(n Notification) error {
+	var auth smtp.Auth
+	if s.Config.Username != "" {
+		host := s.Config.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Config.Username, s.Config.Password, host)
+	}
+
+	subject := fmt.Sprintf("[TempGopher] %s: %s", strings.ToUpper(n.Status), n.Alert.Message)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.Config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.Config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nRule: %s\r\nSince: %s\r\n", n.Alert.Message, n.Alert.Rule, n.Alert.Since.Format(time.RFC1123))
+
+	return sendMail(s.Config.Addr, auth, s.Config.From, s.Config.To, msg.Bytes())
+}
+
+// alertNotifiers returns the notifiers configured for alerts
+func alertNotifiers(config Alerts) []Notifier {
+	var notifiers []Notifier
+	if config.Webhook != "" {
+		notifiers = append(notifiers, WebhookNotifier{URL: config.Webhook})
+	}
+	if len(config.SMTP.To) > 0 {
+		notifiers = append(notifiers, SMTPNotifier{Config: config.SMTP})
+	}
+	return notifiers
+}
+
+// alertKey identifies the alert of a rule for one sensor
+type alertKey struct {
+	rule  string
+	alias string
+}
+
+// pendingNotification is a notification waiting to be sent, with where to send it
+type pendingNotification struct {
+	notification Notification
+	notifiers    []Notifier
+}
+
+// Alerter evaluates alert rules against the states of sensors, and sends notifications when alerts
+// fire and resolve. It is used from the thermostat loop. Notifications are sent in the background,
+// in order, so a slow notifier doesn't hold up the thermostats.
+type Alerter struct {
+	rules     []AlertRule
+	notifiers []Notifier
+	since     map[alertKey]time.Time
+	active    map[alertKey]*Alert
+
+	queue chan pendingNotification
+	wg    sync.WaitGroup
+}
+
+// NewAlerter creates an alerter for a configuration. Close it to send any notifications still waiting.
+func NewAlerter(config *Config) *Alerter {
+	a := &Alerter{
+		since:  make(map[alertKey]time.Time),
+		active: make(map[alertKey]*Alert),
+		queue:  make(chan pendingNotification, notificationBuffer),
+	}
+	a.SetConfig(config)
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		for p := range a.queue {
+			for _, n := range p.notifiers {
+				if err := n.Notify(p.notification); err != nil {
+					log.Println("Unable to send alert:", err)
+				}
+			}
+		}
+	}()
+
+	return a
+}
+
+// SetConfig switches to the alert rules of a newly loaded configuration. Alerts of rules and sensors
+// that are no longer configured are forgotten.
+func (a *Alerter) SetConfig(config *Config) {
+	a.rules = config.Alerts.Rules
+	a.notifiers = alertNotifiers(config.Alerts)
+
+	aliases := make(map[string]bool)
+	for _, s := range config.Sensors {
+		aliases[s.Alias] = true
+	}
+	rules := make(map[string]AlertRule)
+	for _, r := range a.rules {
+		rules[r.Name] = r
+	}
+
+	for key := range a.since {
+		if r, ok := rules[key.rule]; !ok || !aliases[key.alias] || (r.Sensor != "" && r.Sensor != key.alias) {
+			delete(a.since, key)
+			delete(a.active, key)
+		}
+	}
+}
+
+// Close sends any notifications still waiting, then stops the alerter. It gives up on them
+// after alertCloseTimeout.
+func (a *Alerter) Close() {
+	close(a.queue)
+
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(alertCloseTimeout):
+		log.Println("Gave up sending the alerts still waiting")
+	}
+}
+
+// send queues a notification, dropping it if too many are already waiting
+func (a *Alerter) send(status string, alert Alert) {
+	if len(a.notifiers) == 0 {
+		return
+	}
+	select {
+	case a.queue <- pendingNotification{notification: Notification{Status: status, Alert: alert}, notifiers: a.notifiers}:
+	default:
+		log.Println("Too many alerts waiting to be sent, dropping:", alert.Message)
+	}
+}
+
+// Restart sends the restart alerts, and should be called once TempGopher has started
+func (a *Alerter) Restart(now time.Time) {
+	host, _ := os.Hostname()
+	for _, r := range a.rules {
+		if r.Type == AlertRestart {
+			alert := Alert{Rule: r.Name, Type: r.Type, Message: "TempGopher started on " + host, Since: now, Notified: now}
+			log.Println("Alert:", alert.Message)
+			a.send(AlertFiring, alert)
+		}
+	}
+}
+
+// alertCondition returns whether a rule's condition holds for a state, and a message describing it.
+// ok is false when the state says nothing about the condition, like the temperature of a faulted sensor.
+func alertCondition(r AlertRule, sensor Sensor, state State, minutes float64) (holds bool, ok bool, message string) {
+	switch r.Type {
+	case AlertBand:
+		if state.Fault {
+			return false, false, ""
+		}
+		high, low := sensor.HighTemp, sensor.LowTemp
+		if sensor.Mode == ModePID {
+			high, low = sensor.SetPoint, sensor.SetPoint
+		}
+		holds = state.Temp > high+r.Margin || state.Temp < low-r.Margin
+		message = fmt.Sprintf("%s is %.1f°C, outside %.1f°C to %.1f°C for %.0f minutes", sensor.Alias, state.Temp, low, high, minutes)
+	case AlertFault:
+		holds = state.Fault || state.AirFault
+		message = fmt.Sprintf("%s cannot be read: %s", sensor.Alias, state.Error)
+		if !state.Fault && state.AirFault {
+			message = fmt.Sprintf("%s air probe cannot be read: %s", sensor.Alias, state.Error)
+		}
+	case AlertOutput:
+		holds = state.Heating || state.Cooling
+		output := "cooling"
+		if state.Heating {
+			output = "heating"
+		}
+		message = fmt.Sprintf("%s has been %s for %.0f minutes", sensor.Alias, output, minutes)
+	default:
+		return false, false, ""
+	}
+	return holds, true, message
+}
+
+// Check evaluates the alert rules against the new state of a sensor, firing, repeating and resolving
+// its alerts. It returns true if the active alerts changed.
+func (a *Alerter) Check(sensor Sensor, state State, now time.Time) bool {
+	changed := false
+
+	for _, r := range a.rules {
+		if r.Type == AlertRestart || (r.Sensor != "" && r.Sensor != sensor.Alias) {
+			continue
+		}
+
+		key := alertKey{rule: r.Name, alias: sensor.Alias}
+		since, pending := a.since[key]
+		holds, ok, _ := alertCondition(r, sensor, state, 0)
+		if !ok {
+			continue
+		}
+
+		if !holds {
+			delete(a.since, key)
+			if alert, active := a.active[key]; active {
+				delete(a.active, key)
+				changed = true
+				log.Println("Alert resolved:", alert.Message)
+				a.send(AlertResolved, *alert)
+			}
+			continue
+		}
+
+		if !pending {
+			since = now
+			a.since[key] = since
+		}
+		minutes := now.Sub(since).Minutes()
+		if minutes < r.Minutes {
+			continue
+		}
+		_, _, message := alertCondition(r, sensor, state, minutes)
+
+		alert, active := a.active[key]
+		switch {
+		case !active:
+			alert = &Alert{Rule: r.Name, Type: r.Type, Alias: sensor.Alias, Since: since}
+			a.active[key] = alert
+			changed = true
+		case r.Repeat > 0 && now.Sub(alert.Notified).Minutes() >= r.Repeat:
+		default:
+			continue
+		}
+
+		alert.Message = message
+		alert.Notified = now
+		log.Println("Alert:", alert.Message)
+		a.send(AlertFiring, *alert)
+	}
+
+	return changed
+}
+
+// Active returns the active alerts, oldest first
+func (a *Alerter) Active() []Alert {
+	alerts := []Alert{}
+	for _, alert := range a.active {
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if !alerts[i].Since.Equal(alerts[j].Since) {
+			return alerts[i].Since.Before(alerts[j].Since)
+		}
+		return alerts[i].Rule+alerts[i].Alias < alerts[j].Rule+alerts[j].Alias
+	})
+	return alerts
+}
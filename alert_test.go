@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CheckAlerts(t *testing.T) {
+	sensors := []Sensor{Sensor{Alias: "foo"}}
+	assert.Equal(t, nil, CheckAlerts(Alerts{}, sensors))
+	assert.Equal(t, nil, CheckAlerts(Alerts{Rules: []AlertRule{AlertRule{Name: "warm", Type: AlertBand, Sensor: "foo", Minutes: 30}}}, sensors))
+
+	// Rules need unique names, a known type and a known sensor
+	assert.NotEqual(t, nil, CheckAlerts(Alerts{Rules: []AlertRule{AlertRule{Type: AlertBand}}}, sensors))
+	assert.NotEqual(t, nil, CheckAlerts(Alerts{Rules: []AlertRule{AlertRule{Name: "a", Type: AlertBand}, AlertRule{Name: "a", Type: AlertFault}}}, sensors))
+	assert.NotEqual(t, nil, CheckAlerts(Alerts{Rules: []AlertRule{AlertRule{Name: "a", Type: "DNE"}}}, sensors))
+	assert.NotEqual(t, nil, CheckAlerts(Alerts{Rules: []AlertRule{AlertRule{Name: "a", Type: AlertBand, Sensor: "DNE"}}}, sensors))
+	assert.NotEqual(t, nil, CheckAlerts(Alerts{Rules: []AlertRule{AlertRule{Name: "a", Type: AlertBand, Minutes: -1}}}, sensors))
+
+	// Email needs a server and sender
+	assert.NotEqual(t, nil, CheckAlerts(Alerts{SMTP: SMTP{To: []string{"me@example.com"}}}, sensors))
+	assert.Equal(t, nil, CheckAlerts(Alerts{SMTP: SMTP{Addr: "mail:25", From: "tg@example.com", To: []string{"me@example.com"}}}, sensors))
+}
+
+// recordingNotifier keeps every notification it is sent
+type recordingNotifier struct {
+	sent chan Notification
+}
+
+func (r recordingNotifier) Notify(n Notification) error {
+	r.sent <- n
+	return nil
+}
+
+func Test_Alerter(t *testing.T) {
+	sensor := Sensor{Alias: "foo", HighTemp: 20, LowTemp: 10}
+	config := &Config{
+		Sensors: []Sensor{sensor, Sensor{Alias: "bar"}},
+		Alerts: Alerts{Rules: []AlertRule{
+			AlertRule{Name: "band", Type: AlertBand, Minutes: 30, Margin: 1, Repeat: 60},
+			AlertRule{Name: "fault", Type: AlertFault, Sensor: "foo"},
+			AlertRule{Name: "output", Type: AlertOutput, Minutes: 120},
+			AlertRule{Name: "restart", Type: AlertRestart},
+		}},
+	}
+
+	a := NewAlerter(config)
+	notifier := recordingNotifier{sent: make(chan Notification, 10)}
+	a.notifiers = []Notifier{notifier}
+	start := time.Now()
+
+	// Restarts are sent straight away, but aren't active
+	a.Restart(start)
+	n := <-notifier.sent
+	assert.Equal(t, AlertFiring, n.Status)
+	assert.Equal(t, "restart", n.Alert.Rule)
+	assert.Equal(t, 0, len(a.Active()))
+
+	// Within the margin is fine
+	assert.False(t, a.Check(sensor, State{Temp: 20.5}, start))
+
+	// Outside the band has to last long enough to fire
+	assert.False(t, a.Check(sensor, State{Temp: 22}, start))
+	assert.False(t, a.Check(sensor, State{Temp: 22}, start.Add(29*time.Minute)))
+	assert.True(t, a.Check(sensor, State{Temp: 22}, start.Add(30*time.Minute)))
+	n = <-notifier.sent
+	assert.Equal(t, AlertFiring, n.Status)
+	assert.Equal(t, "band", n.Alert.Rule)
+	assert.Equal(t, "foo", n.Alert.Alias)
+	assert.True(t, start.Equal(n.Alert.Since))
+	assert.True(t, strings.Contains(n.Alert.Message, "22.0"))
+	assert.Equal(t, 1, len(a.Active()))
+
+	// And is only sent again after the repeat interval
+	assert.False(t, a.Check(sensor, State{Temp: 22}, start.Add(60*time.Minute)))
+	assert.False(t, a.Check(sensor, State{Temp: 22}, start.Add(91*time.Minute)))
+	n = <-notifier.sent
+	assert.Equal(t, AlertFiring, n.Status)
+	assert.Equal(t, 0, len(notifier.sent))
+
+	// A faulted sensor's temperature is stale, so the band alert stays until readings return
+	assert.True(t, a.Check(sensor, State{Temp: 22, Fault: true, Error: "broken"}, start.Add(92*time.Minute)))
+	n = <-notifier.sent
+	assert.Equal(t, "fault", n.Alert.Rule)
+	assert.Equal(t, "foo cannot be read: broken", n.Alert.Message)
+	assert.Equal(t, 2, len(a.Active()))
+
+	// Both resolve once the sensor is back in its band
+	assert.True(t, a.Check(sensor, State{Temp: 15}, start.Add(93*time.Minute)))
+	assert.Equal(t, AlertResolved, (<-notifier.sent).Status)
+	assert.Equal(t, AlertResolved, (<-notifier.sent).Status)
+	assert.Equal(t, 0, len(a.Active()))
+
+	// A broken air probe is a fault too
+	assert.True(t, a.Check(sensor, State{Temp: 15, AirFault: true, Error: "broken"}, start.Add(94*time.Minute)))
+	n = <-notifier.sent
+	assert.Equal(t, "fault", n.Alert.Rule)
+	assert.Equal(t, "foo air probe cannot be read: broken", n.Alert.Message)
+	assert.True(t, a.Check(sensor, State{Temp: 15}, start.Add(95*time.Minute)))
+	assert.Equal(t, AlertResolved, (<-notifier.sent).Status)
+	assert.Equal(t, 0, len(a.Active()))
+
+	// Outputs on for too long fire, for any sensor without a rule of its own
+	bar := Sensor{Alias: "bar", HighTemp: 20, LowTemp: 10}
+	assert.False(t, a.Check(bar, State{Temp: 15, Cooling: true}, start))
+	assert.True(t, a.Check(bar, State{Temp: 15, Cooling: true}, start.Add(3*time.Hour)))
+	n = <-notifier.sent
+	assert.Equal(t, "bar has been cooling for 180 minutes", n.Alert.Message)
+
+	// Alerts of removed rules are forgotten on reload
+	config.Alerts.Rules = config.Alerts.Rules[:2]
+	a.SetConfig(config)
+	a.notifiers = []Notifier{notifier}
+	assert.Equal(t, 0, len(a.Active()))
+	assert.False(t, a.Check(bar, State{Temp: 15}, start.Add(4*time.Hour)))
+	assert.Equal(t, 0, len(notifier.sent))
+
+	a.Close()
+}
+
+func Test_AlerterClose(t *testing.T) {
+	timeout := alertCloseTimeout
+	defer func() { alertCloseTimeout = timeout }()
+	alertCloseTimeout = 100 * time.Millisecond
+
+	// A notifier that never finishes doesn't stop the alerter closing
+	a := NewAlerter(&Config{})
+	notifier := recordingNotifier{sent: make(chan Notification)}
+	a.notifiers = []Notifier{notifier}
+	a.send(AlertFiring, Alert{Message: "stuck"})
+	start := time.Now()
+	a.Close()
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, "stuck", (<-notifier.sent).Alert.Message)
+}
+
+func Test_WebhookNotifier(t *testing.T) {
+	var got Notification
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		json.NewDecoder(r.Body).Decode(&got)
+		if got.Alert.Rule == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	w := WebhookNotifier{URL: ts.URL}
+	assert.Equal(t, nil, w.Notify(Notification{Status: AlertFiring, Alert: Alert{Rule: "band", Alias: "foo"}}))
+	assert.Equal(t, AlertFiring, got.Status)
+	assert.Equal(t, "foo", got.Alert.Alias)
+
+	assert.NotEqual(t, nil, w.Notify(Notification{Alert: Alert{Rule: "fail"}}))
+}
+
+func Test_SMTPNotifier(t *testing.T) {
+	send := sendMail
+	defer func() { sendMail = send }()
+
+	var addr, from string
+	var to []string
+	var msg []byte
+	var auth smtp.Auth
+	sendMail = func(a string, au smtp.Auth, f string, t []string, m []byte) error {
+		addr, auth, from, to, msg = a, au, f, t, m
+		return nil
+	}
+
+	s := SMTPNotifier{Config: SMTP{Addr: "mail.example.com:587", Username: "tg", Password: "secret", From: "tg@example.com", To: []string{"a@example.com", "b@example.com"}}}
+	assert.Equal(t, nil, s.Notify(Notification{Status: AlertResolved, Alert: Alert{Rule: "band", Message: "foo is back"}}))
+	assert.Equal(t, "mail.example.com:587", addr)
+	assert.Equal(t, "tg@example.com", from)
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, to)
+	assert.NotNil(t, auth)
+	assert.True(t, strings.Contains(string(msg), "Subject: [TempGopher] RESOLVED: foo is back\r\n"))
+
+	// Without a username, mail is sent without authenticating
+	s.Config.Username = ""
+	assert.Equal(t, nil, s.Notify(Notification{Status: AlertFiring}))
+	assert.Nil(t, auth)
+
+	// Subjects that aren't ASCII are encoded
+	assert.Equal(t, nil, s.Notify(Notification{Status: AlertFiring, Alert: Alert{Message: "foo is 25.0°C"}}))
+	assert.True(t, strings.Contains(string(msg), "Subject: =?utf-8?q?"))
+}
+
+func Test_sendMailTimeout(t *testing.T) {
+	timeout := notifyTimeout
+	defer func() { notifyTimeout = timeout }()
+	notifyTimeout = 100 * time.Millisecond
+
+	// A server that accepts the connection and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	err = sendMailTimeout(l.Addr().String(), nil, "tg@example.com", []string{"me@example.com"}, []byte("hi"))
+	assert.NotEqual(t, nil, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func Test_alertNotifiers(t *testing.T) {
+	assert.Equal(t, 0, len(alertNotifiers(Alerts{})))
+	assert.Equal(t, 2, len(alertNotifiers(Alerts{Webhook: "http://example.com", SMTP: SMTP{To: []string{"me@example.com"}}})))
+}
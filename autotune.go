@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// AutotuneOptions controls a relay feedback experiment
+type AutotuneOptions struct {
+	SetPoint   float64       `json:"setpoint"`
+	Hysteresis float64       `json:"hysteresis"`
+	Cycles     int           `json:"cycles"`
+	Interval   time.Duration `json:"-"`
+	Timeout    time.Duration `json:"-"`
+}
+
+// AutotuneResult contains the ultimate gain and period measured by an experiment, and the PID gains suggested by them.
+// The period is in seconds, matching the time base of the PID controller.
+type AutotuneResult struct {
+	Ku float64 `json:"ku"`
+	Tu float64 `json:"tu"`
+	Kp float64 `json:"kp"`
+	Ki float64 `json:"ki"`
+	Kd float64 `json:"kd"`
+}
+
+// AutotuneStatus reports the progress of an experiment started through the API
+type AutotuneStatus struct {
+	Alias   string          `json:"alias"`
+	Running bool            `json:"running"`
+	Started time.Time       `json:"started"`
+	Applied bool            `json:"applied"`
+	Error   string          `json:"error,omitempty"`
+	Result  *AutotuneResult `json:"result,omitempty"`
+	stop    chan struct{}
+}
+
+// Defaults for an experiment
+const (
+	defaultAutotuneHysteresis = 0.2
+	defaultAutotuneCycles     = 3
+	defaultAutotuneInterval   = 5 * time.Second
+	defaultAutotuneTimeout    = 48 * time.Hour
+)
+
+var (
+	autotuneMu sync.Mutex
+	autotunes  = make(map[string]*AutotuneStatus)
+)
+
+// DefaultAutotuneOptions returns the options for tuning a sensor around its setpoint, or the middle of its
+// temperature band if it isn't in PID mode.
+func DefaultAutotuneOptions(sensor Sensor) AutotuneOptions {
+	opts := AutotuneOptions{
+		SetPoint:   (sensor.HighTemp + sensor.LowTemp) / 2,
+		Hysteresis: defaultAutotuneHysteresis,
+		Cycles:     defaultAutotuneCycles,
+		Interval:   defaultAutotuneInterval,
+		Timeout:    defaultAutotuneTimeout,
+	}
+	if sensor.Mode == ModePID {
+		opts.SetPoint = sensor.SetPoint
+	}
+	return opts
+}
+
+// relayTuner implements the Åström–Hägglund relay feedback method. The output is switched fully one
+// way or the other whenever the temperature leaves a band around the setpoint, and the peaks of the
+// resulting oscillation are recorded.
+type relayTuner struct {
+	opts    AutotuneOptions
+	heat    bool
+	cool    bool
+	started bool
+	up      bool // true while the output is pushing the temperature up
+
+	extreme     float64
+	extremeTime time.Time
+	peaks       []float64
+	peakTimes   []time.Time
+	troughs     []float64
+	troughTimes []time.Time
+}
+
+func newRelayTuner(sensor Sensor, opts AutotuneOptions) *relayTuner {
+	// At least two full cycles are needed to measure a period
+	if opts.Cycles < 2 {
+		opts.Cycles = 2
+	}
+	if opts.Hysteresis <= 0 {
+		opts.Hysteresis = defaultAutotuneHysteresis
+	}
+	return &relayTuner{opts: opts, heat: !sensor.HeatDisable, cool: !sensor.CoolDisable}
+}
+
+// Update records a reading and returns whether heating and cooling should be on.
+func (r *relayTuner) Update(now time.Time, temp float64) (bool, bool) {
+	if !r.started {
+		r.started = true
+		r.up = temp < r.opts.SetPoint
+		r.extreme = temp
+		r.extremeTime = now
+	}
+
+	// Track the extreme of the current half cycle
+	if (r.up && temp < r.extreme) || (!r.up && temp > r.extreme) {
+		r.extreme = temp
+		r.extremeTime = now
+	}
+
+	switch {
+	case r.up && temp > r.opts.SetPoint+r.opts.Hysteresis:
+		r.troughs = append(r.troughs, r.extreme)
+		r.troughTimes = append(r.troughTimes, r.extremeTime)
+		r.up = false
+		r.extreme = temp
+		r.extremeTime = now
+	case !r.up && temp < r.opts.SetPoint-r.opts.Hysteresis:
+		r.peaks = append(r.peaks, r.extreme)
+		r.peakTimes = append(r.peakTimes, r.extremeTime)
+		r.up = true
+		r.extreme = temp
+		r.extremeTime = now
+	}
+
+	return r.up && r.heat, !r.up && r.cool
+}
+
+// Done is true once enough cycles have been recorded. The first half cycle is
+// ignored, as it starts from wherever the temperature happened to be.
+func (r *relayTuner) Done() bool {
+	return len(r.peaks) > r.opts.Cycles && len(r.troughs) > r.opts.Cycles
+}
+
+// Result calculates the ultimate gain and period, and the Ziegler–Nichols PID gains.
+func (r *relayTuner) Result() (AutotuneResult, error) {
+	if len(r.peaks) < 3 || len(r.troughs) < 3 {
+		return AutotuneResult{}, errors.New("Not enough oscillations to calculate a result")
+	}
+
+	peaks, peakTimes := r.peaks[1:], r.peakTimes[1:]
+	troughs, troughTimes := r.troughs[1:], r.troughTimes[1:]
+
+	amplitude := (mean(peaks) - mean(troughs)) / 2
+	if amplitude <= 0 {
+		return AutotuneResult{}, errors.New("Temperature did not oscillate")
+	}
+
+	var periods []float64
+	for i := 1; i < len(peakTimes); i++ {
+		periods = append(periods, peakTimes[i].Sub(peakTimes[i-1]).Seconds())
+	}
+	for i := 1; i < len(troughTimes); i++ {
+		periods = append(periods, troughTimes[i].Sub(troughTimes[i-1]).Seconds())
+	}
+
+	// Half the swing of the output, in percent
+	d := 50.0
+	if r.heat && r.cool {
+		d = 100.0
+	}
+
+	// Correct the describing function for the relay's hysteresis
+	a := amplitude
+	if amplitude > r.opts.Hysteresis {
+		a = math.Sqrt(amplitude*amplitude - r.opts.Hysteresis*r.opts.Hysteresis)
+	}
+
+	var res AutotuneResult
+	res.Ku = 4 * d / (math.Pi * a)
+	res.Tu = mean(periods)
+	res.Kp = 0.6 * res.Ku
+	res.Ki = 1.2 * res.Ku / res.Tu
+	res.Kd = 0.075 * res.Ku * res.Tu
+
+	return res, nil
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// Autotune runs a relay feedback experiment on the outputs of a sensor until enough cycles have been
+// recorded, the timeout passes, or stop is closed. The outputs are turned off when it returns.
+func Autotune(sensor Sensor, opts AutotuneOptions, stop <-chan struct{}) (AutotuneResult, error) {
+	if sensor.HeatDisable && sensor.CoolDisable {
+		return AutotuneResult{}, errors.New("Heating and cooling are both disabled")
+	}
+
+	var cool, heat Switch
+	var err error
+	if !sensor.CoolDisable {
+		if cool, err = CoolSwitch(sensor); err != nil {
+			return AutotuneResult{}, err
+		}
+	}
+	if !sensor.HeatDisable {
+		if heat, err = HeatSwitch(sensor); err != nil {
+			return AutotuneResult{}, err
+		}
+	}
+	defer TurnOffSensor(sensor)
+
+	// The outputs may have just been turned off, so the minimum off times apply from the start
+	start := time.Now()
+	state := State{CoolChanged: start, HeatChanged: start}
+
+	tuner := newRelayTuner(sensor, opts)
+	deadline := start.Add(opts.Timeout)
+	for !tuner.Done() {
+		if time.Now().After(deadline) {
+			return AutotuneResult{}, errors.New("Autotune timed out")
+		}
+
+		temp, err := ReadSensor(sensor)
+		if err != nil {
+			return AutotuneResult{}, err
+		}
+		temp = Calibrate(sensor, temp)
+
+		// The relay is held back by the minimum on and off times, like the thermostat
+		now := time.Now()
+		h, c := tuner.Update(now, temp)
+		next := ProtectOutputs(sensor, state, State{Cooling: c, Heating: h}, now)
+		if next.Heating != state.Heating || next.Cooling != state.Cooling {
+			log.Printf("%s Autotune Temp: %.2f, Cooling: %t, Heating: %t, Cycles: %d", sensor.Alias, temp, next.Cooling, next.Heating, len(tuner.peaks))
+		}
+		state = next
+
+		if err = SetSwitch(cool, state.Cooling); err != nil {
+			return AutotuneResult{}, err
+		}
+		if err = SetSwitch(heat, state.Heating); err != nil {
+			return AutotuneResult{}, err
+		}
+
+		select {
+		case <-stop:
+			return AutotuneResult{}, errors.New("Autotune stopped")
+		case <-time.After(opts.Interval):
+		}
+	}
+
+	return tuner.Result()
+}
+
+// ApplyAutotune writes the gains from an experiment to the stored configuration of a sensor.
+func ApplyAutotune(id string, res AutotuneResult) error {
+	return modifyConfig(func(config *Config) error {
+		for i := range config.Sensors {
+			if config.Sensors[i].ID == id {
+				config.Sensors[i].Kp = res.Kp
+				config.Sensors[i].Ki = res.Ki
+				config.Sensors[i].Kd = res.Kd
+				return nil
+			}
+		}
+
+		return errors.New("Sensor not found")
+	})
+}
+
+// IsTuning is true while an experiment started through the API is running on a sensor.
+// The thermostat leaves the sensor alone during that time.
+func IsTuning(alias string) bool {
+	autotuneMu.Lock()
+	defer autotuneMu.Unlock()
+	status, ok := autotunes[alias]
+	return ok && status.Running
+}
+
+// GetAutotuneStatus returns the status of the last experiment started on a sensor.
+func GetAutotuneStatus(alias string) (AutotuneStatus, bool) {
+	autotuneMu.Lock()
+	defer autotuneMu.Unlock()
+	status, ok := autotunes[alias]
+	if !ok {
+		return AutotuneStatus{}, false
+	}
+	return *status, true
+}
+
+// StartAutotune runs an experiment on a sensor in the background. If apply is true, the
+// suggested gains are written to the configuration once it completes.
+func StartAutotune(sensor Sensor, opts AutotuneOptions, apply bool) error {
+	autotuneMu.Lock()
+	defer autotuneMu.Unlock()
+
+	if status, ok := autotunes[sensor.Alias]; ok && status.Running {
+		return errors.New("Autotune is already running")
+	}
+
+	status := &AutotuneStatus{
+		Alias:   sensor.Alias,
+		Running: true,
+		Started: time.Now(),
+		stop:    make(chan struct{}),
+	}
+	autotunes[sensor.Alias] = status
+
+	go func(stop <-chan struct{}) {
+		res, err := Autotune(sensor, opts, stop)
+		applied := false
+		if err == nil && apply {
+			err = ApplyAutotune(sensor.ID, res)
+			applied = err == nil
+		}
+
+		autotuneMu.Lock()
+		defer autotuneMu.Unlock()
+		status.Running = false
+		status.Applied = applied
+		if err != nil {
+			status.Error = err.Error()
+			log.Println(err)
+		} else {
+			status.Result = &res
+		}
+	}(status.stop)
+
+	return nil
+}
+
+// StopAutotune stops a running experiment on a sensor.
+func StopAutotune(alias string) error {
+	autotuneMu.Lock()
+	defer autotuneMu.Unlock()
+
+	status, ok := autotunes[alias]
+	if !ok || !status.Running {
+		return errors.New("Autotune is not running")
+	}
+
+	select {
+	case <-status.stop:
+		return errors.New("Autotune is already stopping")
+	default:
+		close(status.stop)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_relayTuner(t *testing.T) {
+	opts := AutotuneOptions{SetPoint: 20, Hysteresis: 0.2, Cycles: 3}
+	tuner := newRelayTuner(Sensor{}, opts)
+	start := time.Now()
+
+	// Feed a 10 minute oscillation of one degree around the setpoint
+	var heating, cooling bool
+	for i := 0; !tuner.Done() && i < 100000; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		temp := 20 + math.Sin(2*math.Pi*float64(i)/600)
+		heating, cooling = tuner.Update(now, temp)
+		assert.False(t, heating && cooling)
+	}
+	assert.True(t, tuner.Done())
+
+	res, err := tuner.Result()
+	assert.Equal(t, nil, err)
+	assert.InDelta(t, 600, res.Tu, 1)
+	assert.InDelta(t, 400/(math.Pi*math.Sqrt(1-0.04)), res.Ku, 0.01)
+	assert.InDelta(t, 0.6*res.Ku, res.Kp, 0.0001)
+	assert.InDelta(t, 1.2*res.Ku/res.Tu, res.Ki, 0.0001)
+	assert.InDelta(t, 0.075*res.Ku*res.Tu, res.Kd, 0.0001)
+
+	// Heating only halves the relay amplitude
+	tuner.heat, tuner.cool = true, false
+	heatOnly, err := tuner.Result()
+	assert.Equal(t, nil, err)
+	assert.InDelta(t, res.Ku/2, heatOnly.Ku, 0.01)
+
+	// Not enough data
+	_, err = newRelayTuner(Sensor{}, opts).Result()
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_DefaultAutotuneOptions(t *testing.T) {
+	opts := DefaultAutotuneOptions(Sensor{HighTemp: 20, LowTemp: 18})
+	assert.Equal(t, 19.0, opts.SetPoint)
+
+	opts = DefaultAutotuneOptions(Sensor{HighTemp: 20, LowTemp: 18, Mode: ModePID, SetPoint: 10})
+	assert.Equal(t, 10.0, opts.SetPoint)
+}
+
+func Test_StartAutotune(t *testing.T) {
+	defer CloseSwitches()
+
+	RegisterSource("autotune", func(sensor Sensor) (TemperatureSource, error) {
+		return fixedSource(15), nil
+	})
+	sensor := Sensor{ID: "autotune", Alias: "autotune", Type: "autotune", SwitchType: "fake", HeatGPIO: 1, CoolGPIO: 2}
+
+	assert.NotEqual(t, nil, StopAutotune("autotune"))
+
+	err := StartAutotune(sensor, DefaultAutotuneOptions(sensor), false)
+	assert.Equal(t, nil, err)
+	assert.True(t, IsTuning("autotune"))
+
+	// Only one at a time
+	err = StartAutotune(sensor, DefaultAutotuneOptions(sensor), false)
+	assert.NotEqual(t, nil, err)
+
+	assert.Equal(t, nil, StopAutotune("autotune"))
+	for i := 0; i < 100 && IsTuning("autotune"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status, ok := GetAutotuneStatus("autotune")
+	assert.True(t, ok)
+	assert.False(t, status.Running)
+	assert.NotEmpty(t, status.Error)
+
+	// Outputs are left off
+	heat, _ := HeatSwitch(sensor)
+	on, _ := heat.State()
+	assert.False(t, on)
+}
+
+func Test_AutotuneProtectsOutputs(t *testing.T) {
+	defer CloseSwitches()
+
+	RegisterSource("autotunecold", func(sensor Sensor) (TemperatureSource, error) {
+		return fixedSource(15), nil
+	})
+	sensor := Sensor{ID: "cold", Alias: "cold", Type: "autotunecold", SwitchType: "fake", GPIOChip: "cold", HeatGPIO: 1, CoolGPIO: 2, HeatOffMinutes: 5}
+	heat, _ := HeatSwitch(sensor)
+	opts := DefaultAutotuneOptions(sensor)
+	opts.SetPoint = 19
+	opts.Interval = 5 * time.Millisecond
+	opts.Timeout = time.Minute
+
+	run := func() (everOn bool) {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			Autotune(sensor, opts, stop)
+			close(done)
+		}()
+		for i := 0; i < 20; i++ {
+			if on, _ := heat.State(); on {
+				everOn = true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		close(stop)
+		<-done
+		return everOn
+	}
+
+	// The heater has to wait out its minimum off time, even though it's too cold
+	assert.False(t, run())
+
+	// Without one, it comes on straight away
+	sensor.HeatOffMinutes = 0
+	assert.True(t, run())
+}
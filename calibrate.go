@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CalibrationPoint is a raw reading of a sensor and the actual temperature at the time
+type CalibrationPoint struct {
+	Raw    float64 `json:"raw"    yaml:"raw"`
+	Actual float64 `json:"actual" yaml:"actual"`
+}
+
+// calibrationReads is how many readings are averaged for each calibration point
+const calibrationReads = 5
+
+// calibrationDelay is the time between readings of a calibration point
+var calibrationDelay = time.Second
+
+// Calibrate corrects a raw reading of a sensor. With one calibration point the reading is shifted to
+// match it, and with more it is interpolated linearly between them, extending the nearest line past
+// either end. The sensor's Offset is added last.
+func Calibrate(sensor Sensor, raw float64) float64 {
+	temp := raw
+	points := sensor.Calibration
+
+	if len(points) == 1 {
+		temp = raw + points[0].Actual - points[0].Raw
+	} else if len(points) > 1 {
+		sorted := append([]CalibrationPoint(nil), points...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Raw < sorted[j].Raw })
+
+		// Find the line between two points that covers the reading
+		i := sort.Search(len(sorted)-1, func(i int) bool { return sorted[i+1].Raw >= raw })
+		if i == len(sorted)-1 {
+			i--
+		}
+		a, b := sorted[i], sorted[i+1]
+		temp = a.Actual + (raw-a.Raw)*(b.Actual-a.Actual)/(b.Raw-a.Raw)
+	}
+
+	return temp + sensor.Offset
+}
+
+// CheckCalibration returns an error if a sensor's calibration points can't be used
+func CheckCalibration(sensor Sensor) error {
+	seen := make(map[float64]bool)
+	for _, p := range sensor.Calibration {
+		if seen[p.Raw] {
+			return fmt.Errorf("Sensor %s has two calibration points for a reading of %.3f", sensor.Alias, p.Raw)
+		}
+		seen[p.Raw] = true
+	}
+	return nil
+}
+
+// averageReading reads a sensor a few times and returns the average
+func averageReading(read func() (float64, error)) (float64, error) {
+	var sum float64
+	for i := 0; i < calibrationReads; i++ {
+		if i > 0 {
+			time.Sleep(calibrationDelay)
+		}
+		temp, err := read()
+		if err != nil {
+			return 0, err
+		}
+		sum += temp
+	}
+	return sum / calibrationReads, nil
+}
+
+// PromptForCalibration walks a user through calibrating a sensor against references. read returns a
+// raw reading of the sensor. The sensor is returned with its new calibration, replacing any offset or
+// points it had before.
+func PromptForCalibration(in io.Reader, sensor Sensor, read func() (float64, error)) (Sensor, error) {
+	reader := bufio.NewReader(in)
+
+	fmt.Printf("Calibrating %s\n", sensor.Alias)
+	fmt.Println("Place the probe in a reference, like an ice bath (0°C) or boiling water (100°C at sea level), and let it settle.")
+	fmt.Println("Calibrate against as many references as you like, and press enter on its own when done.")
+
+	var points []CalibrationPoint
+	for {
+		fmt.Print("Reference temperature (°C): ")
+		resp := strings.TrimSpace(ReadInput(reader, ""))
+		if resp == "" {
+			break
+		}
+
+		actual, err := strconv.ParseFloat(resp, 64)
+		if err != nil {
+			fmt.Println("That isn't a temperature, try again.")
+			continue
+		}
+
+		raw, err := averageReading(read)
+		if err != nil {
+			return sensor, err
+		}
+		fmt.Printf("Sensor reads %.3f°C, %+.3f°C from the reference\n", raw, raw-actual)
+
+		points = append(points, CalibrationPoint{Raw: raw, Actual: actual})
+	}
+
+	if len(points) == 0 {
+		return sensor, errors.New("No references were measured")
+	}
+
+	sensor.Offset = 0
+	sensor.Calibration = nil
+	if len(points) == 1 {
+		sensor.Offset = points[0].Actual - points[0].Raw
+		fmt.Printf("Offset: %+.3f°C\n", sensor.Offset)
+	} else {
+		sensor.Calibration = points
+		if err := CheckCalibration(sensor); err != nil {
+			return sensor, err
+		}
+		for _, p := range points {
+			fmt.Printf("%.3f°C reads as %.3f°C\n", p.Raw, p.Actual)
+		}
+	}
+
+	return sensor, nil
+}
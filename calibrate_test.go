@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Calibrate(t *testing.T) {
+	// Without calibration, readings are unchanged
+	assert.Equal(t, 20.0, Calibrate(Sensor{}, 20))
+
+	// An offset is added
+	assert.Equal(t, 19.5, Calibrate(Sensor{Offset: -0.5}, 20))
+
+	// One point shifts readings to match it
+	sensor := Sensor{Calibration: []CalibrationPoint{{Raw: 0.5, Actual: 0}}}
+	assert.InDelta(t, 19.5, Calibrate(sensor, 20), 0.0001)
+
+	// Two points scale readings between them, and beyond
+	sensor = Sensor{Calibration: []CalibrationPoint{{Raw: 99, Actual: 100}, {Raw: 1, Actual: 0}}}
+	assert.InDelta(t, 0.0, Calibrate(sensor, 1), 0.0001)
+	assert.InDelta(t, 50.0, Calibrate(sensor, 50), 0.0001)
+	assert.InDelta(t, 100.0, Calibrate(sensor, 99), 0.0001)
+	assert.InDelta(t, -1.0204, Calibrate(sensor, 0), 0.0001)
+	assert.InDelta(t, 101.0204, Calibrate(sensor, 100), 0.0001)
+
+	// More points use the line between the nearest two
+	sensor.Calibration = append(sensor.Calibration, CalibrationPoint{Raw: 20, Actual: 19})
+	assert.InDelta(t, 9.5, Calibrate(sensor, 10.5), 0.0001)
+	assert.InDelta(t, 19.0, Calibrate(sensor, 20), 0.0001)
+
+	// And the offset is added after
+	sensor.Offset = 1
+	assert.InDelta(t, 20.0, Calibrate(sensor, 20), 0.0001)
+}
+
+func Test_CheckCalibration(t *testing.T) {
+	assert.Equal(t, nil, CheckCalibration(Sensor{}))
+	assert.Equal(t, nil, CheckCalibration(Sensor{Calibration: []CalibrationPoint{{Raw: 1, Actual: 0}, {Raw: 99, Actual: 100}}}))
+	assert.NotEqual(t, nil, CheckCalibration(Sensor{Calibration: []CalibrationPoint{{Raw: 1, Actual: 0}, {Raw: 1, Actual: 100}}}))
+}
+
+func Test_PromptForCalibration(t *testing.T) {
+	delay := calibrationDelay
+	calibrationDelay = 0
+	defer func() { calibrationDelay = delay }()
+
+	raw := 0.0
+	read := func() (float64, error) {
+		return raw, nil
+	}
+
+	// One reference gives an offset, replacing any old calibration
+	raw = 0.5
+	sensor := Sensor{Alias: "foo", Calibration: []CalibrationPoint{{Raw: 1, Actual: 2}}}
+	sensor, err := PromptForCalibration(strings.NewReader("0\n\n"), sensor, read)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, -0.5, sensor.Offset)
+	assert.Nil(t, sensor.Calibration)
+
+	// Several references give calibration points, and bad input is asked again
+	in := strings.NewReader("0\nfoo\n100\n\n")
+	readings := []float64{0.5, 0.5, 0.5, 0.5, 0.5, 99, 99, 99, 99, 99}
+	sensor, err = PromptForCalibration(in, sensor, func() (float64, error) {
+		r := readings[0]
+		readings = readings[1:]
+		return r, nil
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0.0, sensor.Offset)
+	assert.Equal(t, []CalibrationPoint{{Raw: 0.5, Actual: 0}, {Raw: 99, Actual: 100}}, sensor.Calibration)
+
+	// Nothing measured
+	_, err = PromptForCalibration(strings.NewReader("\n"), sensor, read)
+	assert.NotEqual(t, nil, err)
+
+	// Reads failing
+	_, err = PromptForCalibration(strings.NewReader("0\n\n"), sensor, func() (float64, error) {
+		return 0, errors.New("broken")
+	})
+	assert.NotEqual(t, nil, err)
+
+	// The same reading for two references
+	_, err = PromptForCalibration(strings.NewReader("0\n100\n\n"), sensor, read)
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// DefaultAirGain is how far the air target moves from the beer target for each degree the beer is off,
+// when a sensor doesn't set airgain
+const DefaultAirGain = 5.0
+
+// CheckAir returns an error if a sensor's air probe settings aren't valid
+func CheckAir(sensor Sensor) error {
+	if sensor.AirID == "" {
+		return nil
+	}
+	if sensor.Type != "" && sensor.Type != DefaultSourceType {
+		return fmt.Errorf("Only %s sensors can have an air probe, sensor %s is %s", DefaultSourceType, sensor.Alias, sensor.Type)
+	}
+	if sensor.AirID == sensor.ID {
+		return fmt.Errorf("The air probe of sensor %s can't be the sensor itself", sensor.Alias)
+	}
+	if sensor.AirMax <= sensor.AirMin {
+		return fmt.Errorf("The airmax of sensor %s must be above its airmin", sensor.Alias)
+	}
+	if sensor.AirGain < 0 {
+		return fmt.Errorf("The airgain of sensor %s cannot be negative", sensor.Alias)
+	}
+	return nil
+}
+
+// AirSensor returns the sensor to read for the air probe of a sensor. It is read from the same kind
+// of source as the sensor itself, without any calibration or filtering. Only DS18B20 sensors have air
+// probes, as other sources have nothing but the ID to tell the two probes apart.
+func AirSensor(sensor Sensor) Sensor {
+	air := sensor
+	air.ID = sensor.AirID
+	air.Alias = sensor.Alias + " air"
+	air.Offset = 0
+	air.Calibration = nil
+	air.MaxRate = 0
+	air.Filter = FilterNone
+	return air
+}
+
+// CheckAirReading returns an error if a reading of an air probe can't be real
+func CheckAirReading(sensor Sensor, reading Reading) (float64, error) {
+	if reading.Err != nil {
+		return 0, reading.Err
+	}
+	_, temp, err := FilterReading(AirSensor(sensor), State{}, reading.Temp, time.Now())
+	return temp, err
+}
+
+// AirTarget returns the temperature the air should be held at to bring the beer to its target. The
+// further the beer is from its target, the further the air is driven past it, within AirMin and AirMax.
+func AirTarget(sensor Sensor, beer float64) float64 {
+	target := sensor.SetPoint
+	if sensor.Mode != ModePID {
+		target = (sensor.HighTemp + sensor.LowTemp) / 2
+	}
+
+	gain := sensor.AirGain
+	if gain == 0 {
+		gain = DefaultAirGain
+	}
+
+	air := target + gain*(target-beer)
+	return math.Max(sensor.AirMin, math.Min(sensor.AirMax, air))
+}
+
+// ProcessCascade controls a sensor with an air probe. The beer temperature sets a target for the air,
+// and the sensor's own controller holds the air at that target. Cooling is never on with the air
+// below AirMin, or heating with it above AirMax, even during an output's minimum on time.
+func ProcessCascade(sensor Sensor, state State, beer float64, air float64) (State, error) {
+	target := AirTarget(sensor, beer)
+
+	// Control the air around its target, with the same band or setpoint as the beer
+	inner := sensor
+	half := (sensor.HighTemp - sensor.LowTemp) / 2
+	inner.LowTemp = target - half
+	inner.HighTemp = target + half
+	inner.SetPoint = target
+
+	if state.AirFault {
+		log.Printf("%s Air probe recovered", sensor.Alias)
+	}
+	prev, state := resumeOutputs(state, controlSensor(inner, state, air))
+	now := time.Now()
+	state = ProtectOutputs(sensor, prev, state, now)
+
+	// Keep the air within its limits, whatever the controller or the compressor protection wants
+	if air < sensor.AirMin {
+		state.Cooling, state.CoolChanged, state.CoolLockout = protectOutput(false, prev.Cooling, prev.CoolChanged, 0, 0, now)
+	}
+	if air > sensor.AirMax {
+		state.Heating, state.HeatChanged, state.HeatLockout = protectOutput(false, prev.Heating, prev.HeatChanged, 0, 0, now)
+	}
+
+	state, err := setOutputs(sensor, prev, state)
+	if err != nil {
+		return state, err
+	}
+
+	state.Temp = beer
+	state.AirTemp = air
+	state.AirTarget = target
+	state.Cascade = true
+	if sensor.Verbose {
+		log.Printf("%s Temp: %.2f, Air: %.2f, Air target: %.2f, Cooling: %t, Heating: %t", sensor.Alias, beer, air, target, state.Cooling, state.Heating)
+	}
+
+	return state, nil
+}
+
+// ProcessAirFault controls a sensor whose air probe can't be read on the beer temperature alone.
+// Without the air temperature nothing stops cooling from freezing the beer, so cooling is set by
+// the sensor's fail-safe action: off, held as it was, or left on the beer temperature with cool.
+// The sensor is marked with an air fault until the probe reads again.
+func ProcessAirFault(sensor Sensor, state State, beer float64, airErr error) (State, error) {
+	if !state.AirFault {
+		log.Printf("%s Air probe faulted, fail-safe action for cooling: %s", sensor.Alias, failSafeAction(sensor))
+	}
+
+	prev := state
+	state = controlSensor(sensor, state, beer)
+	switch failSafeAction(sensor) {
+	case FailSafeHold:
+		state.Cooling = prev.Cooling
+	case FailSafeCool:
+	default:
+		state.Cooling = false
+	}
+	if state.Cooling == prev.Cooling && state.Heating == prev.Heating {
+		state.Changed = prev.Changed
+	}
+
+	state, err := applyOutputs(sensor, prev, state)
+	if err != nil {
+		return state, err
+	}
+
+	state.Temp = beer
+	state.Cascade = false
+	state.AirFault = true
+	state.Error = airErr.Error()
+	if sensor.Verbose {
+		log.Printf("%s Temp: %.2f, Air probe faulted, Cooling: %t, Heating: %t", sensor.Alias, beer, state.Cooling, state.Heating)
+	}
+
+	return state, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CheckAir(t *testing.T) {
+	assert.Equal(t, nil, CheckAir(Sensor{}))
+	assert.Equal(t, nil, CheckAir(Sensor{ID: "beer", AirID: "air", AirMin: -2, AirMax: 30}))
+	assert.NotEqual(t, nil, CheckAir(Sensor{ID: "beer", AirID: "beer", AirMin: -2, AirMax: 30}))
+	assert.NotEqual(t, nil, CheckAir(Sensor{ID: "beer", AirID: "air"}))
+	assert.NotEqual(t, nil, CheckAir(Sensor{ID: "beer", AirID: "air", AirMin: -2, AirMax: 30, AirGain: -1}))
+	assert.Equal(t, nil, CheckAir(Sensor{ID: "beer", Type: "ds18b20", AirID: "air", AirMin: -2, AirMax: 30}))
+	assert.NotEqual(t, nil, CheckAir(Sensor{ID: "beer", Type: "command", AirID: "air", AirMin: -2, AirMax: 30}))
+}
+
+func Test_AirSensor(t *testing.T) {
+	sensor := Sensor{ID: "beer", Alias: "fermenter", Type: "ds18b20", AirID: "air", Offset: 1, Filter: FilterMedian}
+	air := AirSensor(sensor)
+	assert.Equal(t, "air", air.ID)
+	assert.Equal(t, "fermenter air", air.Alias)
+	assert.Equal(t, "ds18b20", air.Type)
+	assert.Equal(t, 0.0, air.Offset)
+	assert.Equal(t, FilterNone, air.Filter)
+
+	temp, err := CheckAirReading(sensor, Reading{Temp: 4})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4.0, temp)
+	_, err = CheckAirReading(sensor, Reading{Err: errors.New("broken")})
+	assert.NotEqual(t, nil, err)
+	_, err = CheckAirReading(Sensor{AirID: "air"}, Reading{Temp: 85})
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_AirTarget(t *testing.T) {
+	sensor := Sensor{HighTemp: 20, LowTemp: 18, AirMin: 0, AirMax: 30, AirGain: 5}
+
+	// On target, the air is held at the target
+	assert.Equal(t, 19.0, AirTarget(sensor, 19))
+
+	// Beer too warm, drive the air colder
+	assert.Equal(t, 14.0, AirTarget(sensor, 20))
+
+	// But no further than the limits
+	assert.Equal(t, 0.0, AirTarget(sensor, 25))
+	assert.Equal(t, 30.0, AirTarget(sensor, 10))
+
+	// PID mode uses the setpoint, and the default gain
+	sensor = Sensor{Mode: ModePID, SetPoint: 10, AirMin: 0, AirMax: 30}
+	assert.Equal(t, 10-DefaultAirGain, AirTarget(sensor, 11))
+}
+
+func Test_ProcessCascade(t *testing.T) {
+	defer CloseSwitches()
+
+	sensor := Sensor{
+		ID:         "beer",
+		Alias:      "cascade",
+		SwitchType: "fake",
+		GPIOChip:   "cascade",
+		HighTemp:   20,
+		LowTemp:    18,
+		HeatGPIO:   1,
+		CoolGPIO:   2,
+		AirID:      "air",
+		AirMin:     2,
+		AirMax:     30,
+		AirGain:    5,
+	}
+	cool, _ := CoolSwitch(sensor)
+
+	// Beer a little warm, air at the beer temperature: cool the air
+	state, err := ProcessCascade(sensor, State{Alias: "cascade"}, 20, 20)
+	assert.Equal(t, nil, err)
+	assert.True(t, state.Cascade)
+	assert.Equal(t, 20.0, state.Temp)
+	assert.Equal(t, 20.0, state.AirTemp)
+	assert.Equal(t, 14.0, state.AirTarget)
+	assert.True(t, state.Cooling)
+	on, _ := cool.State()
+	assert.True(t, on)
+
+	// Beer on target and air at its target: nothing to do
+	state, err = ProcessCascade(sensor, State{Alias: "cascade"}, 19, 19)
+	assert.Equal(t, nil, err)
+	assert.False(t, state.Cooling)
+	assert.False(t, state.Heating)
+
+	// The air is never cooled below its minimum, even if the beer is still warm
+	state, err = ProcessCascade(sensor, State{Alias: "cascade", Cooling: true}, 25, 1)
+	assert.Equal(t, nil, err)
+	assert.False(t, state.Cooling)
+	on, _ = cool.State()
+	assert.False(t, on)
+
+	// Not even while the chiller is held on by its minimum on time
+	sensor.CoolOnMinutes = 10
+	held := State{Alias: "cascade", Cooling: true, CoolChanged: time.Now()}
+	assert.True(t, ProtectOutputs(sensor, held, State{}, time.Now()).Cooling)
+	state, err = ProcessCascade(sensor, held, 25, 1)
+	assert.Equal(t, nil, err)
+	assert.False(t, state.Cooling)
+	assert.Equal(t, 0.0, state.CoolLockout)
+	on, _ = cool.State()
+	assert.False(t, on)
+	sensor.CoolOnMinutes = 0
+
+	// Or heated above its maximum
+	state, err = ProcessCascade(sensor, State{Alias: "cascade"}, 10, 31)
+	assert.Equal(t, nil, err)
+	assert.False(t, state.Heating)
+
+	// Controlling without the air probe clears the cascade
+	state, err = ProcessSensor(sensor, state, 19)
+	assert.Equal(t, nil, err)
+	assert.False(t, state.Cascade)
+}
+
+func Test_ProcessAirFault(t *testing.T) {
+	defer CloseSwitches()
+
+	sensor := Sensor{
+		ID:         "beer",
+		Alias:      "airfault",
+		SwitchType: "fake",
+		GPIOChip:   "airfault",
+		HighTemp:   20,
+		LowTemp:    18,
+		HeatGPIO:   1,
+		CoolGPIO:   2,
+		AirID:      "air",
+		AirMin:     2,
+		AirMax:     30,
+	}
+	cool, _ := CoolSwitch(sensor)
+	heat, _ := HeatSwitch(sensor)
+	airErr := errors.New("broken")
+
+	// By default, cooling is kept off without the air probe, even with the beer warm
+	state, err := ProcessAirFault(sensor, State{Alias: "airfault", Cooling: true, Cascade: true}, 25, airErr)
+	assert.Equal(t, nil, err)
+	assert.True(t, state.AirFault)
+	assert.False(t, state.Fault)
+	assert.False(t, state.Cascade)
+	assert.Equal(t, "broken", state.Error)
+	assert.Equal(t, 25.0, state.Temp)
+	assert.False(t, state.Cooling)
+	on, _ := cool.State()
+	assert.False(t, on)
+
+	// Heating is still controlled on the beer temperature
+	state, err = ProcessAirFault(sensor, state, 15, airErr)
+	assert.Equal(t, nil, err)
+	assert.True(t, state.Heating)
+	on, _ = heat.State()
+	assert.True(t, on)
+
+	// Hold leaves cooling as it was
+	sensor.FailSafe = FailSafeHold
+	changed := time.Now().Add(-time.Hour)
+	state, err = ProcessAirFault(sensor, State{Alias: "airfault", Cooling: true, Changed: changed}, 19, airErr)
+	assert.Equal(t, nil, err)
+	assert.True(t, state.Cooling)
+	assert.Equal(t, changed, state.Changed)
+
+	// Cool controls it on the beer temperature
+	sensor.FailSafe = FailSafeCool
+	state, err = ProcessAirFault(sensor, State{Alias: "airfault"}, 25, airErr)
+	assert.Equal(t, nil, err)
+	assert.True(t, state.Cooling)
+	on, _ = cool.State()
+	assert.True(t, on)
+
+	// The fault clears once the air probe reads again
+	state, err = ProcessCascade(sensor, state, 19, 19)
+	assert.Equal(t, nil, err)
+	assert.False(t, state.AirFault)
+	assert.Equal(t, "", state.Error)
+	assert.True(t, state.Cascade)
+}
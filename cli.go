@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/howeyc/gopass"
 	"github.com/yryz/ds18b20"
@@ -185,11 +187,28 @@ func PromptForConfiguration(in io.Reader) Config {
 		fmt.Print("Influx address [http://influx:8086]: ")
 		config.Influx.Addr = ReadInput(reader, "http://influx:8086")
 
-		fmt.Print("Influx Username []: ")
-		config.Influx.Username = ReadInput(reader, "")
+		fmt.Print("Influx version (1 or 2) [1]: ")
+		config.Influx.Version, err = strconv.Atoi(ReadInput(reader, "1"))
+		if err != nil {
+			panic(err)
+		}
+
+		if config.Influx.Version == InfluxV2 {
+			fmt.Print("Influx token []: ")
+			config.Influx.Token = ReadInput(reader, "")
 
-		fmt.Print("Influx Password []: ")
-		config.Influx.Password = ReadInput(reader, "")
+			fmt.Print("Influx org []: ")
+			config.Influx.Org = ReadInput(reader, "")
+
+			fmt.Print("Influx bucket []: ")
+			config.Influx.Bucket = ReadInput(reader, "")
+		} else {
+			fmt.Print("Influx Username []: ")
+			config.Influx.Username = ReadInput(reader, "")
+
+			fmt.Print("Influx Password []: ")
+			config.Influx.Password = ReadInput(reader, "")
+		}
 
 		fmt.Print("Influx UserAgent [InfluxDBClient]: ")
 		config.Influx.UserAgent = ReadInput(reader, "InfluxDBClient")
@@ -200,8 +219,10 @@ func PromptForConfiguration(in io.Reader) Config {
 			panic(err)
 		}
 
-		fmt.Print("Influx database []: ")
-		config.Influx.Database = ReadInput(reader, "")
+		if config.Influx.Version != InfluxV2 {
+			fmt.Print("Influx database []: ")
+			config.Influx.Database = ReadInput(reader, "")
+		}
 
 		fmt.Print("Enable InsecureSkipVerify? [false]: ")
 		config.Influx.InsecureSkipVerify, err = strconv.ParseBool(ReadInput(reader, "false"))
@@ -248,3 +269,133 @@ func ConfigCLI(path string) {
 
 	SaveConfig(path, config)
 }
+
+// AutotuneCLI runs a relay feedback experiment on a sensor, reports the results, and optionally writes
+// the suggested gains to the config file
+func AutotuneCLI(path string, alias string, apply bool) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var sensor *Sensor
+	for i := range config.Sensors {
+		if config.Sensors[i].Alias == alias {
+			sensor = &config.Sensors[i]
+		}
+	}
+	if sensor == nil {
+		fmt.Printf("No sensor with alias %s\n", alias)
+		os.Exit(1)
+	}
+
+	// The daemon drives the same outputs, so don't autotune while it's running
+	lock, err := LockOutputs(LockFilePath(path, config))
+	if err == ErrLocked {
+		fmt.Println("tempgopher is already running with this configuration. Stop it first, or autotune through it with POST /api/autotune/" + alias)
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+
+	run := *sensor
+	if config.Simulate {
+		run = SimulateSensor(run)
+	}
+	defer CloseSwitches()
+
+	opts := DefaultAutotuneOptions(*sensor)
+	fmt.Printf("Autotuning %s around %.2f°C\n", alias, opts.SetPoint)
+	fmt.Println("This will take at least a few cycles of heating and cooling. Press Ctrl-C to stop.")
+
+	// Stop the experiment, and turn everything off, on SIGTERM & SIGINT
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		close(stop)
+	}()
+
+	res, err := Autotune(run, opts, stop)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Printf("Ultimate gain: %.3f\n", res.Ku)
+	fmt.Printf("Ultimate period: %.0f seconds\n", res.Tu)
+	fmt.Printf("Suggested gains: kp: %.3f, ki: %.5f, kd: %.3f\n", res.Kp, res.Ki, res.Kd)
+
+	if apply {
+		// UpdateSensorConfig signals this process to reload, but there is nothing to reload here
+		signal.Ignore(syscall.SIGHUP)
+		if err = ApplyAutotune(sensor.ID, res); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Gains written to %s\n", path)
+	}
+}
+
+// CalibrateCLI calibrates a sensor against references entered by the user, and writes the
+// calibration to the config file
+func CalibrateCLI(path string, alias string) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var sensor *Sensor
+	for i := range config.Sensors {
+		if config.Sensors[i].Alias == alias {
+			sensor = &config.Sensors[i]
+		}
+	}
+	if sensor == nil {
+		fmt.Printf("No sensor with alias %s\n", alias)
+		os.Exit(1)
+	}
+
+	// The daemon drives the same outputs, so don't autotune while it's running
+	lock, err := LockOutputs(LockFilePath(path, config))
+	if err == ErrLocked {
+		fmt.Println("tempgopher is already running with this configuration. Stop it first, or autotune through it with POST /api/autotune/" + alias)
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+
+	run := *sensor
+	if config.Simulate {
+		run = SimulateSensor(run)
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	calibrated, err := PromptForCalibration(reader, *sensor, func() (float64, error) {
+		return ReadSensor(run)
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Write calibration to %s?\n", path)
+	fmt.Print("[Y/n]: ")
+	if strings.ToLower(ReadInput(reader, "y"))[0] != 'y' {
+		return
+	}
+
+	*sensor = calibrated
+	if err = SaveConfig(path, *config); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Calibration written. Reload TempGopher (send it SIGHUP) to start using it.")
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/jinzhu/copier"
 	"gopkg.in/yaml.v2"
@@ -12,30 +15,71 @@ import (
 
 // Influx defines an Influx database configuration
 type Influx struct {
-	Addr               string  `json:"string"             yaml:"addr"`
-	Username           string  `json:"username"           yaml:"username"`
-	Password           string  `json:"-"                  yaml:"password"`
-	UserAgent          string  `json:"useragent"          yaml:"useragent"`
-	Timeout            float64 `json:"timeout"            yaml:"timeout"`
-	InsecureSkipVerify bool    `json:"insecureskipverify" yaml:"insecureskipverify"`
-	Database           string  `json:"database" yaml:"database"`
+	Addr               string            `json:"string"             yaml:"addr"`
+	Username           string            `json:"username"           yaml:"username"`
+	Password           string            `json:"-"                  yaml:"password"`
+	UserAgent          string            `json:"useragent"          yaml:"useragent"`
+	Timeout            float64           `json:"timeout"            yaml:"timeout"`
+	InsecureSkipVerify bool              `json:"insecureskipverify" yaml:"insecureskipverify"`
+	Database           string            `json:"database"           yaml:"database"`
+	Version            int               `json:"version"            yaml:"version"`
+	Token              string            `json:"-"                  yaml:"token"`
+	Org                string            `json:"org"                yaml:"org"`
+	Bucket             string            `json:"bucket"             yaml:"bucket"`
+	FlushInterval      float64           `json:"flushinterval"      yaml:"flushinterval"`
+	Spool              string            `json:"spool"              yaml:"spool"`
+	Measurement        string            `json:"measurement"        yaml:"measurement"`
+	EventMeasurement   string            `json:"eventmeasurement"   yaml:"eventmeasurement"`
+	Tags               map[string]string `json:"tags"               yaml:"tags,omitempty"`
 }
 
 // Sensor defines configuration for a temperature sensor.
 type Sensor struct {
-	ID          string  `json:"id"          yaml:"id"`
-	Alias       string  `json:"alias"       yaml:"alias"`
-	HighTemp    float64 `json:"hightemp"    yaml:"hightemp"`
-	LowTemp     float64 `json:"lowtemp"     yaml:"lowtemp"`
-	HeatDisable bool    `json:"heatdisable" yaml:"heatdisable"`
-	HeatGPIO    int32   `json:"heatgpio"    yaml:"heatgpio"`
-	HeatInvert  bool    `json:"heatinvert"  yaml:"heatinvert"`
-	HeatMinutes float64 `json:"heatminutes" yaml:"heatminutes"`
-	CoolDisable bool    `json:"cooldisable" yaml:"cooldisable"`
-	CoolGPIO    int32   `json:"coolgpio"    yaml:"coolgpio"`
-	CoolInvert  bool    `json:"coolinvert"  yaml:"coolinvert"`
-	CoolMinutes float64 `json:"coolminutes" yaml:"coolminutes"`
-	Verbose     bool    `json:"verbose"     yaml:"verbose"`
+	ID             string             `json:"id"             yaml:"id"`
+	Alias          string             `json:"alias"          yaml:"alias"`
+	Type           string             `json:"type"           yaml:"type"`
+	Path           string             `json:"path"           yaml:"path"`
+	Command        string             `json:"command"        yaml:"command"`
+	URL            string             `json:"url"            yaml:"url"`
+	JSONKey        string             `json:"jsonkey"        yaml:"jsonkey"`
+	Interval       float64            `json:"interval"       yaml:"interval"`
+	Offset         float64            `json:"offset"         yaml:"offset"`
+	Calibration    []CalibrationPoint `json:"calibration"    yaml:"calibration,omitempty"`
+	MaxRate        float64            `json:"maxrate"        yaml:"maxrate"`
+	Filter         string             `json:"filter"         yaml:"filter"`
+	FilterSamples  int                `json:"filtersamples"  yaml:"filtersamples"`
+	FilterAlpha    float64            `json:"filteralpha"    yaml:"filteralpha"`
+	AirID          string             `json:"airid"          yaml:"airid"`
+	AirMin         float64            `json:"airmin"         yaml:"airmin"`
+	AirMax         float64            `json:"airmax"         yaml:"airmax"`
+	AirGain        float64            `json:"airgain"        yaml:"airgain"`
+	HighTemp       float64            `json:"hightemp"       yaml:"hightemp"`
+	LowTemp        float64            `json:"lowtemp"        yaml:"lowtemp"`
+	HeatDisable    bool               `json:"heatdisable"    yaml:"heatdisable"`
+	HeatGPIO       int32              `json:"heatgpio"       yaml:"heatgpio"`
+	HeatInvert     bool               `json:"heatinvert"     yaml:"heatinvert"`
+	HeatMinutes    float64            `json:"heatminutes"    yaml:"heatminutes"`
+	HeatOnMinutes  float64            `json:"heatonminutes"  yaml:"heatonminutes"`
+	HeatOffMinutes float64            `json:"heatoffminutes" yaml:"heatoffminutes"`
+	CoolDisable    bool               `json:"cooldisable"    yaml:"cooldisable"`
+	CoolGPIO       int32              `json:"coolgpio"       yaml:"coolgpio"`
+	CoolInvert     bool               `json:"coolinvert"     yaml:"coolinvert"`
+	CoolMinutes    float64            `json:"coolminutes"    yaml:"coolminutes"`
+	CoolOnMinutes  float64            `json:"coolonminutes"  yaml:"coolonminutes"`
+	CoolOffMinutes float64            `json:"cooloffminutes" yaml:"cooloffminutes"`
+	SwitchType     string             `json:"switch"         yaml:"switch"`
+	GPIOChip       string             `json:"gpiochip"       yaml:"gpiochip"`
+	Mode           string             `json:"mode"           yaml:"mode"`
+	SetPoint       float64            `json:"setpoint"       yaml:"setpoint"`
+	Kp             float64            `json:"kp"             yaml:"kp"`
+	Ki             float64            `json:"ki"             yaml:"ki"`
+	Kd             float64            `json:"kd"             yaml:"kd"`
+	WindowMinutes  float64            `json:"windowminutes"  yaml:"windowminutes"`
+	FailSafe       string             `json:"failsafe"       yaml:"failsafe"`
+	Profile        string             `json:"profile"        yaml:"profile"`
+	ProfileStart   *time.Time         `json:"profilestart"   yaml:"profilestart,omitempty"`
+	Vessel         Vessel             `json:"vessel"         yaml:"vessel"`
+	Verbose        bool               `json:"verbose"        yaml:"verbose"`
 }
 
 // User defines a user's configuration
@@ -46,34 +90,72 @@ type User struct {
 
 // Config contains the applications configuration
 type Config struct {
-	Sensors           []Sensor `yaml:"sensors"`
-	Users             []User   `yaml:"users"`
-	BaseURL           string   `yaml:"baseurl"`
-	ListenAddr        string   `yaml:"listenaddr"`
-	DisplayFahrenheit bool     `yaml:"displayfahrenheit"`
-	Influx            Influx   `yaml:"influx"`
+	Sensors           []Sensor  `yaml:"sensors"`
+	Users             []User    `yaml:"users"`
+	BaseURL           string    `yaml:"baseurl"`
+	ListenAddr        string    `yaml:"listenaddr"`
+	DisplayFahrenheit bool      `yaml:"displayfahrenheit"`
+	Influx            Influx    `yaml:"influx"`
+	Sinks             []Sink    `yaml:"sinks,omitempty"`
+	MQTT              MQTT      `yaml:"mqtt"`
+	Metrics           Metrics   `yaml:"metrics"`
+	Interval          float64   `yaml:"interval"`
+	ReadTimeout       float64   `yaml:"readtimeout"`
+	Simulate          bool      `yaml:"simulate"`
+	StateFile         string    `yaml:"statefile"`
+	HistoryDir        string    `yaml:"historydir"`
+	Profiles          []Profile `yaml:"profiles,omitempty"`
+	Alerts            Alerts    `yaml:"alerts"`
 }
 
+// configFilePath is the configuration file changed by the API, MQTT and autotuning. It is set
+// once at startup.
 var configFilePath string
 
-// UpdateSensorConfig updates the configuration of an individual sensor and writes to disk
-func UpdateSensorConfig(s Sensor) error {
+// configMu serializes changes to the configuration file, so one change can't overwrite another
+var configMu sync.Mutex
+
+// modifyConfig loads the configuration file, changes it with fn, and writes it back if it is still
+// valid, signalling the app to reload it. Changes are made one at a time.
+func modifyConfig(fn func(config *Config) error) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
 	config, err := LoadConfig(configFilePath)
 	if err != nil {
 		return err
 	}
 
-	for i := range config.Sensors {
-		if config.Sensors[i].ID == s.ID {
-			copier.Copy(&config.Sensors[i], &s)
-		}
+	if err := fn(config); err != nil {
+		return err
 	}
 
-	if err = SaveConfig(configFilePath, *config); err != nil {
+	if err := ValidateConfig(config); err != nil {
+		return err
+	}
+
+	return saveAndReload(*config)
+}
+
+// UpdateSensorConfig updates the configuration of an individual sensor and writes to disk
+func UpdateSensorConfig(s Sensor) error {
+	return modifyConfig(func(config *Config) error {
+		for i := range config.Sensors {
+			if config.Sensors[i].ID == s.ID {
+				copier.Copy(&config.Sensors[i], &s)
+			}
+		}
+		return nil
+	})
+}
+
+// saveAndReload writes a configuration to disk and signals the app to reload it
+func saveAndReload(config Config) error {
+	if err := SaveConfig(configFilePath, config); err != nil {
 		return err
 	}
 
-	if err = SignalReload(); err != nil {
+	if err := SignalReload(); err != nil {
 		return err
 	}
 
@@ -107,7 +189,6 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
-	configFilePath = path
 	var config Config
 	yaml.Unmarshal(data, &config)
 
@@ -116,6 +197,15 @@ func LoadConfig(path string) (*Config, error) {
 		config.ListenAddr = ":8080"
 	}
 
+	if err := ValidateConfig(&config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// ValidateConfig returns an error if a configuration can't be run
+func ValidateConfig(config *Config) error {
 	// Check for Duplicates
 	ids := make(map[string]bool)
 	aliases := make(map[string]bool)
@@ -123,15 +213,67 @@ func LoadConfig(path string) (*Config, error) {
 		if !ids[v.ID] {
 			ids[v.ID] = true
 		} else {
-			return nil, errors.New("Duplicate sensor ID found in configuration")
+			return errors.New("Duplicate sensor ID found in configuration")
 		}
 
 		if !aliases[v.Alias] {
 			aliases[v.Alias] = true
 		} else {
-			return nil, errors.New("Duplicate sensor alias found in configuration")
+			return errors.New("Duplicate sensor alias found in configuration")
+		}
+
+		if _, err := NewTemperatureSource(v); err != nil {
+			return err
+		}
+
+		if err := CheckSwitchType(v.SwitchType); err != nil {
+			return err
+		}
+
+		if v.Mode != "" && v.Mode != ModeHysteresis && v.Mode != ModePID {
+			return fmt.Errorf("Unknown mode for sensor %s: %s", v.Alias, v.Mode)
+		}
+
+		if err := CheckFailSafe(v.FailSafe); err != nil {
+			return err
+		}
+
+		if err := CheckFilter(v); err != nil {
+			return err
+		}
+
+		if err := CheckCalibration(v); err != nil {
+			return err
+		}
+
+		if err := CheckAir(v); err != nil {
+			return err
+		}
+
+		if _, ok := FindProfile(config.Profiles, v.Profile); v.Profile != "" && !ok {
+			return fmt.Errorf("Unknown profile for sensor %s: %s", v.Alias, v.Profile)
 		}
 	}
 
-	return &config, nil
+	names := make(map[string]bool)
+	for _, p := range config.Profiles {
+		if p.Name == "" || names[p.Name] {
+			return errors.New("Profile names must be unique and not blank")
+		}
+		names[p.Name] = true
+	}
+
+	if err := CheckInflux(config.Influx); err != nil {
+		return err
+	}
+
+	if err := CheckSinks(config); err != nil {
+		return err
+	}
+
+	if err := CheckAlerts(config.Alerts, config.Sensors); err != nil {
+		return err
+	}
+
+	return nil
 }
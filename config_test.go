@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
 	"testing"
 
@@ -50,6 +53,47 @@ func Test_UpdateSensorConfig(t *testing.T) {
 	// Validate SIGHUP
 	ret := <-sig
 	assert.Equal(t, syscall.SIGHUP, ret)
+
+	// Invalid changes aren't written
+	assert.NotEqual(t, nil, UpdateSensorConfig(Sensor{Alias: "bar", Mode: "bogus"}))
+	assert.NotEqual(t, nil, UpdateSensorConfig(Sensor{Alias: "bar", FailSafe: "bogus"}))
+	config, err = LoadConfig(tmpfile.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", config.Sensors[0].Mode)
+}
+
+func Test_modifyConfig(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.Remove(tmpfile.Name())
+	configFilePath = tmpfile.Name()
+	assert.Equal(t, nil, SaveConfig(tmpfile.Name(), Config{ListenAddr: ":8080"}))
+
+	sig := make(chan os.Signal, 20)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	// Changes made at the same time are all kept
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Equal(t, nil, UpdateProfileConfig(Profile{Name: strconv.Itoa(i), Segments: []Segment{Segment{Temp: 20, Hours: 1}}}))
+		}(i)
+	}
+	wg.Wait()
+	config, err := LoadConfig(tmpfile.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 10, len(config.Profiles))
+
+	// A change that fails leaves the file alone
+	assert.NotEqual(t, nil, modifyConfig(func(config *Config) error {
+		config.Profiles = nil
+		return errors.New("failed")
+	}))
+	config, _ = LoadConfig(tmpfile.Name())
+	assert.Equal(t, 10, len(config.Profiles))
 }
 
 func Test_SignalReload(t *testing.T) {
@@ -134,6 +178,30 @@ func Test_LoadConfig(t *testing.T) {
 	_, err = LoadConfig("tests/duplicate_alias.yml")
 	assert.NotEqual(t, nil, err)
 
+	// Test for failure with an unknown mode
+	_, err = LoadConfig("tests/bad_mode.yml")
+	assert.NotEqual(t, nil, err)
+
+	// Test for failure with an unknown fail-safe action
+	_, err = LoadConfig("tests/bad_failsafe.yml")
+	assert.NotEqual(t, nil, err)
+
+	// Test for failure with air limits the wrong way around
+	_, err = LoadConfig("tests/bad_air.yml")
+	assert.NotEqual(t, nil, err)
+
+	// Test for failure with an alert on an unknown sensor
+	_, err = LoadConfig("tests/bad_alert.yml")
+	assert.NotEqual(t, nil, err)
+
+	// Test for failure with InfluxDB 2.x missing a bucket
+	_, err = LoadConfig("tests/bad_influx.yml")
+	assert.NotEqual(t, nil, err)
+
+	// Test for failure with two sinks of the same name
+	_, err = LoadConfig("tests/bad_sink.yml")
+	assert.NotEqual(t, nil, err)
+
 	// Test for non-existence
 	_, err = LoadConfig("DNE")
 	assert.NotEqual(t, nil, err)
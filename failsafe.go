@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Fail-safe actions for a faulted sensor
+const (
+	FailSafeOff  = "off"
+	FailSafeHold = "hold"
+	FailSafeCool = "cool"
+)
+
+// faultThreshold is how many reads in a row must fail before a sensor is faulted. Until then the
+// outputs are left as they are, so a single bad read doesn't change anything.
+const faultThreshold = 3
+
+// Delays between retries of a failing sensor. The delay doubles with each failure, up to retryMax.
+const (
+	retryBase = time.Second
+	retryMax  = time.Minute
+)
+
+// CheckFailSafe returns an error if a fail-safe action isn't known
+func CheckFailSafe(action string) error {
+	switch action {
+	case "", FailSafeOff, FailSafeHold, FailSafeCool:
+		return nil
+	}
+	return fmt.Errorf("Unknown fail-safe action: %s", action)
+}
+
+// RetryDelay returns how long to wait before reading a sensor again after it has failed
+func RetryDelay(failures int) time.Duration {
+	delay := retryBase
+	for i := 1; i < failures && delay < retryMax; i++ {
+		delay *= 2
+	}
+	if delay > retryMax {
+		delay = retryMax
+	}
+	return delay
+}
+
+// FailSensor records a failed read of a sensor. After faultThreshold failures in a row the sensor
+// is faulted, and its outputs are set by its fail-safe action until readings return. The minimum
+// on and off times still apply.
+func FailSensor(sensor Sensor, state State, err error) (State, error) {
+	state.Failures++
+	state.Error = err.Error()
+	sensorReadErrors.WithLabelValues(sensor.Alias).Inc()
+	log.Printf("%s Unable to read sensor (%d in a row): %v", sensor.Alias, state.Failures, err)
+
+	if state.Failures < faultThreshold {
+		return state, nil
+	}
+
+	if !state.Fault {
+		log.Printf("%s Sensor faulted, fail-safe action: %s", sensor.Alias, failSafeAction(sensor))
+	}
+	state.Fault = true
+
+	prev := state
+	switch failSafeAction(sensor) {
+	case FailSafeHold:
+		return state, nil
+	case FailSafeCool:
+		state.Cooling = !sensor.CoolDisable
+		state.Heating = false
+	default:
+		state.Cooling = false
+		state.Heating = false
+	}
+	if state.Cooling != prev.Cooling || state.Heating != prev.Heating {
+		state.Changed = time.Now()
+	}
+
+	return applyOutputs(sensor, prev, state)
+}
+
+// SwitchFault handles a sensor whose outputs couldn't be switched. The sensor is marked as
+// faulted and its outputs are turned off, as far as that is still possible.
+func SwitchFault(sensor Sensor, state State, err error) State {
+	log.Printf("%s Unable to switch outputs, turning them off: %v", sensor.Alias, err)
+	state.Fault = true
+	state.Error = err.Error()
+
+	now := time.Now()
+	if state.Cooling {
+		state.Cooling = false
+		state.CoolChanged = now
+	}
+	if state.Heating {
+		state.Heating = false
+		state.HeatChanged = now
+	}
+	TurnOffSensor(sensor)
+
+	return state
+}
+
+// failSafeAction returns the fail-safe action of a sensor, which is off unless configured
+func failSafeAction(sensor Sensor) string {
+	if sensor.FailSafe == "" {
+		return FailSafeOff
+	}
+	return sensor.FailSafe
+}
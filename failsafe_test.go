@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CheckFailSafe(t *testing.T) {
+	for _, action := range []string{"", FailSafeOff, FailSafeHold, FailSafeCool} {
+		assert.Equal(t, nil, CheckFailSafe(action))
+	}
+	assert.NotEqual(t, nil, CheckFailSafe("DNE"))
+}
+
+func Test_RetryDelay(t *testing.T) {
+	assert.Equal(t, time.Second, RetryDelay(1))
+	assert.Equal(t, 2*time.Second, RetryDelay(2))
+	assert.Equal(t, 4*time.Second, RetryDelay(3))
+	assert.Equal(t, retryMax, RetryDelay(10))
+	assert.Equal(t, retryMax, RetryDelay(1000))
+}
+
+func Test_FailSensor(t *testing.T) {
+	defer CloseSwitches()
+
+	sensor := Sensor{Alias: "fail", SwitchType: "fake", GPIOChip: "fail", HeatGPIO: 1, CoolGPIO: 2}
+	cool, _ := CoolSwitch(sensor)
+	heat, _ := HeatSwitch(sensor)
+	readErr := errors.New("CRC error")
+
+	// Outputs are left alone until the sensor has failed a few times
+	heat.On()
+	state := State{Alias: "fail", Heating: true}
+	var err error
+	for i := 1; i < faultThreshold; i++ {
+		state, err = FailSensor(sensor, state, readErr)
+		assert.Equal(t, nil, err)
+		assert.False(t, state.Fault)
+		assert.Equal(t, i, state.Failures)
+		assert.Equal(t, "CRC error", state.Error)
+		assert.True(t, state.Heating)
+	}
+
+	// Then the default fail-safe turns everything off
+	state, err = FailSensor(sensor, state, readErr)
+	assert.Equal(t, nil, err)
+	assert.True(t, state.Fault)
+	assert.False(t, state.Heating)
+	on, _ := heat.State()
+	assert.False(t, on)
+
+	// Holding leaves the outputs as they were
+	sensor.FailSafe = FailSafeHold
+	heat.On()
+	state = State{Alias: "fail", Heating: true, Failures: faultThreshold}
+	state, _ = FailSensor(sensor, state, readErr)
+	assert.True(t, state.Fault)
+	assert.True(t, state.Heating)
+	on, _ = heat.State()
+	assert.True(t, on)
+
+	// Forcing cooling turns the heater off and the chiller on
+	sensor.FailSafe = FailSafeCool
+	state, _ = FailSensor(sensor, state, readErr)
+	assert.True(t, state.Cooling)
+	assert.False(t, state.Heating)
+	on, _ = cool.State()
+	assert.True(t, on)
+	on, _ = heat.State()
+	assert.False(t, on)
+
+	// But not if cooling is disabled
+	sensor.CoolDisable = true
+	state, _ = FailSensor(sensor, State{Failures: faultThreshold}, readErr)
+	assert.False(t, state.Cooling)
+
+	// A good reading clears the fault
+	sensor = Sensor{Alias: "fail", SwitchType: "fake", GPIOChip: "fail", HeatGPIO: 1, CoolGPIO: 2, HighTemp: 20, LowTemp: 10}
+	state, err = ProcessSensor(sensor, State{Fault: true, Failures: 5, Error: "CRC error"}, 15)
+	assert.Equal(t, nil, err)
+	assert.False(t, state.Fault)
+	assert.Equal(t, 0, state.Failures)
+	assert.Equal(t, "", state.Error)
+	assert.Equal(t, 15.0, state.Temp)
+}
+
+func Test_SwitchFault(t *testing.T) {
+	defer CloseSwitches()
+
+	sensor := Sensor{Alias: "fault", SwitchType: "fake", GPIOChip: "fault", HeatGPIO: 1, CoolGPIO: 2}
+	heat, _ := HeatSwitch(sensor)
+	heat.On()
+
+	// The sensor is faulted and its outputs turned off
+	state := SwitchFault(sensor, State{Alias: "fault", Heating: true}, errors.New("Pin is busy"))
+	assert.True(t, state.Fault)
+	assert.Equal(t, "Pin is busy", state.Error)
+	assert.False(t, state.Heating)
+	assert.False(t, state.HeatChanged.IsZero())
+	on, _ := heat.State()
+	assert.False(t, on)
+}
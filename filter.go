@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Filters for smoothing readings
+const (
+	FilterNone   = ""
+	FilterMedian = "median"
+	FilterEMA    = "ema"
+)
+
+// Defaults for the filters when a sensor doesn't set them
+const (
+	DefaultFilterSamples = 5
+	DefaultFilterAlpha   = 0.3
+)
+
+// DS18B20 sensors report 85°C when they have reset without converting a temperature, and -127°C when
+// they can't be read. A real 85°C is only believed when the last reading was close to it.
+const (
+	ds18b20ResetTemp  = 85.0
+	ds18b20ErrorTemp  = -127.0
+	ds18b20ResetRange = 5.0
+)
+
+// CheckFilter returns an error if a sensor's filter settings aren't valid
+func CheckFilter(sensor Sensor) error {
+	switch sensor.Filter {
+	case FilterNone, FilterMedian, FilterEMA:
+	default:
+		return fmt.Errorf("Unknown filter for sensor %s: %s", sensor.Alias, sensor.Filter)
+	}
+	if sensor.FilterAlpha < 0 || sensor.FilterAlpha > 1 {
+		return fmt.Errorf("The filteralpha of sensor %s must be between 0 and 1", sensor.Alias)
+	}
+	if sensor.FilterSamples < 0 || sensor.MaxRate < 0 {
+		return fmt.Errorf("The filtersamples and maxrate of sensor %s cannot be negative", sensor.Alias)
+	}
+	return nil
+}
+
+// FilterReading checks a raw reading is plausible, and returns the calibrated temperature to control
+// with. The raw reading and recent raw samples are kept in the state. Implausible readings return an
+// error, so they are handled like a failed read. The state's When and Raw must be those of the
+// last accepted reading.
+func FilterReading(sensor Sensor, state State, raw float64, now time.Time) (State, float64, error) {
+	if math.IsNaN(raw) || math.IsInf(raw, 0) {
+		return state, 0, errors.New("Implausible reading: not a number")
+	}
+
+	previous := len(state.Samples) > 0
+	if sensor.Type == "" || sensor.Type == "ds18b20" {
+		if raw == ds18b20ErrorTemp {
+			return state, 0, errors.New("Implausible reading: sensor error value")
+		}
+		if raw == ds18b20ResetTemp && (!previous || math.Abs(state.Raw-raw) > ds18b20ResetRange) {
+			return state, 0, errors.New("Implausible reading: sensor power-on reset value")
+		}
+	}
+
+	// The allowed change grows while readings are rejected, so a real jump is accepted eventually
+	if sensor.MaxRate > 0 && previous {
+		minutes := now.Sub(state.When).Minutes()
+		if change := math.Abs(raw - state.Raw); change > sensor.MaxRate*minutes {
+			return state, 0, fmt.Errorf("Implausible reading: %.2f changed by %.2f in %.1f minutes", raw, change, minutes)
+		}
+	}
+
+	n := sensor.FilterSamples
+	if n <= 0 {
+		n = DefaultFilterSamples
+	}
+	state.Samples = append(state.Samples, raw)
+	if len(state.Samples) > n {
+		state.Samples = state.Samples[len(state.Samples)-n:]
+	}
+	state.Raw = raw
+
+	temp := Calibrate(sensor, raw)
+	switch sensor.Filter {
+	case FilterMedian:
+		temp = Calibrate(sensor, median(state.Samples))
+	case FilterEMA:
+		alpha := sensor.FilterAlpha
+		if alpha <= 0 {
+			alpha = DefaultFilterAlpha
+		}
+		if previous {
+			temp = alpha*temp + (1-alpha)*state.Temp
+		}
+	}
+
+	return state, temp, nil
+}
+
+// median returns the middle of some values, or the mean of the middle two
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CheckFilter(t *testing.T) {
+	assert.Equal(t, nil, CheckFilter(Sensor{}))
+	assert.Equal(t, nil, CheckFilter(Sensor{Filter: FilterMedian, FilterSamples: 3}))
+	assert.Equal(t, nil, CheckFilter(Sensor{Filter: FilterEMA, FilterAlpha: 0.5}))
+	assert.NotEqual(t, nil, CheckFilter(Sensor{Filter: "DNE"}))
+	assert.NotEqual(t, nil, CheckFilter(Sensor{FilterAlpha: 2}))
+	assert.NotEqual(t, nil, CheckFilter(Sensor{FilterSamples: -1}))
+	assert.NotEqual(t, nil, CheckFilter(Sensor{MaxRate: -1}))
+}
+
+func Test_FilterReading(t *testing.T) {
+	now := time.Now()
+	sensor := Sensor{}
+
+	// Values that are never real
+	for _, raw := range []float64{math.NaN(), math.Inf(1), -127, 85} {
+		_, _, err := FilterReading(sensor, State{}, raw, now)
+		assert.NotEqual(t, nil, err)
+	}
+
+	// Without a filter, readings are used as they are
+	state, temp, err := FilterReading(sensor, State{}, 20, now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 20.0, temp)
+	assert.Equal(t, 20.0, state.Raw)
+	assert.Equal(t, []float64{20}, state.Samples)
+
+	// 85 is believed when the last reading was close to it
+	state.Raw = 84
+	_, temp, err = FilterReading(sensor, state, 85, now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 85.0, temp)
+
+	// Other sources can read 85 or -127
+	_, _, err = FilterReading(Sensor{Type: "command"}, State{}, 85, now)
+	assert.Equal(t, nil, err)
+
+	// Changes faster than the max rate are rejected
+	sensor.MaxRate = 1
+	state = State{When: now.Add(-time.Minute), Raw: 20, Samples: []float64{20}}
+	_, _, err = FilterReading(sensor, state, 25, now)
+	assert.NotEqual(t, nil, err)
+	_, _, err = FilterReading(sensor, state, 20.5, now)
+	assert.Equal(t, nil, err)
+
+	// But the allowed change grows with time, so a real change gets through
+	_, _, err = FilterReading(sensor, state, 25, now.Add(5*time.Minute))
+	assert.Equal(t, nil, err)
+}
+
+func Test_FilterReadingSmoothing(t *testing.T) {
+	now := time.Now()
+
+	// A median ignores a single spike
+	sensor := Sensor{Filter: FilterMedian, FilterSamples: 3}
+	state := State{}
+	var temp float64
+	for _, raw := range []float64{20, 20.2, 30, 20.4} {
+		state, temp, _ = FilterReading(sensor, state, raw, now)
+	}
+	assert.Equal(t, 3, len(state.Samples))
+	assert.Equal(t, 20.4, temp)
+	assert.Equal(t, 20.4, state.Raw)
+
+	// An average of an even number of samples
+	assert.Equal(t, 2.5, median([]float64{4, 1, 3, 2}))
+
+	// An EMA moves part of the way towards each reading
+	sensor = Sensor{Filter: FilterEMA, FilterAlpha: 0.5}
+	state, temp, _ = FilterReading(sensor, State{}, 20, now)
+	assert.Equal(t, 20.0, temp)
+	state.Temp = temp
+	state, temp, _ = FilterReading(sensor, state, 22, now)
+	assert.Equal(t, 21.0, temp)
+	assert.Equal(t, 22.0, state.Raw)
+}
+
+func Test_FilterReadingCalibration(t *testing.T) {
+	now := time.Now()
+	sensor := Sensor{Offset: -0.5, Filter: FilterEMA, FilterAlpha: 0.5}
+
+	// Raw readings are kept as they are, and the temperature calibrated
+	state, temp, err := FilterReading(sensor, State{}, 20, now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 20.0, state.Raw)
+	assert.Equal(t, 19.5, temp)
+
+	// Smoothing works on calibrated temperatures
+	state.Temp = temp
+	_, temp, _ = FilterReading(sensor, state, 22, now)
+	assert.Equal(t, 20.5, temp)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Definitions from linux/gpio.h (v1 ABI)
+const (
+	gpioGetLineHandleIoctl       = 0xc16cb403
+	gpioHandleGetLineValuesIoctl = 0xc040b408
+	gpioHandleSetLineValuesIoctl = 0xc040b409
+	gpioHandleRequestOutput      = 1 << 1
+)
+
+type gpioHandleRequest struct {
+	LineOffsets   [64]uint32
+	Flags         uint32
+	DefaultValues [64]uint8
+	ConsumerLabel [32]byte
+	Lines         uint32
+	Fd            int32
+}
+
+type gpioHandleData struct {
+	Values [64]uint8
+}
+
+// gpiochipSwitch drives a single output line through the Linux GPIO character device.
+// The line is held for as long as the switch is open.
+type gpiochipSwitch struct {
+	fd uintptr
+}
+
+func newGPIOChipSwitch(chip string, pin int32) (Switch, error) {
+	f, err := os.OpenFile(chip, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	req := gpioHandleRequest{Flags: gpioHandleRequestOutput, Lines: 1}
+	req.LineOffsets[0] = uint32(pin)
+	copy(req.ConsumerLabel[:], "tempgopher")
+
+	if err := ioctl(f.Fd(), gpioGetLineHandleIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, os.NewSyscallError("GPIO_GET_LINEHANDLE_IOCTL", err)
+	}
+
+	return &gpiochipSwitch{fd: uintptr(req.Fd)}, nil
+}
+
+func (s *gpiochipSwitch) set(value uint8) error {
+	var data gpioHandleData
+	data.Values[0] = value
+	return ioctl(s.fd, gpioHandleSetLineValuesIoctl, unsafe.Pointer(&data))
+}
+
+func (s *gpiochipSwitch) On() error {
+	return s.set(1)
+}
+
+func (s *gpiochipSwitch) Off() error {
+	return s.set(0)
+}
+
+func (s *gpiochipSwitch) State() (bool, error) {
+	var data gpioHandleData
+	if err := ioctl(s.fd, gpioHandleGetLineValuesIoctl, unsafe.Pointer(&data)); err != nil {
+		return false, err
+	}
+	return data.Values[0] == 1, nil
+}
+
+// Close releases the line back to the kernel.
+func (s *gpiochipSwitch) Close() error {
+	return syscall.Close(int(s.fd))
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func newGPIOChipSwitch(chip string, pin int32) (Switch, error) {
+	return nil, errors.New("GPIO character devices are only supported on Linux")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// WriterHealth reports how a sink writing states is doing. Pending points are waiting
+// for the next write, spooled points are kept on disk until the database can be reached,
+// dropped points were lost because the spool was full, and rejected points were refused by
+// the database as invalid.
+type WriterHealth struct {
+	Enabled   bool      `json:"enabled"`
+	Healthy   bool      `json:"healthy"`
+	LastWrite time.Time `json:"lastwrite"`
+	LastError string    `json:"lasterror"`
+	ErrorTime time.Time `json:"errortime"`
+	Pending   int       `json:"pending"`
+	Spooled   int       `json:"spooled"`
+	Dropped   int       `json:"dropped"`
+	Rejected  int       `json:"rejected"`
+}
+
+var (
+	healthMu sync.Mutex
+	healths  = make(map[string]WriterHealth)
+)
+
+// SetWriterHealth records the health of a writer
+func SetWriterHealth(name string, health WriterHealth) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	healths[name] = health
+}
+
+// GetWriterHealth returns the health of every writer, keyed by name
+func GetWriterHealth() map[string]WriterHealth {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	h := make(map[string]WriterHealth, len(healths))
+	for k, v := range healths {
+		h[k] = v
+	}
+	return h
+}
+
+// RemoveWriterHealth forgets a writer that has stopped
+func RemoveWriterHealth(name string) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	delete(healths, name)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HistoryPoint is the average state of a sensor over a period of time. Heating and
+// Cooling are the fraction of the period that each output was on.
+type HistoryPoint struct {
+	Time    time.Time `json:"time"`
+	Temp    float64   `json:"temp"`
+	High    float64   `json:"high"`
+	Low     float64   `json:"low"`
+	Heating float64   `json:"heating"`
+	Cooling float64   `json:"cooling"`
+}
+
+// historyTier is one resolution of stored history. Each tier is a fixed size ring of
+// records on disk, so older data is kept at coarser resolutions without growing.
+type historyTier struct {
+	name       string
+	resolution time.Duration
+	capacity   int64
+}
+
+// retention is how far back a tier reaches
+func (t historyTier) retention() time.Duration {
+	return t.resolution * time.Duration(t.capacity)
+}
+
+var historyTiers = []historyTier{
+	{name: "1m", resolution: time.Minute, capacity: 2 * 24 * 60},       // 2 days
+	{name: "15m", resolution: 15 * time.Minute, capacity: 14 * 24 * 4}, // 2 weeks
+	{name: "1h", resolution: time.Hour, capacity: 60 * 24},             // 60 days
+}
+
+// historyRecordSize is the size of a record on disk: the start of the period in unix
+// seconds, followed by temp, high, low, heating and cooling.
+const historyRecordSize = 6 * 8
+
+// HistoryPath returns where history should be stored for a configuration. Unless
+// configured, it is a history directory next to the config file.
+func HistoryPath(configPath string, config *Config) string {
+	if config.HistoryDir != "" {
+		return config.HistoryDir
+	}
+	return filepath.Join(filepath.Dir(configPath), "history")
+}
+
+func historyFile(dir string, alias string, tier historyTier) string {
+	return filepath.Join(dir, url.PathEscape(alias)+"."+tier.name)
+}
+
+// historyBucket accumulates the readings of one period
+type historyBucket struct {
+	start time.Time
+	count float64
+	point HistoryPoint
+}
+
+func (b *historyBucket) add(p HistoryPoint) {
+	b.count++
+	b.point.Temp += p.Temp
+	b.point.High += p.High
+	b.point.Low += p.Low
+	b.point.Heating += p.Heating
+	b.point.Cooling += p.Cooling
+}
+
+func (b *historyBucket) average() HistoryPoint {
+	return HistoryPoint{
+		Time:    b.start,
+		Temp:    b.point.Temp / b.count,
+		High:    b.point.High / b.count,
+		Low:     b.point.Low / b.count,
+		Heating: b.point.Heating / b.count,
+		Cooling: b.point.Cooling / b.count,
+	}
+}
+
+// historyKey identifies the period in progress for a sensor at one tier
+type historyKey struct {
+	alias string
+	tier  int
+}
+
+// HistoryWriter records the states of sensors to disk
+type HistoryWriter struct {
+	dir     string
+	mu      sync.Mutex
+	buckets map[historyKey]*historyBucket
+}
+
+// NewHistoryWriter creates a writer that stores history in dir
+func NewHistoryWriter(dir string) (*HistoryWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &HistoryWriter{dir: dir, buckets: make(map[historyKey]*historyBucket)}, nil
+}
+
+// Record adds a reading to the history of a sensor. The band stored with it is the one the
+// sensor is controlling to, which for PID mode is just the setpoint. States of a faulted sensor
+// hold an old temperature, so they are skipped.
+func (w *HistoryWriter) Record(sensor Sensor, s State) error {
+	if s.Fault {
+		return nil
+	}
+
+	p := HistoryPoint{Time: s.When, Temp: s.Temp, High: sensor.HighTemp, Low: sensor.LowTemp}
+	if sensor.Mode == ModePID {
+		p.High = sensor.SetPoint
+		p.Low = sensor.SetPoint
+	}
+	if s.Heating {
+		p.Heating = 1
+	}
+	if s.Cooling {
+		p.Cooling = 1
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i, tier := range historyTiers {
+		key := historyKey{alias: sensor.Alias, tier: i}
+		start := p.Time.Truncate(tier.resolution)
+
+		b, ok := w.buckets[key]
+		if ok && !b.start.Equal(start) {
+			// The period is over, write it out and start the next
+			if err := writeHistoryRecord(historyFile(w.dir, sensor.Alias, tier), tier, b.average()); err != nil {
+				return err
+			}
+			ok = false
+		}
+		if !ok {
+			b = &historyBucket{start: start}
+			w.buckets[key] = b
+		}
+		b.add(p)
+	}
+
+	return nil
+}
+
+// HandleEvent records state events, so the writer can subscribe to a Hub
+func (w *HistoryWriter) HandleEvent(e Event) {
+	if e.Type != EventState {
+		return
+	}
+	if err := w.Record(e.Sensor, e.State); err != nil {
+		log.Println("Unable to record history:", err)
+	}
+}
+
+// Flush writes every period in progress, for example before shutting down. Any readings
+// recorded later in the same periods overwrite them.
+func (w *HistoryWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for key, b := range w.buckets {
+		tier := historyTiers[key.tier]
+		if err := writeHistoryRecord(historyFile(w.dir, key.alias, tier), tier, b.average()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeHistoryRecord(path string, tier historyTier, p HistoryPoint) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	unix := p.Time.Unix()
+	slot := (unix / int64(tier.resolution.Seconds())) % tier.capacity
+
+	buf := make([]byte, historyRecordSize)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(unix))
+	binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(p.Temp))
+	binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(p.High))
+	binary.LittleEndian.PutUint64(buf[24:], math.Float64bits(p.Low))
+	binary.LittleEndian.PutUint64(buf[32:], math.Float64bits(p.Heating))
+	binary.LittleEndian.PutUint64(buf[40:], math.Float64bits(p.Cooling))
+
+	_, err = f.WriteAt(buf, slot*historyRecordSize)
+	return err
+}
+
+func readHistoryRecords(path string, from time.Time, to time.Time) ([]HistoryPoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var points []HistoryPoint
+	for i := 0; i+historyRecordSize <= len(data); i += historyRecordSize {
+		unix := int64(binary.LittleEndian.Uint64(data[i:]))
+		if unix == 0 {
+			continue // Never written
+		}
+
+		t := time.Unix(unix, 0)
+		if t.Before(from) || t.After(to) {
+			continue
+		}
+
+		points = append(points, HistoryPoint{
+			Time:    t,
+			Temp:    math.Float64frombits(binary.LittleEndian.Uint64(data[i+8:])),
+			High:    math.Float64frombits(binary.LittleEndian.Uint64(data[i+16:])),
+			Low:     math.Float64frombits(binary.LittleEndian.Uint64(data[i+24:])),
+			Heating: math.Float64frombits(binary.LittleEndian.Uint64(data[i+32:])),
+			Cooling: math.Float64frombits(binary.LittleEndian.Uint64(data[i+40:])),
+		})
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points, nil
+}
+
+// ReadHistory returns the history of a sensor between from and to. It uses the finest
+// resolution still holding data from that far back. If step is longer than that
+// resolution, points are averaged together into periods of step.
+func ReadHistory(dir string, alias string, from time.Time, to time.Time, step time.Duration) ([]HistoryPoint, error) {
+	if to.Before(from) {
+		return nil, errors.New("History must end after it starts")
+	}
+
+	tier := historyTiers[len(historyTiers)-1]
+	for _, t := range historyTiers {
+		if time.Since(from) <= t.retention() {
+			tier = t
+			break
+		}
+	}
+
+	points, err := readHistoryRecords(historyFile(dir, alias, tier), from, to)
+	if err != nil || step <= tier.resolution {
+		return points, err
+	}
+
+	var downsampled []HistoryPoint
+	var b *historyBucket
+	for _, p := range points {
+		start := p.Time.Truncate(step)
+		if b != nil && !b.start.Equal(start) {
+			downsampled = append(downsampled, b.average())
+			b = nil
+		}
+		if b == nil {
+			b = &historyBucket{start: start}
+		}
+		b.add(p)
+	}
+	if b != nil {
+		downsampled = append(downsampled, b.average())
+	}
+
+	return downsampled, nil
+}
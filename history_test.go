@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HistoryPath(t *testing.T) {
+	assert.Equal(t, "/etc/tempgopher/history", HistoryPath("/etc/tempgopher/config.yml", &Config{}))
+	assert.Equal(t, "/var/lib/history", HistoryPath("config.yml", &Config{HistoryDir: "/var/lib/history"}))
+}
+
+func Test_History(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	w, err := NewHistoryWriter(dir)
+	assert.Equal(t, nil, err)
+
+	sensor := Sensor{Alias: "foo bar", HighTemp: 20, LowTemp: 10}
+	start := time.Now().Add(-time.Hour).Truncate(time.Hour)
+
+	// Two readings a minute for 30 minutes, heating for the first half of each minute
+	for i := 0; i < 60; i++ {
+		s := State{When: start.Add(time.Duration(i) * 30 * time.Second), Temp: float64(i % 2), Heating: i%2 == 0}
+		assert.Equal(t, nil, w.Record(sensor, s))
+	}
+
+	// The last minute is still in progress
+	points, err := ReadHistory(dir, sensor.Alias, start, time.Now(), 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 29, len(points))
+	assert.True(t, start.Equal(points[0].Time))
+	assert.Equal(t, 0.5, points[0].Temp)
+	assert.Equal(t, 0.5, points[0].Heating)
+	assert.Equal(t, 0.0, points[0].Cooling)
+	assert.Equal(t, 20.0, points[0].High)
+	assert.Equal(t, 10.0, points[0].Low)
+
+	// Until it is flushed
+	assert.Equal(t, nil, w.Flush())
+	points, _ = ReadHistory(dir, sensor.Alias, start, time.Now(), 0)
+	assert.Equal(t, 30, len(points))
+
+	// Points can be combined into longer steps
+	points, _ = ReadHistory(dir, sensor.Alias, start, time.Now(), 10*time.Minute)
+	assert.Equal(t, 3, len(points))
+	assert.True(t, start.Add(10*time.Minute).Equal(points[1].Time))
+	assert.Equal(t, 0.5, points[1].Heating)
+
+	// Only the requested range is returned
+	points, _ = ReadHistory(dir, sensor.Alias, start.Add(5*time.Minute), start.Add(9*time.Minute), 0)
+	assert.Equal(t, 5, len(points))
+
+	// Coarser resolutions are used further back
+	points, _ = ReadHistory(dir, sensor.Alias, time.Now().Add(-7*24*time.Hour), time.Now(), 0)
+	assert.Equal(t, 2, len(points))
+	assert.Equal(t, 0.5, points[0].Temp)
+
+	// PID sensors store their setpoint as the band
+	pid := Sensor{Alias: "pid", Mode: ModePID, SetPoint: 18, HighTemp: 20, LowTemp: 10}
+	assert.Equal(t, nil, w.Record(pid, State{When: start, Temp: 18, Cooling: true}))
+	assert.Equal(t, nil, w.Flush())
+	points, _ = ReadHistory(dir, pid.Alias, start, time.Now(), 0)
+	assert.Equal(t, 1, len(points))
+	assert.Equal(t, 18.0, points[0].High)
+	assert.Equal(t, 18.0, points[0].Low)
+	assert.Equal(t, 1.0, points[0].Cooling)
+
+	// State events from a hub are recorded, other events ignored
+	w.HandleEvent(Event{Type: EventConfig, Config: &Config{}})
+	w.HandleEvent(Event{Type: EventState, Sensor: Sensor{Alias: "hub"}, State: State{When: start, Temp: 5}})
+	assert.Equal(t, nil, w.Flush())
+	points, _ = ReadHistory(dir, "hub", start, time.Now(), 0)
+	assert.Equal(t, 1, len(points))
+	assert.Equal(t, 5.0, points[0].Temp)
+
+	// Unknown sensors have no history
+	points, err = ReadHistory(dir, "DNE", start, time.Now(), 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(points))
+
+	// The range must make sense
+	_, err = ReadHistory(dir, sensor.Alias, time.Now(), start, 0)
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_HistoryRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	// Records wrap around, replacing the oldest
+	tier := historyTiers[0]
+	path := filepath.Join(dir, "ring")
+	old := time.Unix(0, 0).Add(tier.resolution)
+	assert.Equal(t, nil, writeHistoryRecord(path, tier, HistoryPoint{Time: old, Temp: 1}))
+	assert.Equal(t, nil, writeHistoryRecord(path, tier, HistoryPoint{Time: old.Add(tier.retention()), Temp: 2}))
+
+	info, err := os.Stat(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(2*historyRecordSize), info.Size())
+
+	points, err := readHistoryRecords(path, time.Unix(0, 0), time.Now())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(points))
+	assert.Equal(t, 2.0, points[0].Temp)
+}
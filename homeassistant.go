@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+)
+
+// DefaultDiscoveryPrefix is where Home Assistant looks for discovery messages, unless it's configured otherwise
+const DefaultDiscoveryPrefix = "homeassistant"
+
+// The range of temperatures Home Assistant offers for a thermostat, wide enough for fermenting and mashing
+const (
+	discoveryMinTemp = -10.0
+	discoveryMaxTemp = 110.0
+)
+
+// Templates Home Assistant uses to read the state topic of a sensor
+const (
+	discoveryTempTemplate     = "{{ value_json.temp }}"
+	discoveryOutputsTemplate  = "{{ value_json.outputs }}"
+	discoveryHighTemplate     = "{{ value_json.hightemp }}"
+	discoveryLowTemplate      = "{{ value_json.lowtemp }}"
+	discoverySetPointTemplate = "{{ value_json.setpoint }}"
+	discoveryActionTemplate   = "{% if value_json.heating %}heating{% elif value_json.cooling %}cooling{% elif value_json.outputs == 'off' %}off{% else %}idle{% endif %}"
+)
+
+// DiscoveryDevice groups the entities of a sensor into one device in Home Assistant
+type DiscoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SWVersion    string   `json:"sw_version"`
+}
+
+// ClimateDiscovery is the Home Assistant discovery message of a thermostat. Hysteresis sensors have
+// a low and high target, and PID sensors a single target, their setpoint.
+type ClimateDiscovery struct {
+	Name                string          `json:"name"`
+	UniqueID            string          `json:"unique_id"`
+	Device              DiscoveryDevice `json:"device"`
+	AvailabilityTopic   string          `json:"availability_topic"`
+	PayloadAvailable    string          `json:"payload_available"`
+	PayloadNotAvailable string          `json:"payload_not_available"`
+	Modes               []string        `json:"modes"`
+	ModeStateTopic      string          `json:"mode_state_topic"`
+	ModeStateTemplate   string          `json:"mode_state_template"`
+	ModeCommandTopic    string          `json:"mode_command_topic"`
+	ModeCommandTemplate string          `json:"mode_command_template"`
+	CurrentTempTopic    string          `json:"current_temperature_topic"`
+	CurrentTempTemplate string          `json:"current_temperature_template"`
+	ActionTopic         string          `json:"action_topic"`
+	ActionTemplate      string          `json:"action_template"`
+	TempStateTopic      string          `json:"temperature_state_topic,omitempty"`
+	TempStateTemplate   string          `json:"temperature_state_template,omitempty"`
+	TempCommandTopic    string          `json:"temperature_command_topic,omitempty"`
+	TempCommandTemplate string          `json:"temperature_command_template,omitempty"`
+	HighStateTopic      string          `json:"temperature_high_state_topic,omitempty"`
+	HighStateTemplate   string          `json:"temperature_high_state_template,omitempty"`
+	HighCommandTopic    string          `json:"temperature_high_command_topic,omitempty"`
+	HighCommandTemplate string          `json:"temperature_high_command_template,omitempty"`
+	LowStateTopic       string          `json:"temperature_low_state_topic,omitempty"`
+	LowStateTemplate    string          `json:"temperature_low_state_template,omitempty"`
+	LowCommandTopic     string          `json:"temperature_low_command_topic,omitempty"`
+	LowCommandTemplate  string          `json:"temperature_low_command_template,omitempty"`
+	TemperatureUnit     string          `json:"temperature_unit"`
+	Precision           float64         `json:"precision"`
+	MinTemp             float64         `json:"min_temp"`
+	MaxTemp             float64         `json:"max_temp"`
+}
+
+// SensorDiscovery is the Home Assistant discovery message of a temperature sensor
+type SensorDiscovery struct {
+	Name                string          `json:"name"`
+	UniqueID            string          `json:"unique_id"`
+	Device              DiscoveryDevice `json:"device"`
+	AvailabilityTopic   string          `json:"availability_topic"`
+	PayloadAvailable    string          `json:"payload_available"`
+	PayloadNotAvailable string          `json:"payload_not_available"`
+	StateTopic          string          `json:"state_topic"`
+	ValueTemplate       string          `json:"value_template"`
+	DeviceClass         string          `json:"device_class"`
+	StateClass          string          `json:"state_class"`
+	UnitOfMeasurement   string          `json:"unit_of_measurement"`
+}
+
+func discoveryPrefix(config MQTT) string {
+	if config.DiscoveryPrefix != "" {
+		return config.DiscoveryPrefix
+	}
+	return DefaultDiscoveryPrefix
+}
+
+// discoveryInvalid matches the characters Home Assistant doesn't allow in the IDs of discovered entities
+var discoveryInvalid = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// discoveryID identifies a sensor in Home Assistant. It uses the ID, which is unique and unlikely to
+// change, so renaming a sensor doesn't create a new entity.
+func discoveryID(id string) string {
+	return "tempgopher_" + discoveryInvalid.ReplaceAllString(id, "_")
+}
+
+// ClimateDiscoveryTopic returns the topic the discovery message of a thermostat is published to
+func ClimateDiscoveryTopic(config MQTT, id string) string {
+	return discoveryPrefix(config) + "/climate/" + discoveryID(id) + "/config"
+}
+
+// SensorDiscoveryTopic returns the topic the discovery message of a temperature sensor is published to
+func SensorDiscoveryTopic(config MQTT, id string) string {
+	return discoveryPrefix(config) + "/sensor/" + discoveryID(id) + "/config"
+}
+
+func discoveryDevice(sensor Sensor) DiscoveryDevice {
+	return DiscoveryDevice{
+		Identifiers:  []string{discoveryID(sensor.ID)},
+		Name:         sensor.Alias,
+		Manufacturer: "TempGopher",
+		Model:        "Thermostat",
+		SWVersion:    Version,
+	}
+}
+
+// NewClimateDiscovery returns the discovery message of the thermostat of a sensor. Its modes turn
+// heating and cooling on and off, and its targets are the band or setpoint of the sensor.
+func NewClimateDiscovery(config MQTT, sensor Sensor) ClimateDiscovery {
+	state := MQTTStateTopic(config, sensor.Alias)
+	set := MQTTSetTopic(config, sensor.Alias)
+
+	d := ClimateDiscovery{
+		Name:                sensor.Alias,
+		UniqueID:            discoveryID(sensor.ID),
+		Device:              discoveryDevice(sensor),
+		AvailabilityTopic:   MQTTAvailabilityTopic(config),
+		PayloadAvailable:    MQTTOnline,
+		PayloadNotAvailable: MQTTOffline,
+		Modes:               []string{OutputsOff, OutputsHeat, OutputsCool, OutputsHeatCool},
+		ModeStateTopic:      state,
+		ModeStateTemplate:   discoveryOutputsTemplate,
+		ModeCommandTopic:    set,
+		ModeCommandTemplate: `{"outputs": "{{ value }}"}`,
+		CurrentTempTopic:    state,
+		CurrentTempTemplate: discoveryTempTemplate,
+		ActionTopic:         state,
+		ActionTemplate:      discoveryActionTemplate,
+		TemperatureUnit:     "C",
+		Precision:           0.1,
+		MinTemp:             discoveryMinTemp,
+		MaxTemp:             discoveryMaxTemp,
+	}
+
+	if sensor.Mode == ModePID {
+		d.TempStateTopic = state
+		d.TempStateTemplate = discoverySetPointTemplate
+		d.TempCommandTopic = set
+		d.TempCommandTemplate = `{"setpoint": {{ value }}}`
+	} else {
+		d.HighStateTopic = state
+		d.HighStateTemplate = discoveryHighTemplate
+		d.HighCommandTopic = set
+		d.HighCommandTemplate = `{"hightemp": {{ value }}}`
+		d.LowStateTopic = state
+		d.LowStateTemplate = discoveryLowTemplate
+		d.LowCommandTopic = set
+		d.LowCommandTemplate = `{"lowtemp": {{ value }}}`
+	}
+
+	return d
+}
+
+// NewSensorDiscovery returns the discovery message of the temperature of a sensor
+func NewSensorDiscovery(config MQTT, sensor Sensor) SensorDiscovery {
+	return SensorDiscovery{
+		Name:                sensor.Alias + " temperature",
+		UniqueID:            discoveryID(sensor.ID) + "_temp",
+		Device:              discoveryDevice(sensor),
+		AvailabilityTopic:   MQTTAvailabilityTopic(config),
+		PayloadAvailable:    MQTTOnline,
+		PayloadNotAvailable: MQTTOffline,
+		StateTopic:          MQTTStateTopic(config, sensor.Alias),
+		ValueTemplate:       discoveryTempTemplate,
+		DeviceClass:         "temperature",
+		StateClass:          "measurement",
+		UnitOfMeasurement:   "°C",
+	}
+}
+
+// DiscoveryMessages returns the discovery messages of every sensor, keyed by topic. Sensors that
+// were published before, listed in previous by ID, but are no longer configured get an empty message,
+// which removes them from Home Assistant.
+func DiscoveryMessages(config MQTT, sensors []Sensor, previous map[string]bool) (map[string][]byte, error) {
+	messages := make(map[string][]byte)
+
+	current := make(map[string]bool)
+	for _, s := range sensors {
+		current[s.ID] = true
+
+		climate, err := json.Marshal(NewClimateDiscovery(config, s))
+		if err != nil {
+			return nil, err
+		}
+		messages[ClimateDiscoveryTopic(config, s.ID)] = climate
+
+		sensor, err := json.Marshal(NewSensorDiscovery(config, s))
+		if err != nil {
+			return nil, err
+		}
+		messages[SensorDiscoveryTopic(config, s.ID)] = sensor
+	}
+
+	for id := range previous {
+		if !current[id] {
+			messages[ClimateDiscoveryTopic(config, id)] = []byte{}
+			messages[SensorDiscoveryTopic(config, id)] = []byte{}
+		}
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DiscoveryTopics(t *testing.T) {
+	assert.Equal(t, "homeassistant/climate/tempgopher_28-000008083108/config", ClimateDiscoveryTopic(MQTT{}, "28-000008083108"))
+	assert.Equal(t, "ha/sensor/tempgopher__dev_temp/config", SensorDiscoveryTopic(MQTT{DiscoveryPrefix: "ha"}, "/dev/temp"))
+}
+
+func Test_ClimateDiscovery(t *testing.T) {
+	config := MQTT{Topic: "brewery"}
+
+	// Hysteresis sensors have a band to set
+	d := NewClimateDiscovery(config, Sensor{ID: "foo", Alias: "fermenter"})
+	assert.Equal(t, "fermenter", d.Name)
+	assert.Equal(t, "tempgopher_foo", d.UniqueID)
+	assert.Equal(t, []string{"tempgopher_foo"}, d.Device.Identifiers)
+	assert.Equal(t, "brewery/status", d.AvailabilityTopic)
+	assert.Equal(t, []string{"off", "heat", "cool", "heat_cool"}, d.Modes)
+	assert.Equal(t, "brewery/fermenter/state", d.ModeStateTopic)
+	assert.Equal(t, "brewery/fermenter/set", d.ModeCommandTopic)
+	assert.Equal(t, "brewery/fermenter/set", d.LowCommandTopic)
+	assert.Equal(t, `{"lowtemp": {{ value }}}`, d.LowCommandTemplate)
+	assert.Equal(t, "{{ value_json.hightemp }}", d.HighStateTemplate)
+	assert.Equal(t, "", d.TempCommandTopic)
+
+	// The action comes from the outputs that are on, not from which are enabled
+	assert.True(t, strings.Index(d.ActionTemplate, "value_json.cooling") < strings.Index(d.ActionTemplate, "value_json.outputs"))
+	assert.True(t, strings.Index(d.ActionTemplate, "value_json.heating") < strings.Index(d.ActionTemplate, "value_json.outputs"))
+
+	// PID sensors have their setpoint
+	d = NewClimateDiscovery(config, Sensor{ID: "foo", Alias: "fermenter", Mode: ModePID})
+	assert.Equal(t, `{"setpoint": {{ value }}}`, d.TempCommandTemplate)
+	assert.Equal(t, "", d.LowCommandTopic)
+
+	// Which only has the fields of its mode
+	j, _ := json.Marshal(d)
+	var m map[string]interface{}
+	json.Unmarshal(j, &m)
+	_, ok := m["temperature_low_command_topic"]
+	assert.False(t, ok)
+	assert.Equal(t, "brewery/fermenter/set", m["temperature_command_topic"])
+}
+
+func Test_SensorDiscovery(t *testing.T) {
+	d := NewSensorDiscovery(MQTT{}, Sensor{ID: "foo", Alias: "fermenter"})
+	assert.Equal(t, "fermenter temperature", d.Name)
+	assert.Equal(t, "tempgopher_foo_temp", d.UniqueID)
+	assert.Equal(t, "tempgopher/fermenter/state", d.StateTopic)
+	assert.Equal(t, "temperature", d.DeviceClass)
+}
+
+func Test_DiscoveryMessages(t *testing.T) {
+	sensors := []Sensor{Sensor{ID: "foo", Alias: "foo"}}
+
+	messages, err := DiscoveryMessages(MQTT{}, sensors, map[string]bool{"foo": true, "bar": true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(messages))
+	assert.NotEmpty(t, messages["homeassistant/climate/tempgopher_foo/config"])
+	assert.NotEmpty(t, messages["homeassistant/sensor/tempgopher_foo/config"])
+
+	// Removed sensors are cleared
+	assert.Equal(t, []byte{}, messages["homeassistant/climate/tempgopher_bar/config"])
+	assert.Equal(t, []byte{}, messages["homeassistant/sensor/tempgopher_bar/config"])
+}
+
+func Test_SensorOutputs(t *testing.T) {
+	for _, outputs := range []string{OutputsOff, OutputsHeat, OutputsCool, OutputsHeatCool} {
+		var s Sensor
+		assert.Equal(t, nil, setSensorOutputs(&s, outputs))
+		assert.Equal(t, outputs, SensorOutputs(s))
+	}
+	assert.NotEqual(t, nil, setSensorOutputs(&Sensor{}, "auto"))
+}
@@ -0,0 +1,123 @@
+// Ranges that can be charted, with the step to request for each
+var chartRanges = {
+    "1h": {hours: 1, step: "1m"},
+    "24h": {hours: 24, step: "5m"},
+    "7d": {hours: 24 * 7, step: "1h"},
+    "30d": {hours: 24 * 30, step: "2h"}
+};
+
+// Remember the selected range of each chart between refreshes
+var chartSelected = {};
+
+var chartWidth = 600;
+var chartHeight = 160;
+var chartMargin = 40;
+
+function svgElement(name, attrs) {
+    var el = document.createElementNS("http://www.w3.org/2000/svg", name);
+    for (var key in attrs) {
+        el.setAttribute(key, attrs[key]);
+    }
+    return el;
+}
+
+function drawChart(svg, points, from, to, step) {
+    $(svg).empty();
+
+    if (points.length == 0) {
+        svg.appendChild(svgElement("text", {x: chartWidth / 2, y: chartHeight / 2, "text-anchor": "middle", "class": "chart-label"}))
+            .textContent = "No history yet";
+        return;
+    }
+
+    // Scale to fit the temperatures and band, with a little room around them
+    var min = Infinity, max = -Infinity;
+    for (var i in points) {
+        min = Math.min(min, points[i].temp, points[i].low);
+        max = Math.max(max, points[i].temp, points[i].high);
+    }
+    min -= 0.5;
+    max += 0.5;
+
+    var plotWidth = chartWidth - chartMargin;
+    function x(t) {
+        return chartMargin + (t - from) / (to - from) * plotWidth;
+    }
+    function y(temp) {
+        return chartHeight - 20 - (temp - min) / (max - min) * (chartHeight - 30);
+    }
+
+    // Shade the time spent heating and cooling, darker the longer the output was on
+    for (var i = 0; i < points.length; i++) {
+        var t = new Date(points[i].time).getTime();
+        var width = Math.max(1, x(t + step) - x(t));
+        if (points[i].heating > 0) {
+            svg.appendChild(svgElement("rect", {x: x(t), y: 10, width: width, height: chartHeight - 30, "class": "chart-heating", "fill-opacity": 0.4 * points[i].heating}));
+        }
+        if (points[i].cooling > 0) {
+            svg.appendChild(svgElement("rect", {x: x(t), y: 10, width: width, height: chartHeight - 30, "class": "chart-cooling", "fill-opacity": 0.4 * points[i].cooling}));
+        }
+    }
+
+    // Draw the band and temperature, breaking the lines where readings are missing
+    var runs = [[]], last = null;
+    for (var i = 0; i < points.length; i++) {
+        var t = new Date(points[i].time).getTime();
+        if (last !== null && t - last > 2 * step) {
+            runs.push([]);
+        }
+        runs[runs.length - 1].push({t: t, point: points[i]});
+        last = t;
+    }
+    for (var i in runs) {
+        var lows = runs[i].map(function(r) { return x(r.t) + "," + y(r.point.low); });
+        var highs = runs[i].map(function(r) { return x(r.t) + "," + y(r.point.high); }).reverse();
+        var temps = runs[i].map(function(r) { return x(r.t) + "," + y(r.point.temp); });
+        svg.appendChild(svgElement("polygon", {points: lows.concat(highs).join(" "), "class": "chart-band"}));
+        svg.appendChild(svgElement("polyline", {points: temps.join(" "), "class": "chart-temp"}));
+    }
+
+    // Label the axes
+    svg.appendChild(svgElement("text", {x: chartMargin - 5, y: y(max - 0.5) + 4, "text-anchor": "end", "class": "chart-label"}))
+        .textContent = displayTemp(max - 0.5);
+    svg.appendChild(svgElement("text", {x: chartMargin - 5, y: y(min + 0.5) + 4, "text-anchor": "end", "class": "chart-label"}))
+        .textContent = displayTemp(min + 0.5);
+    svg.appendChild(svgElement("text", {x: chartMargin, y: chartHeight - 4, "class": "chart-label"}))
+        .textContent = new Date(from).toLocaleString();
+    svg.appendChild(svgElement("text", {x: chartWidth, y: chartHeight - 4, "text-anchor": "end", "class": "chart-label"}))
+        .textContent = new Date(to).toLocaleString();
+}
+
+function appendChart(div, alias) {
+    var svg = svgElement("svg", {viewBox: "0 0 " + chartWidth + " " + chartHeight, "class": "chart"});
+
+    var rangeSel = $("<select>");
+    for (var name in chartRanges) {
+        rangeSel.append($("<option>").val(name).text(name));
+    }
+    rangeSel.val(chartSelected[alias] || "24h");
+
+    function load() {
+        var range = chartRanges[rangeSel.val()];
+        var to = Date.now();
+        var from = to - range.hours * 3600 * 1000;
+        $.ajax({
+            url: jsconfig.baseurl + "/api/history/" + encodeURIComponent(alias),
+            data: {from: Math.floor(from / 1000), to: Math.floor(to / 1000), step: range.step},
+            beforeSend: authHeaders
+        }).then(function(points) {
+            // Each point covers at least a minute, the finest history kept
+            var step = Math.max(60, parseInt(range.step) * (range.step.slice(-1) == "h" ? 3600 : 60)) * 1000;
+            drawChart(svg, points, from, to, step);
+        });
+    }
+
+    rangeSel.on('input', function() {
+        chartSelected[alias] = rangeSel.val();
+        load();
+    });
+
+    div.append($("<div></div>").addClass("eleven columns").append(svg));
+    div.append($("<div></div>").addClass("one columns").append(rangeSel));
+    load();
+}
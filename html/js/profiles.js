@@ -0,0 +1,104 @@
+// Temperatures are stored in celsius, but displayed in the configured unit
+function displayTemp(degree) {
+    if (jsconfig.fahrenheit) {
+        return celsiusToFahrenheit(parseFloat(degree)).toFixed(1);
+    }
+    return parseFloat(degree).toFixed(1);
+}
+
+function storedTemp(degree) {
+    if (jsconfig.fahrenheit) {
+        return fahrenheitToCelsius(parseFloat(degree));
+    }
+    return parseFloat(degree);
+}
+
+function segmentRow(segment) {
+    var typeSel = $("<select>").addClass("segtype")
+        .append($("<option>").val("step").text("Hold"))
+        .append($("<option>").val("ramp").text("Ramp to"))
+        .val(segment.ramp ? "ramp" : "step");
+    var tempIn = $("<input>").addClass("segtemp").attr("size", "4").val(displayTemp(segment.temp));
+    var hoursIn = $("<input>").addClass("seghours").attr("size", "4").val(segment.hours);
+    var removeButton = $("<button></button>").addClass("button").text("✘").click(function() {
+        $(this).closest("tr").remove();
+    });
+
+    return $("<tr></tr>")
+        .append($("<td></td>").append(typeSel))
+        .append($("<td></td>").append(tempIn))
+        .append($("<td></td>").append(hoursIn))
+        .append($("<td></td>").append(removeButton));
+}
+
+function appendProfile(profile) {
+    var titleh = $("<h5></h5>").text(profile.name);
+
+    var unit = jsconfig.fahrenheit ? "°F" : "°C";
+    var table = $("<table></table>").append($("<tr></tr>")
+        .append($("<th></th>").text("Segment"))
+        .append($("<th></th>").text("Temperature (" + unit + ")"))
+        .append($("<th></th>").text("Hours"))
+        .append($("<th></th>")));
+    for (var i in profile.segments) {
+        table.append(segmentRow(profile.segments[i]));
+    }
+
+    var addButton = $("<button></button>").addClass("button").text("+").click(function() {
+        table.append(segmentRow({ramp: false, temp: 20, hours: 24}));
+    });
+
+    var saveButton = $("<button></button>").addClass("button button-primary").text("✔").click(function() {
+        var segments = [];
+        table.find("tr").slice(1).each(function() {
+            segments.push({
+                "ramp": $(this).find(".segtype").val() == "ramp",
+                "temp": storedTemp($(this).find(".segtemp").val()),
+                "hours": parseFloat($(this).find(".seghours").val()) || 0
+            });
+        });
+        $.ajax({
+            type: "POST",
+            url: jsconfig.baseurl + "/api/profiles",
+            beforeSend: authHeaders,
+            data: JSON.stringify({"name": profile.name, "segments": segments})
+        }).then(renderProfiles);
+    });
+
+    var deleteButton = $("<button></button>").addClass("button").text("Delete").click(function() {
+        $.ajax({
+            type: "DELETE",
+            url: jsconfig.baseurl + "/api/profiles/" + encodeURIComponent(profile.name),
+            beforeSend: authHeaders
+        }).then(renderProfiles);
+    });
+
+    $("#profiles").append($("<div></div>").addClass("row").append(titleh));
+    $("#profiles").append($("<div></div>").addClass("row").append(table));
+    $("#profiles").append($("<div></div>").addClass("row").append(addButton).append(saveButton).append(deleteButton));
+}
+
+function renderProfiles() {
+    $.ajax({
+        url: jsconfig.baseurl + "/api/profiles",
+        beforeSend: authHeaders
+    }).then(function(profiles) {
+        $("#profiles").empty();
+
+        for (var i in profiles) {
+            appendProfile(profiles[i]);
+        }
+
+        // New profiles only exist in the page until they are saved
+        var nameIn = $("<input>").attr("placeholder", "New profile");
+        var newButton = $("<button></button>").addClass("button").text("+").click(function() {
+            if (nameIn.val() != "") {
+                nameIn.parent().remove();
+                appendProfile({name: nameIn.val(), segments: [{ramp: false, temp: 20, hours: 24}]});
+            }
+        });
+        $("#profiles").append($("<div></div>").addClass("row").append(nameIn).append(newButton));
+    });
+};
+
+$(document).ready(renderProfiles);
@@ -60,6 +60,52 @@ function fahrenheitToCelsius(degree) {
     return (degree - 32) * 5 / 9;
 };
 
+function tempText(data) {
+    if (jsconfig.fahrenheit) {
+        return celsiusToFahrenheit(parseFloat(data.temp)).toFixed(1) + "°F";
+    }
+    return parseFloat(data.temp).toFixed(1) + "°C";
+}
+
+function statusText(data) {
+    if (data.cooling) {
+        var statustext = "Cooling"
+    } else if (data.heating) {
+        var statustext = "Heating"
+    } else {
+        var statustext = "Idle"
+    }
+    if (data.cascade) {
+        if (jsconfig.fahrenheit) {
+            var air = celsiusToFahrenheit(parseFloat(data.airtemp)).toFixed(1) + "°F";
+            var airTarget = celsiusToFahrenheit(parseFloat(data.airtarget)).toFixed(1) + "°F";
+        } else {
+            var air = parseFloat(data.airtemp).toFixed(1) + "°C";
+            var airTarget = parseFloat(data.airtarget).toFixed(1) + "°C";
+        }
+        statustext += "<br>Air " + air + " (target " + airTarget + ")"
+    }
+    if ((data.cooling || data.heating) && data.pid && data.pid.duty) {
+        statustext += " " + Math.abs(data.pid.duty).toFixed(0) + "%"
+    }
+    if (data.profile) {
+        if (jsconfig.fahrenheit) {
+            var target = celsiusToFahrenheit(parseFloat(data.profile.target)).toFixed(1) + "°F";
+        } else {
+            var target = parseFloat(data.profile.target).toFixed(1) + "°C";
+        }
+        statustext += "<br>" + $("<span>").text(data.profile.name).html() + " step " + (data.profile.segment + 1) + ": " + target
+    }
+    if (data.fault) {
+        statustext += "<br><strong>Sensor fault:</strong> " + $("<span>").text(data.error).html()
+    }
+    var lockout = Math.max(data.coollockout || 0, data.heatlockout || 0);
+    if (lockout > 0) {
+        statustext += "<br>Waiting " + Math.ceil(lockout / 60) + " min for compressor delay"
+    }
+    return statustext;
+}
+
 function appendData(data) {
     // Title of thermostat
     var titleh = $("<h4></h4>").text(data.alias);
@@ -71,25 +117,13 @@ function appendData(data) {
 
     ////////////////////////////////////////////////////////////////////////////
     // Display temperature
-    if (jsconfig.fahrenheit) {
-        var temp = celsiusToFahrenheit(parseFloat(data.temp)).toFixed(1) + "°F";
-    } else {
-        var temp = parseFloat(data.temp).toFixed(1) + "°C";
-    }
-    var temph = $("<h2></h2>").text(temp);
+    var temph = $("<h2></h2>").attr("id", "temp" + data.alias).text(tempText(data));
     var tempdiv = $("<div></div>").addClass("two columns").append(temph);
     rowdiv.append(tempdiv);
 
     ////////////////////////////////////////////////////////////////////////////
     // Display status
-    if (data.cooling) {
-        var statustext = "Cooling"
-    } else if (data.heating) {
-        var statustext = "Heating"
-    } else {
-        var statustext = "Idle"
-    }
-    var statusp = $("<p></p>").html(statustext);
+    var statusp = $("<p></p>").attr("id", "status" + data.alias).html(statusText(data));
     var statusdiv = $("<div></div>").addClass("one columns").append(statusp);
     rowdiv.append(statusdiv);
 
@@ -104,9 +138,11 @@ function appendData(data) {
             var degUnit = "°F";
             var hightemp = celsiusToFahrenheit(parseFloat(configData.hightemp)).toFixed(1);
             var lowtemp = celsiusToFahrenheit(parseFloat(configData.lowtemp)).toFixed(1);
+            var setpoint = celsiusToFahrenheit(parseFloat(configData.setpoint)).toFixed(1);
         } else {
             var hightemp = parseFloat(configData.hightemp).toFixed(1);
             var lowtemp = parseFloat(configData.lowtemp).toFixed(1);
+            var setpoint = parseFloat(configData.setpoint).toFixed(1);
         }
 
         rp = '[0-9]+(\.[0-9]+)?'
@@ -116,20 +152,73 @@ function appendData(data) {
         var hmIn = $("<input>").attr("id", "hm" + configData.alias).val(configData.heatminutes).attr("size", "2").attr("pattern", rp).on('input', function(){window.clearInterval(rtHandle)});
         var ltIn = $("<input>").attr("id", "lt" + configData.alias).val(lowtemp).attr("size", "4").attr("pattern", rp).on('input', function(){window.clearInterval(rtHandle)});
 
-        var configp = $("<p></p>")
-        if (!configData.cooldisable) {
-            configp.append("Chills for ").append(cmIn).append(" minutes when &gt; ").append(htIn).append(degUnit);
-        }
+        var spIn = $("<input>").attr("id", "sp" + configData.alias).val(setpoint).attr("size", "4").attr("pattern", rp).on('input', function(){window.clearInterval(rtHandle)});
+        var kpIn = $("<input>").attr("id", "kp" + configData.alias).val(configData.kp).attr("size", "3").attr("pattern", rp).on('input', function(){window.clearInterval(rtHandle)});
+        var kiIn = $("<input>").attr("id", "ki" + configData.alias).val(configData.ki).attr("size", "3").attr("pattern", rp).on('input', function(){window.clearInterval(rtHandle)});
+        var kdIn = $("<input>").attr("id", "kd" + configData.alias).val(configData.kd).attr("size", "3").attr("pattern", rp).on('input', function(){window.clearInterval(rtHandle)});
+        var wmIn = $("<input>").attr("id", "wm" + configData.alias).val(configData.windowminutes).attr("size", "2").attr("pattern", rp).on('input', function(){window.clearInterval(rtHandle)});
 
-        if (!configData.cooldisable && !configData.heatdisable){
+        var configp = $("<p></p>")
+        if (configData.mode == "pid") {
+            configp.append("Holds ").append(spIn).append(degUnit).append(" over ").append(wmIn).append(" minute windows");
             configp.append($("<br>"));
+            configp.append("Kp ").append(kpIn).append(" Ki ").append(kiIn).append(" Kd ").append(kdIn);
+        } else {
+            if (!configData.cooldisable) {
+                configp.append("Chills for ").append(cmIn).append(" minutes when &gt; ").append(htIn).append(degUnit);
+            }
+
+            if (!configData.cooldisable && !configData.heatdisable){
+                configp.append($("<br>"));
+            }
+
+            if (!configData.heatdisable) {
+                configp.append("Heats for ").append(hmIn).append(" minutes when &lt; ").append(ltIn).append(degUnit);
+            }
         }
 
-        if (!configData.heatdisable) {
-            configp.append("Heats for ").append(hmIn).append(" minutes when &lt; ").append(ltIn).append(degUnit);
+        var modeSel = $("<select>").attr("id", "mode" + configData.alias)
+            .append($("<option>").val("hysteresis").text("Thresholds"))
+            .append($("<option>").val("pid").text("PID"))
+            .val(configData.mode == "pid" ? "pid" : "hysteresis")
+            .on('input', function(){window.clearInterval(rtHandle)});
+        configp.append($("<br>")).append(modeSel);
+
+        ////////////////////////////////////////////////////////////////////////
+        // Display options to start or stop a profile
+        var profilep = $("<p></p>");
+        if (configData.profile) {
+            var stopButton = $("<button></button>").addClass("button").text("Stop profile").click(function() {
+                $.ajax({
+                    type: "DELETE",
+                    url: jsconfig.baseurl + "/api/profiles/" + encodeURIComponent(configData.profile) + "/sensors/" + encodeURIComponent(configData.alias),
+                    beforeSend: authHeaders
+                }).then(renderThermostats);
+            });
+            profilep.append(stopButton);
+        } else {
+            var profileSel = $("<select>").on('input', function(){window.clearInterval(rtHandle)});
+            var startButton = $("<button></button>").addClass("button").text("Start profile").click(function() {
+                $.ajax({
+                    type: "PUT",
+                    url: jsconfig.baseurl + "/api/profiles/" + encodeURIComponent(profileSel.val()) + "/sensors/" + encodeURIComponent(configData.alias),
+                    beforeSend: authHeaders
+                }).then(renderThermostats);
+            });
+            $.ajax({
+                url: jsconfig.baseurl + "/api/profiles",
+                beforeSend: authHeaders
+            }).then(function(profiles) {
+                for (var i in profiles) {
+                    profileSel.append($("<option>").val(profiles[i].name).text(profiles[i].name));
+                }
+                if (profiles.length > 0) {
+                    profilep.append(profileSel).append(startButton);
+                }
+            });
         }
 
-        var configdiv = $("<div></div>").addClass("six columns").append(configp);
+        var configdiv = $("<div></div>").addClass("six columns").append(configp).append(profilep);
         rowdiv.append(configdiv);
 
         ////////////////////////////////////////////////////////////////////////
@@ -158,29 +247,31 @@ function appendData(data) {
             if (jsconfig.fahrenheit) {
                 var newHT = fahrenheitToCelsius(parseFloat(htIn.val()));
                 var newLT = fahrenheitToCelsius(parseFloat(ltIn.val()));
+                var newSP = fahrenheitToCelsius(parseFloat(spIn.val()));
             } else {
                 var newHT = parseFloat(htIn.val());
                 var newLT = parseFloat(ltIn.val());
+                var newSP = parseFloat(spIn.val());
             }
             $.ajax({
                 type: "POST",
                 url: jsconfig.baseurl + "/api/config/sensors",
                 beforeSend: authHeaders,
-                data: JSON.stringify([{
-                    "id": configData.id,
-                    "alias": configData.alias,
+                // Start from the stored configuration so settings not shown here are kept
+                data: JSON.stringify([$.extend({}, configData, {
                     "hightemp": newHT,
                     "lowtemp": newLT,
-                    "heatgpio": configData.heatgpio,
-                    "heatinvert": configData.heatInvert,
                     "heatminutes": parseFloat(hmIn.val()),
                     "heatdisable": !hon.is(":checked"),
-                    "coolgpio": configData.coolgpio,
-                    "coolinvert": configData.coolinvert,
                     "coolminutes": parseFloat(cmIn.val()),
                     "cooldisable": !con.is(":checked"),
-                    "verbose": configData.verbose
-                }])
+                    "mode": modeSel.val(),
+                    "setpoint": newSP,
+                    "kp": parseFloat(kpIn.val()),
+                    "ki": parseFloat(kiIn.val()),
+                    "kd": parseFloat(kdIn.val()),
+                    "windowminutes": parseFloat(wmIn.val())
+                })])
             });
             window.clearInterval(rtHandle);
             rtHandle = window.setInterval(renderThermostats, 60000);
@@ -196,9 +287,15 @@ function appendData(data) {
         var buttonDiv = $("<div></div>").addClass("two columns").append(yesButton).append($("<br>")).append(noButton);
         rowdiv.append(buttonDiv);
 
+        ////////////////////////////////////////////////////////////////////////
+        // Chart the history of the thermostat
+        var chartdiv = $("<div></div>").addClass("row");
+        appendChart(chartdiv, configData.alias);
+
         // Add things back to the thermostat list
         $("#thermostats").append(titlediv);
         $("#thermostats").append(rowdiv);
+        $("#thermostats").append(chartdiv);
     });
 }
 
@@ -224,3 +321,69 @@ function renderThermostats() {
 
 $(document).ready(renderThermostats);
 var rtHandle = window.setInterval(renderThermostats, 60000);
+
+// Update thermostats as soon as their state changes. EventSource can't send the auth
+// header, so the stream is read with fetch instead. Polling carries on as a fallback.
+function handleEvent(type, data) {
+    if (type == "state") {
+        // Aliases can contain characters that aren't valid in a selector
+        $(document.getElementById("temp" + data.alias)).text(tempText(data));
+        $(document.getElementById("status" + data.alias)).html(statusText(data));
+    } else if (type == "config") {
+        renderThermostats();
+    }
+}
+
+function subscribeEvents() {
+    if (!window.fetch || !window.TextDecoder) {
+        return;
+    }
+
+    var headers = {};
+    if (window.localStorage.getItem("authtoken") !== null) {
+        headers["Authorization"] = "Basic " + window.localStorage.getItem("authtoken");
+    }
+
+    fetch(jsconfig.baseurl + "/api/events", {headers: headers}).then(function(response) {
+        if (!response.ok || !response.body) {
+            throw new Error("Unable to subscribe to events");
+        }
+
+        var reader = response.body.getReader();
+        var decoder = new TextDecoder();
+        var buffer = "";
+        function read() {
+            return reader.read().then(function(result) {
+                if (result.done) {
+                    throw new Error("Event stream closed");
+                }
+                buffer += decoder.decode(result.value, {stream: true});
+
+                // Events are separated by a blank line
+                var messages = buffer.split("\n\n");
+                buffer = messages.pop();
+                for (var i in messages) {
+                    var type = null, data = "";
+                    var lines = messages[i].split("\n");
+                    for (var j in lines) {
+                        if (lines[j].indexOf("event:") == 0) {
+                            type = lines[j].slice(6).trim();
+                        } else if (lines[j].indexOf("data:") == 0) {
+                            data += lines[j].slice(5);
+                        }
+                    }
+                    if (type !== null) {
+                        handleEvent(type, JSON.parse(data));
+                    }
+                }
+                return read();
+            });
+        }
+        return read();
+    }).catch(function() {
+        // Try again in a little while
+        window.setTimeout(subscribeEvents, 10000);
+    });
+}
+
+$(document).ready(subscribeEvents);
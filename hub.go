@@ -0,0 +1,185 @@
+package main
+
+import (
+	"sync"
+)
+
+// eventBuffer is how many events a subscriber can fall behind before state and alerts events are dropped
+const eventBuffer = 16
+
+// Types of Event
+const (
+	EventState  = "state"
+	EventConfig = "config"
+	EventAlerts = "alerts"
+)
+
+// Event is something that happened which may interest subscribers. State events carry the
+// new State, along with the Sensor settings it was produced with after any profile was applied.
+// Config events carry the configuration that was just loaded, and alerts events every active Alert.
+type Event struct {
+	Type   string
+	State  State
+	Sensor Sensor
+	Config *Config
+	Alerts []Alert
+}
+
+// Hub holds the latest state of every thermostat and the configuration they are running, and
+// passes each change on to any number of subscribers. It is safe for concurrent use.
+type Hub struct {
+	mu          sync.RWMutex
+	states      map[string]State
+	config      *Config
+	alerts      []Alert
+	subscribers map[chan Event]struct{}
+}
+
+// NewHub creates a hub with no states or subscribers
+func NewHub() *Hub {
+	return &Hub{
+		states:      make(map[string]State),
+		alerts:      []Alert{},
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// States returns a copy of the latest state of every thermostat, keyed by alias
+func (h *Hub) States() map[string]State {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	states := make(map[string]State, len(h.states))
+	for k, v := range h.states {
+		states[k] = v
+	}
+	return states
+}
+
+// State returns the latest state of a thermostat
+func (h *Hub) State(alias string) (State, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	s, ok := h.states[alias]
+	return s, ok
+}
+
+// Config returns the configuration last published, or nil if there hasn't been one
+func (h *Hub) Config() *Config {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.config
+}
+
+// Alerts returns the active alerts last published
+func (h *Hub) Alerts() []Alert {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.alerts
+}
+
+// PublishState records the new state of a thermostat and sends it to subscribers
+func (h *Hub) PublishState(sensor Sensor, s State) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.states[s.Alias] = s
+	h.publish(Event{Type: EventState, State: s, Sensor: sensor})
+}
+
+// PublishConfig records a newly loaded configuration and sends it to subscribers. States of
+// sensors that are no longer configured are forgotten. The configuration must not be modified
+// afterwards.
+func (h *Hub) PublishConfig(config *Config) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	aliases := make(map[string]bool)
+	for _, s := range config.Sensors {
+		aliases[s.Alias] = true
+	}
+	for alias := range h.states {
+		if !aliases[alias] {
+			delete(h.states, alias)
+		}
+	}
+
+	h.config = config
+	h.publish(Event{Type: EventConfig, Config: config})
+}
+
+// PublishAlerts records the active alerts and sends them to subscribers. The alerts must not
+// be modified afterwards.
+func (h *Hub) PublishAlerts(alerts []Alert) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.alerts = alerts
+	h.publish(Event{Type: EventAlerts, Alerts: alerts})
+}
+
+// publish sends an event to every subscriber. A subscriber that isn't keeping up misses the
+// event, rather than holding up everyone else. Config events are never missed, as subscribers
+// like the sinks depend on them; the oldest event waiting is dropped to make room instead.
+// h.mu must be held.
+func (h *Hub) publish(e Event) {
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+			continue
+		default:
+		}
+		if e.Type != EventConfig {
+			continue
+		}
+
+		// Only publish sends, so there is room once one event is taken
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- e
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on. Call the returned
+// function to unsubscribe, which closes the channel.
+func (h *Hub) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subscribers, ch)
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Handle calls fn with every event published from now on, one at a time, in a new goroutine.
+// The returned function unsubscribes, and waits for fn to finish with the events already received.
+func (h *Hub) Handle(fn func(Event)) func() {
+	ch, unsubscribe := h.Subscribe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range ch {
+			fn(e)
+		}
+	}()
+
+	return func() {
+		unsubscribe()
+		<-done
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Hub(t *testing.T) {
+	hub := NewHub()
+	assert.Nil(t, hub.Config())
+
+	// Publishing without subscribers just keeps the state
+	hub.PublishState(Sensor{Alias: "foo"}, State{Alias: "foo", Temp: 10})
+	s, ok := hub.State("foo")
+	assert.True(t, ok)
+	assert.Equal(t, 10.0, s.Temp)
+	_, ok = hub.State("DNE")
+	assert.False(t, ok)
+
+	ch1, unsubscribe1 := hub.Subscribe()
+	ch2, unsubscribe2 := hub.Subscribe()
+
+	// Every subscriber gets the event
+	hub.PublishState(Sensor{Alias: "foo", HighTemp: 20}, State{Alias: "foo", Temp: 11})
+	e := <-ch1
+	assert.Equal(t, EventState, e.Type)
+	assert.Equal(t, 11.0, e.State.Temp)
+	assert.Equal(t, 20.0, e.Sensor.HighTemp)
+	assert.Equal(t, 11.0, (<-ch2).State.Temp)
+
+	// States returns a copy
+	states := hub.States()
+	states["bar"] = State{}
+	assert.Equal(t, 1, len(hub.States()))
+
+	// Unsubscribing closes the channel, and can be done twice
+	unsubscribe1()
+	unsubscribe1()
+	_, ok = <-ch1
+	assert.False(t, ok)
+
+	// A subscriber that falls behind misses events, without blocking
+	for i := 0; i < eventBuffer+5; i++ {
+		hub.PublishState(Sensor{}, State{Alias: "foo", Temp: float64(i)})
+	}
+	assert.Equal(t, eventBuffer, len(ch2))
+	assert.Equal(t, 0.0, (<-ch2).State.Temp)
+
+	// Except config events, which replace the oldest event waiting
+	hub.PublishState(Sensor{}, State{Alias: "foo"})
+	hub.PublishConfig(&Config{Sensors: []Sensor{Sensor{Alias: "foo"}}})
+	assert.Equal(t, eventBuffer, len(ch2))
+	assert.Equal(t, 2.0, (<-ch2).State.Temp)
+	for len(ch2) > 1 {
+		<-ch2
+	}
+	assert.Equal(t, EventConfig, (<-ch2).Type)
+	unsubscribe2()
+
+	// Reloading forgets sensors that were removed
+	config := &Config{Sensors: []Sensor{Sensor{Alias: "bar"}}}
+	hub.PublishConfig(config)
+	assert.Equal(t, config, hub.Config())
+	_, ok = hub.State("foo")
+	assert.False(t, ok)
+
+	// Alerts are kept and sent on
+	assert.Equal(t, 0, len(hub.Alerts()))
+	ch3, unsubscribe3 := hub.Subscribe()
+	defer unsubscribe3()
+	hub.PublishAlerts([]Alert{Alert{Rule: "band", Alias: "bar"}})
+	assert.Equal(t, "band", hub.Alerts()[0].Rule)
+	e = <-ch3
+	assert.Equal(t, EventAlerts, e.Type)
+	assert.Equal(t, "bar", e.Alerts[0].Alias)
+}
+
+func Test_HubHandle(t *testing.T) {
+	hub := NewHub()
+
+	var received []Event
+	stop := hub.Handle(func(e Event) {
+		received = append(received, e)
+	})
+
+	hub.PublishConfig(&Config{})
+	hub.PublishState(Sensor{}, State{Alias: "foo"})
+
+	// Events already received are handled before stop returns
+	stop()
+	assert.Equal(t, 2, len(received))
+	assert.Equal(t, EventConfig, received[0].Type)
+	assert.Equal(t, EventState, received[1].Type)
+}
+
+func Test_HubConcurrent(t *testing.T) {
+	hub := NewHub()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				hub.PublishState(Sensor{}, State{Alias: "foo", Temp: float64(j)})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				hub.States()
+				hub.State("foo")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			ch, unsubscribe := hub.Subscribe()
+			for j := 0; j < 10; j++ {
+				select {
+				case <-ch:
+				default:
+				}
+			}
+			unsubscribe()
+		}()
+	}
+	wg.Wait()
+}
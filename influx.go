@@ -1,46 +1,776 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+)
+
+// DefaultFlushInterval is how often points are written to Influx, unless configured
+const DefaultFlushInterval = 10 * time.Second
+
+// DefaultInfluxTimeout is how long a write to Influx may take, unless configured. Without one, a
+// stalled connection would hold up every write after it.
+const DefaultInfluxTimeout = 30 * time.Second
+
+// influxRetryMax is the longest to wait between attempts to write to Influx while it's failing
+const influxRetryMax = 5 * time.Minute
+
+// influxBatchSize is the most points written to Influx in one request
+const influxBatchSize = 5000
+
+// influxSpoolMax is the most points kept on disk while Influx is unreachable. Any more are dropped.
+const influxSpoolMax = 100000
 
-	client "github.com/influxdata/influxdb/client/v2"
+// Versions of Influx that can be written to. InfluxDB 1.x is the default.
+const (
+	InfluxV1 = 1
+	InfluxV2 = 2
 )
 
-// WriteStateToInflux writes a State object to an Influx database
-func WriteStateToInflux(s State, config Influx) error {
+// Measurements written to Influx, unless configured
+const (
+	DefaultInfluxMeasurement      = "temperature"
+	DefaultInfluxEventMeasurement = "events"
+)
+
+// Types of events written to the events measurement
+const (
+	InfluxEventHeating = "heating"
+	InfluxEventCooling = "cooling"
+	InfluxEventFault   = "fault"
+	InfluxEventConfig  = "config"
+)
+
+// InfluxPoint is a point waiting to be written to Influx. Fields may be float64, int64, bool or string.
+type InfluxPoint struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+func influxMeasurement(config Influx) string {
+	if config.Measurement != "" {
+		return config.Measurement
+	}
+	return DefaultInfluxMeasurement
+}
+
+func influxEventMeasurement(config Influx) string {
+	if config.EventMeasurement != "" {
+		return config.EventMeasurement
+	}
+	return DefaultInfluxEventMeasurement
+}
+
+// influxTags returns the configured tags, along with the alias and ID of sensor, if it has them
+func influxTags(config Influx, sensor Sensor) map[string]string {
+	tags := make(map[string]string, len(config.Tags)+2)
+	for k, v := range config.Tags {
+		tags[k] = v
+	}
+	if sensor.Alias != "" {
+		tags["alias"] = sensor.Alias
+	}
+	if sensor.ID != "" {
+		tags["id"] = sensor.ID
+	}
+	return tags
+}
+
+// StatePoint returns the point written to Influx for a State of sensor. Along with the temperature,
+// it has the outputs, and the band or setpoint the sensor was following.
+func StatePoint(config Influx, sensor Sensor, s State) InfluxPoint {
+	fields := map[string]interface{}{
+		"value":    s.Temp,
+		"raw":      s.Raw,
+		"heating":  s.Heating,
+		"cooling":  s.Cooling,
+		"fault":    s.Fault,
+		"hightemp": sensor.HighTemp,
+		"lowtemp":  sensor.LowTemp,
+	}
+	if sensor.Mode == ModePID {
+		fields["setpoint"] = sensor.SetPoint
+	}
+
+	return InfluxPoint{
+		Measurement: influxMeasurement(config),
+		Tags:        influxTags(config, sensor),
+		Fields:      fields,
+		Time:        s.When,
+	}
+}
+
+// eventPoint returns a point in the events measurement. Value is whether the event started or
+// ended, and text describes it.
+func eventPoint(config Influx, sensor Sensor, event string, value bool, text string, when time.Time) InfluxPoint {
+	tags := influxTags(config, sensor)
+	tags["event"] = event
+	return InfluxPoint{
+		Measurement: influxEventMeasurement(config),
+		Tags:        tags,
+		Fields:      map[string]interface{}{"value": value, "text": text},
+		Time:        when,
+	}
+}
 
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:               config.Addr,
-		Username:           config.Username,
-		Password:           config.Password,
-		UserAgent:          config.UserAgent,
-		Timeout:            time.Duration(config.Timeout * 1000000000),
-		InsecureSkipVerify: config.InsecureSkipVerify,
+// TransitionPoints returns the events written to Influx between two states of sensor: outputs
+// switching on or off, and the sensor faulting or recovering.
+func TransitionPoints(config Influx, sensor Sensor, prev State, s State) []InfluxPoint {
+	var points []InfluxPoint
+	if s.Heating != prev.Heating {
+		points = append(points, eventPoint(config, sensor, InfluxEventHeating, s.Heating, "Heating "+onOff(s.Heating), s.When))
+	}
+	if s.Cooling != prev.Cooling {
+		points = append(points, eventPoint(config, sensor, InfluxEventCooling, s.Cooling, "Cooling "+onOff(s.Cooling), s.When))
+	}
+	if s.Fault != prev.Fault {
+		text := "Recovered"
+		if s.Fault {
+			text = "Faulted: " + s.Error
+		}
+		points = append(points, eventPoint(config, sensor, InfluxEventFault, s.Fault, text, s.When))
+	}
+	return points
+}
+
+// ConfigPoint returns the event written to Influx when a configuration is loaded
+func ConfigPoint(config Influx, when time.Time) InfluxPoint {
+	return eventPoint(config, Sensor{}, InfluxEventConfig, true, "Configuration loaded", when)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// InfluxSpoolPath returns where the points of the sink called name are spooled while Influx is
+// unreachable. Unless configured, it is next to the config file.
+func InfluxSpoolPath(configPath string, name string, config Influx) string {
+	if config.Spool != "" {
+		return config.Spool
+	}
+	return filepath.Join(filepath.Dir(configPath), name+".spool")
+}
+
+// CheckInflux returns an error if an Influx configuration can't be written to
+func CheckInflux(config Influx) error {
+	switch config.Version {
+	case 0, InfluxV1:
+	case InfluxV2:
+		if config.Addr != "" && (config.Org == "" || config.Bucket == "") {
+			return errors.New("InfluxDB 2.x needs an org and a bucket")
+		}
+	default:
+		return fmt.Errorf("Unknown Influx version: %d", config.Version)
+	}
+	return nil
+}
+
+// InfluxTimeout returns how long a write to Influx may take
+func InfluxTimeout(config Influx) time.Duration {
+	if config.Timeout <= 0 {
+		return DefaultInfluxTimeout
+	}
+	return time.Duration(config.Timeout * float64(time.Second))
+}
+
+// NewInfluxClient creates an HTTP client for writing to Influx
+func NewInfluxClient(config Influx) *http.Client {
+	return &http.Client{
+		Timeout: InfluxTimeout(config),
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+		},
+	}
+}
+
+// InfluxWriteError is a write that Influx responded to with an error. Points is how many points
+// weren't written because of it.
+type InfluxWriteError struct {
+	StatusCode int
+	Status     string
+	Message    string
+	Points     int
+}
+
+func (e *InfluxWriteError) Error() string {
+	return fmt.Sprintf("Influx responded %s: %s", e.Status, e.Message)
+}
+
+// InfluxRetryable returns whether a failed write is worth trying again, because Influx couldn't be
+// reached or couldn't take the points just then. Writes Influx rejects as invalid, like those with
+// a bad token or a field of the wrong type, fail again however often they are tried.
+func InfluxRetryable(err error) bool {
+	if e, ok := err.(*InfluxWriteError); ok {
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// WriteInfluxPoints writes points to an InfluxDB 1.x database through its write endpoint, in batches
+// of up to influxBatchSize
+func WriteInfluxPoints(c *http.Client, config Influx, points []InfluxPoint) error {
+	query := url.Values{}
+	query.Set("db", config.Database)
+	query.Set("precision", "s")
+	u := strings.TrimSuffix(config.Addr, "/") + "/write?" + query.Encode()
+
+	return writeInfluxLines(c, u, config, points, func(req *http.Request) {
+		if config.Username != "" {
+			req.SetBasicAuth(config.Username, config.Password)
+		}
 	})
-	if err != nil {
-		return err
+}
+
+// Escaping in line protocol: of measurements, of tag keys, tag values and field keys, and of string field values
+var (
+	lineEscaper    = strings.NewReplacer(",", `\,`, " ", `\ `)
+	lineKeyEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	lineStrEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// LineProtocol returns a point in the line protocol of Influx, with its time in seconds. Tags with
+// no value are left out, as are fields that can't be written, like NaN.
+func LineProtocol(p InfluxPoint) (string, error) {
+	var b strings.Builder
+	b.WriteString(lineEscaper.Replace(p.Measurement))
+
+	keys := make([]string, 0, len(p.Tags))
+	for k, v := range p.Tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString("," + lineKeyEscaper.Replace(k) + "=" + lineKeyEscaper.Replace(p.Tags[k]))
+	}
+
+	keys = keys[:0]
+	for k := range p.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	sep := " "
+	for _, k := range keys {
+		var value string
+		switch v := p.Fields[k].(type) {
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		case int64:
+			value = strconv.FormatInt(v, 10) + "i"
+		case bool:
+			value = strconv.FormatBool(v)
+		case string:
+			value = `"` + lineStrEscaper.Replace(v) + `"`
+		default:
+			return "", fmt.Errorf("Unsupported type of field %s: %T", k, v)
+		}
+		b.WriteString(sep + lineKeyEscaper.Replace(k) + "=" + value)
+		sep = ","
+	}
+	if sep == " " {
+		return "", fmt.Errorf("Point in %s has no fields", p.Measurement)
 	}
-	defer c.Close()
 
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  config.Database,
-		Precision: "s",
+	b.WriteString(" " + strconv.FormatInt(p.Time.Unix(), 10))
+	return b.String(), nil
+}
+
+// WriteInfluxV2Points writes points to the bucket of an InfluxDB 2.x server through its write API,
+// in batches of up to influxBatchSize
+func WriteInfluxV2Points(c *http.Client, config Influx, points []InfluxPoint) error {
+	query := url.Values{}
+	query.Set("org", config.Org)
+	query.Set("bucket", config.Bucket)
+	query.Set("precision", "s")
+	u := strings.TrimSuffix(config.Addr, "/") + "/api/v2/write?" + query.Encode()
+
+	return writeInfluxLines(c, u, config, points, func(req *http.Request) {
+		req.Header.Set("Authorization", "Token "+config.Token)
 	})
+}
+
+// writeInfluxLines posts points to u as line protocol, in batches of up to influxBatchSize, with
+// auth adding the credentials to each request. Batches Influx rejects are skipped, and returned as
+// one InfluxWriteError once the rest are written. Any other error stops the write.
+func writeInfluxLines(c *http.Client, u string, config Influx, points []InfluxPoint, auth func(req *http.Request)) error {
+	var rejected *InfluxWriteError
+	for len(points) > 0 {
+		n := len(points)
+		if n > influxBatchSize {
+			n = influxBatchSize
+		}
+
+		var body bytes.Buffer
+		for _, p := range points[:n] {
+			line, err := LineProtocol(p)
+			if err != nil {
+				return err
+			}
+			body.WriteString(line + "\n")
+		}
+
+		req, err := http.NewRequest("POST", u, &body)
+		if err != nil {
+			return err
+		}
+		auth(req)
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if config.UserAgent != "" {
+			req.Header.Set("User-Agent", config.UserAgent)
+		}
+
+		resp, err := c.Do(req)
+		if err != nil {
+			return err
+		}
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			werr := &InfluxWriteError{StatusCode: resp.StatusCode, Status: resp.Status, Message: strings.TrimSpace(string(msg)), Points: n}
+			if InfluxRetryable(werr) {
+				return werr
+			}
+			if rejected != nil {
+				werr.Points += rejected.Points
+			}
+			rejected = werr
+		}
+		points = points[n:]
+	}
+
+	if rejected != nil {
+		return rejected
+	}
+	return nil
+}
+
+// spooledPoint is how a point is stored on disk. Fields are kept apart by type, so they are
+// written back to Influx with the same types.
+type spooledPoint struct {
+	Measurement string             `json:"measurement"`
+	Tags        map[string]string  `json:"tags"`
+	Floats      map[string]float64 `json:"floats,omitempty"`
+	Ints        map[string]int64   `json:"ints,omitempty"`
+	Bools       map[string]bool    `json:"bools,omitempty"`
+	Strings     map[string]string  `json:"strings,omitempty"`
+	Time        time.Time          `json:"time"`
+}
+
+func newSpooledPoint(p InfluxPoint) spooledPoint {
+	s := spooledPoint{Measurement: p.Measurement, Tags: p.Tags, Time: p.Time}
+	for k, v := range p.Fields {
+		switch v := v.(type) {
+		case float64:
+			if s.Floats == nil {
+				s.Floats = make(map[string]float64)
+			}
+			s.Floats[k] = v
+		case int64:
+			if s.Ints == nil {
+				s.Ints = make(map[string]int64)
+			}
+			s.Ints[k] = v
+		case bool:
+			if s.Bools == nil {
+				s.Bools = make(map[string]bool)
+			}
+			s.Bools[k] = v
+		case string:
+			if s.Strings == nil {
+				s.Strings = make(map[string]string)
+			}
+			s.Strings[k] = v
+		}
+	}
+	return s
+}
+
+func (s spooledPoint) point() InfluxPoint {
+	p := InfluxPoint{Measurement: s.Measurement, Tags: s.Tags, Fields: make(map[string]interface{}), Time: s.Time}
+	for k, v := range s.Floats {
+		p.Fields[k] = v
+	}
+	for k, v := range s.Ints {
+		p.Fields[k] = v
+	}
+	for k, v := range s.Bools {
+		p.Fields[k] = v
+	}
+	for k, v := range s.Strings {
+		p.Fields[k] = v
+	}
+	return p
+}
+
+// appendSpool adds points to the end of a spool file
+func appendSpool(path string, points []InfluxPoint) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
 
-	tags := map[string]string{"alias": s.Alias}
-	fields := map[string]interface{}{"value": s.Temp}
-	pt, err := client.NewPoint("temperature", tags, fields, s.When)
+	enc := json.NewEncoder(f)
+	for _, p := range points {
+		if err := enc.Encode(newSpooledPoint(p)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// readSpool returns the points in a spool file. A missing file has no points.
+func readSpool(path string) ([]InfluxPoint, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var points []InfluxPoint
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s spooledPoint
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			// A line cut short by a crash; skip it rather than losing the rest
+			continue
+		}
+		points = append(points, s.point())
+	}
+
+	return points, scanner.Err()
+}
+
+// InfluxWriter is a MetricsSink writing states to Influx in the background. Points are batched and
+// written every FlushInterval. While writes fail they are retried with a backoff, and the points
+// waiting are spooled to disk until Influx is back. Nothing is written without an Addr.
+type InfluxWriter struct {
+	name  string
+	spool string
+
+	mu      sync.Mutex
+	config  Influx
+	pending []InfluxPoint
+	health  WriterHealth
+	last    map[string]State // The last state of each sensor, by ID, to find transitions
+
+	// write writes points, and is replaced in tests
+	write func(config Influx, points []InfluxPoint) error
+
+	// Only one flush runs at a time, and it owns the client
+	flushMu sync.Mutex
+	c       *http.Client
+	cfor    Influx
+
+	stop   chan struct{}
+	done   chan struct{}
+	closed sync.Once
+}
+
+// NewInfluxWriter creates and starts a writer, which reports its health as name and spools points to
+// the file at spool. Any points already spooled are written once Influx can be reached. Close it to
+// write the points still waiting.
+func NewInfluxWriter(name string, spool string, config Influx) *InfluxWriter {
+	w := &InfluxWriter{
+		name:   name,
+		spool:  spool,
+		config: config,
+		last:   make(map[string]State),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	w.write = w.writeClient
+
+	spooled, err := readSpool(spool)
 	if err != nil {
-		return err
+		log.Println("Unable to read the Influx spool:", err)
 	}
+	w.health.Spooled = len(spooled)
+	w.updateHealth()
 
-	bp.AddPoint(pt)
-	if err := c.Write(bp); err != nil {
-		return err
+	go w.run()
+	return w
+}
+
+// HandleEvent queues state events, and the transitions between them, to be written. Config events
+// are recorded as events too.
+func (w *InfluxWriter) HandleEvent(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch e.Type {
+	case EventConfig:
+		if w.config.Addr != "" {
+			w.pending = append(w.pending, ConfigPoint(w.config, time.Now()))
+		}
+	case EventState:
+		prev, ok := w.last[e.Sensor.ID]
+		w.last[e.Sensor.ID] = e.State
+		if w.config.Addr == "" {
+			return
+		}
+		w.pending = append(w.pending, StatePoint(w.config, e.Sensor, e.State))
+		if ok {
+			w.pending = append(w.pending, TransitionPoints(w.config, e.Sensor, prev, e.State)...)
+		}
+	}
+	w.health.Pending = len(w.pending)
+	w.updateHealth()
+}
+
+// flushInterval returns how often to write points. w.mu must be held.
+func (w *InfluxWriter) flushInterval() time.Duration {
+	if w.config.FlushInterval > 0 {
+		return time.Duration(w.config.FlushInterval * float64(time.Second))
+	}
+	return DefaultFlushInterval
+}
+
+func (w *InfluxWriter) run() {
+	defer close(w.done)
+
+	w.mu.Lock()
+	delay := w.flushInterval()
+	w.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			w.Flush()
+			w.flushMu.Lock()
+			w.closeClient()
+			w.flushMu.Unlock()
+			return
+		case <-timer.C:
+		}
+
+		err := w.Flush()
+
+		w.mu.Lock()
+		interval := w.flushInterval()
+		w.mu.Unlock()
+
+		// Back off while Influx can't be reached, so a struggling server isn't hammered
+		if err != nil && InfluxRetryable(err) {
+			delay *= 2
+			if delay > influxRetryMax {
+				delay = influxRetryMax
+			}
+			if delay < interval {
+				delay = interval
+			}
+		} else {
+			delay = interval
+		}
+		timer.Reset(delay)
+	}
+}
+
+// Flush writes the spooled and pending points. If Influx can't be reached, the pending points are
+// spooled to try again later. Points Influx rejects are dropped.
+func (w *InfluxWriter) Flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	config := w.config
+	pending := w.pending
+	spooled := w.health.Spooled
+	w.pending = nil
+	w.health.Pending = 0
+	w.mu.Unlock()
+
+	if config.Addr == "" || (len(pending) == 0 && spooled == 0) {
+		return nil
+	}
+
+	err := w.flush(config, pending, spooled)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		influxWriteErrors.Inc()
+		log.Println("Unable to write to Influx:", err)
+		w.health.LastError = err.Error()
+		w.health.ErrorTime = time.Now()
+	} else {
+		w.health.LastWrite = time.Now()
+		w.health.LastError = ""
+	}
+	w.updateHealth()
+	return err
+}
+
+// flush writes the points spooled, then those pending
+func (w *InfluxWriter) flush(config Influx, pending []InfluxPoint, spooled int) error {
+	var rejected error
+	if spooled > 0 {
+		points, err := readSpool(w.spool)
+		if err != nil {
+			return w.spoolPoints(pending, err)
+		}
+		err = w.write(config, points)
+		if err != nil && InfluxRetryable(err) {
+			return w.spoolPoints(pending, err)
+		}
+		if err := os.Remove(w.spool); err != nil && !os.IsNotExist(err) {
+			log.Println("Unable to remove the Influx spool:", err)
+		}
+		w.mu.Lock()
+		w.health.Spooled = 0
+		w.mu.Unlock()
+		if err != nil {
+			rejected = w.rejectPoints(err, len(points))
+		} else {
+			log.Printf("Wrote %d spooled points to Influx", len(points))
+		}
 	}
 
+	if len(pending) == 0 {
+		return rejected
+	}
+	if err := w.write(config, pending); err != nil {
+		if InfluxRetryable(err) {
+			return w.spoolPoints(pending, err)
+		}
+		return w.rejectPoints(err, len(pending))
+	}
+	return rejected
+}
+
+// rejectPoints drops points Influx won't take, as trying them again would only hold up the points
+// after them. Of the n points written, only those in rejected batches are counted. It returns err,
+// the reason they were rejected.
+func (w *InfluxWriter) rejectPoints(err error, n int) error {
+	if e, ok := err.(*InfluxWriteError); ok {
+		n = e.Points
+	}
+	log.Printf("Influx rejected %d points, dropping them: %v", n, err)
+
+	w.mu.Lock()
+	w.health.Rejected += n
+	w.mu.Unlock()
+	return err
+}
+
+// spoolPoints keeps points that couldn't be written on disk, dropping them once the spool is full.
+// It returns err, the reason the points weren't written.
+func (w *InfluxWriter) spoolPoints(points []InfluxPoint, err error) error {
+	w.mu.Lock()
+	room := influxSpoolMax - w.health.Spooled
+	w.mu.Unlock()
+
+	if room < 0 {
+		room = 0
+	}
+	var dropped int
+	if len(points) > room {
+		dropped = len(points) - room
+		points = points[:room]
+	}
+
+	if len(points) > 0 {
+		if spoolErr := appendSpool(w.spool, points); spoolErr != nil {
+			log.Println("Unable to spool points for Influx:", spoolErr)
+			dropped += len(points)
+			points = nil
+		}
+	}
+
+	w.mu.Lock()
+	w.health.Spooled += len(points)
+	w.health.Dropped += dropped
+	w.mu.Unlock()
+	if dropped > 0 {
+		log.Printf("Dropped %d points for Influx", dropped)
+	}
+
+	return err
+}
+
+// writeClient writes points with a client that is kept between writes, until the settings change
+func (w *InfluxWriter) writeClient(config Influx, points []InfluxPoint) error {
+	if !sameInfluxServer(w.cfor, config) {
+		w.closeClient()
+	}
+	w.cfor = config
+
+	if w.c == nil {
+		w.c = NewInfluxClient(config)
+	}
+	if config.Version == InfluxV2 {
+		return WriteInfluxV2Points(w.c, config, points)
+	}
+	return WriteInfluxPoints(w.c, config, points)
+}
+
+// sameInfluxServer returns whether a client made for one configuration can write for another
+func sameInfluxServer(a Influx, b Influx) bool {
+	return a.Addr == b.Addr && a.Username == b.Username && a.Password == b.Password &&
+		a.UserAgent == b.UserAgent && a.Timeout == b.Timeout && a.InsecureSkipVerify == b.InsecureSkipVerify
+}
+
+func (w *InfluxWriter) closeClient() {
+	if w.c != nil {
+		w.c.CloseIdleConnections()
+		w.c = nil
+	}
+}
+
+// updateHealth publishes the health of the writer. w.mu must be held.
+func (w *InfluxWriter) updateHealth() {
+	w.health.Enabled = w.config.Addr != ""
+	w.health.Healthy = w.health.LastError == ""
+	SetWriterHealth(w.name, w.health)
+}
+
+// Close writes any points waiting, spooling them if Influx can't be reached, and stops the writer
+func (w *InfluxWriter) Close() error {
+	w.closed.Do(func() {
+		close(w.stop)
+		<-w.done
+	})
 	return nil
 }
+
+func newInfluxSink(configPath string, sink Sink) (MetricsSink, error) {
+	if err := CheckInflux(sink.Influx); err != nil {
+		return nil, err
+	}
+	return NewInfluxWriter(sink.Name, InfluxSpoolPath(configPath, sink.Name, sink.Influx), sink.Influx), nil
+}
@@ -1,26 +1,376 @@
 package main
 
 import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func Test_WriteStateToInflux(t *testing.T) {
+func Test_WriteInfluxPoints(t *testing.T) {
 	influxAddr := os.Getenv("INFLUXDB_ADDR")
-	state := State{Temp: 32}
+	points := []InfluxPoint{StatePoint(Influx{}, Sensor{ID: "foo", Alias: "foo"}, State{Alias: "foo", Temp: 32, When: time.Now()})}
 
 	// Test failure with empty config
-	err := WriteStateToInflux(state, Influx{})
-	assert.NotEqual(t, nil, err)
+	c := NewInfluxClient(Influx{})
+	assert.NotEqual(t, nil, WriteInfluxPoints(c, Influx{}, points))
 
 	// Test failure with missing database
-	err = WriteStateToInflux(state, Influx{Addr: influxAddr})
-	assert.NotEqual(t, nil, err)
+	c = NewInfluxClient(Influx{Addr: influxAddr})
+	assert.NotEqual(t, nil, WriteInfluxPoints(c, Influx{Addr: influxAddr}, points))
 
 	// Test success with writing to database
 	config := Influx{Addr: influxAddr, Database: "db"}
-	err = WriteStateToInflux(state, config)
+	assert.Equal(t, nil, WriteInfluxPoints(c, config, points))
+}
+
+func Test_WriteInfluxPointsV1(t *testing.T) {
+	fake := &fakeInfluxV2{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	config := Influx{Addr: server.URL, Database: "db", Username: "tg", Password: "secret"}
+	when := time.Unix(1540000000, 0)
+	points := []InfluxPoint{StatePoint(config, Sensor{ID: "28-foo", Alias: "foo"}, State{Temp: 18, When: when})}
+
+	assert.Equal(t, nil, WriteInfluxPoints(NewInfluxClient(config), config, points))
+	r := fake.reqs[0]
+	assert.Equal(t, "/write", r.URL.Path)
+	assert.Equal(t, "db", r.URL.Query().Get("db"))
+	assert.Equal(t, "s", r.URL.Query().Get("precision"))
+	user, pass, _ := r.BasicAuth()
+	assert.Equal(t, "tg", user)
+	assert.Equal(t, "secret", pass)
+	assert.True(t, strings.HasPrefix(fake.bodies[0], "temperature,alias=foo,id=28-foo "))
+}
+
+func Test_InfluxRetryable(t *testing.T) {
+	assert.True(t, InfluxRetryable(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.True(t, InfluxRetryable(&InfluxWriteError{StatusCode: http.StatusServiceUnavailable}))
+	assert.True(t, InfluxRetryable(&InfluxWriteError{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, InfluxRetryable(&InfluxWriteError{StatusCode: http.StatusBadRequest}))
+	assert.False(t, InfluxRetryable(&InfluxWriteError{StatusCode: http.StatusUnauthorized}))
+	assert.False(t, InfluxRetryable(errors.New("Point in m has no fields")))
+}
+
+func Test_CheckInflux(t *testing.T) {
+	assert.Equal(t, nil, CheckInflux(Influx{}))
+	assert.Equal(t, nil, CheckInflux(Influx{Version: InfluxV1, Addr: "http://influx:8086"}))
+	assert.Equal(t, nil, CheckInflux(Influx{Version: InfluxV2}))
+	assert.Equal(t, nil, CheckInflux(Influx{Version: InfluxV2, Addr: "http://influx:8086", Org: "home", Bucket: "brewery"}))
+	assert.NotEqual(t, nil, CheckInflux(Influx{Version: InfluxV2, Addr: "http://influx:8086", Org: "home"}))
+	assert.NotEqual(t, nil, CheckInflux(Influx{Version: 3}))
+}
+
+func Test_LineProtocol(t *testing.T) {
+	when := time.Unix(1540000000, 0)
+	line, err := LineProtocol(InfluxPoint{
+		Measurement: "temperature",
+		Tags:        map[string]string{"alias": "foo", "id": "28-foo"},
+		Fields:      map[string]interface{}{"value": 18.25, "heating": true},
+		Time:        when,
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "temperature,alias=foo,id=28-foo heating=true,value=18.25 1540000000", line)
+
+	// Special characters are escaped, and empty tags and NaN are left out
+	line, err = LineProtocol(InfluxPoint{
+		Measurement: "my events",
+		Tags:        map[string]string{"alias": "big, beer=yes", "id": ""},
+		Fields:      map[string]interface{}{"text": `Faulted: "no" \ yes`, "count": int64(3), "temp": math.NaN()},
+		Time:        when,
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `my\ events,alias=big\,\ beer\=yes count=3i,text="Faulted: \"no\" \\ yes" 1540000000`, line)
+
+	// A point needs a field of a known type
+	_, err = LineProtocol(InfluxPoint{Measurement: "m", Fields: map[string]interface{}{"v": math.NaN()}})
+	assert.NotEqual(t, nil, err)
+	_, err = LineProtocol(InfluxPoint{Measurement: "m", Fields: map[string]interface{}{"v": 3}})
+	assert.NotEqual(t, nil, err)
+}
+
+// fakeInfluxV2 stands in for the write API of InfluxDB 2.x
+type fakeInfluxV2 struct {
+	mu     sync.Mutex
+	status int
+	reqs   []*http.Request
+	bodies []string
+}
+
+func (f *fakeInfluxV2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reqs = append(f.reqs, r)
+	f.bodies = append(f.bodies, string(body))
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		w.Write([]byte(`{"code":"unauthorized","message":"unauthorized access"}`))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func Test_WriteInfluxV2Points(t *testing.T) {
+	fake := &fakeInfluxV2{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	config := Influx{Version: InfluxV2, Addr: server.URL + "/", Token: "secret", Org: "home", Bucket: "brewery", Timeout: 5}
+	when := time.Unix(1540000000, 0)
+	points := []InfluxPoint{
+		StatePoint(config, Sensor{ID: "28-foo", Alias: "foo"}, State{Temp: 18, When: when}),
+		ConfigPoint(config, when),
+	}
+
+	c := NewInfluxClient(config)
+	assert.Equal(t, nil, WriteInfluxV2Points(c, config, points))
+	assert.Equal(t, 1, len(fake.reqs))
+	r := fake.reqs[0]
+	assert.Equal(t, "POST", r.Method)
+	assert.Equal(t, "/api/v2/write", r.URL.Path)
+	assert.Equal(t, "home", r.URL.Query().Get("org"))
+	assert.Equal(t, "brewery", r.URL.Query().Get("bucket"))
+	assert.Equal(t, "s", r.URL.Query().Get("precision"))
+	assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+	lines := strings.Split(strings.TrimSpace(fake.bodies[0]), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.True(t, strings.HasPrefix(lines[0], "temperature,alias=foo,id=28-foo cooling=false,"))
+	assert.True(t, strings.HasSuffix(lines[0], " 1540000000"))
+	assert.Equal(t, `events,event=config text="Configuration loaded",value=true 1540000000`, lines[1])
+
+	// Errors from the server are returned
+	fake.mu.Lock()
+	fake.status = http.StatusUnauthorized
+	fake.mu.Unlock()
+	err := WriteInfluxV2Points(c, config, points)
+	assert.NotEqual(t, nil, err)
+	assert.True(t, strings.Contains(err.Error(), "unauthorized access"))
+	assert.False(t, InfluxRetryable(err))
+	assert.Equal(t, 2, err.(*InfluxWriteError).Points)
+
+	// The writer uses the write API for 2.x
+	fake.mu.Lock()
+	fake.status = 0
+	fake.mu.Unlock()
+	w := NewInfluxWriter("influx", filepath.Join(t.TempDir(), "influx.spool"), config)
+	defer w.Close()
+	w.HandleEvent(Event{Type: EventState, Sensor: Sensor{ID: "28-foo", Alias: "foo"}, State: State{Temp: 18, When: when}})
+	assert.Equal(t, nil, w.Flush())
+	fake.mu.Lock()
+	assert.Equal(t, 3, len(fake.reqs))
+	fake.mu.Unlock()
+}
+
+func Test_InfluxTimeout(t *testing.T) {
+	assert.Equal(t, DefaultInfluxTimeout, InfluxTimeout(Influx{}))
+	assert.Equal(t, 1500*time.Millisecond, InfluxTimeout(Influx{Timeout: 1.5}))
+	assert.Equal(t, DefaultInfluxTimeout, NewInfluxClient(Influx{}).Timeout)
+}
+
+func Test_InfluxSpoolPath(t *testing.T) {
+	assert.Equal(t, "/etc/tempgopher/influx.spool", InfluxSpoolPath("/etc/tempgopher/config.yml", "influx", Influx{}))
+	assert.Equal(t, "/etc/tempgopher/cloud.spool", InfluxSpoolPath("/etc/tempgopher/config.yml", "cloud", Influx{}))
+	assert.Equal(t, "/var/spool/influx", InfluxSpoolPath("/etc/tempgopher/config.yml", "influx", Influx{Spool: "/var/spool/influx"}))
+}
+
+func Test_StatePoint(t *testing.T) {
+	now := time.Now()
+	sensor := Sensor{ID: "28-foo", Alias: "foo", HighTemp: 20, LowTemp: 18}
+	state := State{Alias: "foo", Temp: 19, Raw: 19.2, Heating: true, When: now}
+
+	p := StatePoint(Influx{}, sensor, state)
+	assert.Equal(t, "temperature", p.Measurement)
+	assert.Equal(t, map[string]string{"alias": "foo", "id": "28-foo"}, p.Tags)
+	assert.Equal(t, 19.0, p.Fields["value"])
+	assert.Equal(t, 19.2, p.Fields["raw"])
+	assert.Equal(t, true, p.Fields["heating"])
+	assert.Equal(t, false, p.Fields["cooling"])
+	assert.Equal(t, 20.0, p.Fields["hightemp"])
+	assert.Equal(t, 18.0, p.Fields["lowtemp"])
+	assert.Equal(t, nil, p.Fields["setpoint"])
+	assert.Equal(t, now, p.Time)
+
+	// PID sensors have their setpoint, and the measurement and extra tags can be configured
+	sensor.Mode = ModePID
+	sensor.SetPoint = 19.5
+	config := Influx{Measurement: "fermenters", Tags: map[string]string{"site": "cellar", "alias": "bar"}}
+	p = StatePoint(config, sensor, state)
+	assert.Equal(t, "fermenters", p.Measurement)
+	assert.Equal(t, map[string]string{"alias": "foo", "id": "28-foo", "site": "cellar"}, p.Tags)
+	assert.Equal(t, 19.5, p.Fields["setpoint"])
+}
+
+func Test_TransitionPoints(t *testing.T) {
+	now := time.Now()
+	sensor := Sensor{ID: "28-foo", Alias: "foo"}
+	config := Influx{Tags: map[string]string{"site": "cellar"}}
+
+	// Nothing changing is no events
+	assert.Equal(t, 0, len(TransitionPoints(config, sensor, State{}, State{When: now})))
+
+	points := TransitionPoints(config, sensor, State{Cooling: true}, State{Heating: true, Fault: true, Error: "broken", When: now})
+	assert.Equal(t, 3, len(points))
+	events := make(map[string]InfluxPoint)
+	for _, p := range points {
+		assert.Equal(t, "events", p.Measurement)
+		assert.Equal(t, "foo", p.Tags["alias"])
+		assert.Equal(t, "cellar", p.Tags["site"])
+		assert.Equal(t, now, p.Time)
+		events[p.Tags["event"]] = p
+	}
+	assert.Equal(t, true, events[InfluxEventHeating].Fields["value"])
+	assert.Equal(t, "Heating on", events[InfluxEventHeating].Fields["text"])
+	assert.Equal(t, false, events[InfluxEventCooling].Fields["value"])
+	assert.Equal(t, "Cooling off", events[InfluxEventCooling].Fields["text"])
+	assert.Equal(t, "Faulted: broken", events[InfluxEventFault].Fields["text"])
+
+	p := ConfigPoint(Influx{EventMeasurement: "changes"}, now)
+	assert.Equal(t, "changes", p.Measurement)
+	assert.Equal(t, map[string]string{"event": InfluxEventConfig}, p.Tags)
+}
+
+// fakeInfluxWrites records the points written, failing while err is set
+type fakeInfluxWrites struct {
+	mu      sync.Mutex
+	err     error
+	written []InfluxPoint
+}
+
+func (f *fakeInfluxWrites) write(config Influx, points []InfluxPoint) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.written = append(f.written, points...)
+	return nil
+}
+
+func Test_InfluxWriter(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "influx.spool")
+	config := Influx{Addr: "http://influx:8086", Database: "db", FlushInterval: 3600}
+	now := time.Now().Truncate(time.Second)
+	foo := Sensor{ID: "foo", Alias: "foo"}
+	bar := Sensor{ID: "bar", Alias: "bar"}
+
+	// Nothing is queued without an address
+	w := NewInfluxWriter("influx", spool, Influx{})
+	fake := &fakeInfluxWrites{}
+	w.write = fake.write
+	w.HandleEvent(Event{Type: EventConfig, Config: &Config{}})
+	w.HandleEvent(Event{Type: EventState, Sensor: foo, State: State{Alias: "foo", Temp: 20, When: now}})
+	assert.Equal(t, nil, w.Flush())
+	assert.Equal(t, 0, len(fake.written))
+	assert.False(t, GetWriterHealth()["influx"].Enabled)
+	w.Close()
+
+	// States and config changes are batched until a flush
+	w = NewInfluxWriter("influx", spool, config)
+	w.write = fake.write
+	w.HandleEvent(Event{Type: EventConfig, Config: &Config{Influx: config}})
+	w.HandleEvent(Event{Type: EventState, Sensor: foo, State: State{Alias: "foo", Temp: 20, Raw: 20.5, When: now}})
+	w.HandleEvent(Event{Type: EventState, Sensor: bar, State: State{Alias: "bar", Temp: 10, When: now}})
+	assert.Equal(t, 3, GetWriterHealth()["influx"].Pending)
+	assert.Equal(t, nil, w.Flush())
+	assert.Equal(t, 3, len(fake.written))
+	assert.Equal(t, InfluxEventConfig, fake.written[0].Tags["event"])
+	assert.Equal(t, 20.5, fake.written[1].Fields["raw"])
+	health := GetWriterHealth()["influx"]
+	assert.True(t, health.Enabled)
+	assert.True(t, health.Healthy)
+	assert.Equal(t, 0, health.Pending)
+
+	// Points are spooled while Influx is unreachable, with an event when heating starts
+	fake.mu.Lock()
+	fake.err = &net.OpError{Op: "dial", Err: errors.New("unreachable")}
+	fake.mu.Unlock()
+	w.HandleEvent(Event{Type: EventState, Sensor: foo, State: State{Alias: "foo", Temp: 21, Heating: true, When: now}})
+	assert.NotEqual(t, nil, w.Flush())
+	w.HandleEvent(Event{Type: EventState, Sensor: foo, State: State{Alias: "foo", Temp: 22, Heating: true, When: now}})
+	assert.NotEqual(t, nil, w.Flush())
+	health = GetWriterHealth()["influx"]
+	assert.False(t, health.Healthy)
+	assert.Equal(t, "dial: unreachable", health.LastError)
+	assert.Equal(t, 3, health.Spooled)
+
+	// The spool survives a restart, and is written with the same field types once Influx is back
+	w.Close()
+	w = NewInfluxWriter("influx", spool, config)
+	defer w.Close()
+	w.write = fake.write
+	assert.Equal(t, 3, GetWriterHealth()["influx"].Spooled)
+	fake.mu.Lock()
+	fake.err = nil
+	fake.written = nil
+	fake.mu.Unlock()
+	assert.Equal(t, nil, w.Flush())
+	assert.Equal(t, 3, len(fake.written))
+	assert.Equal(t, 21.0, fake.written[0].Fields["value"])
+	assert.Equal(t, true, fake.written[0].Fields["heating"])
+	assert.Equal(t, "foo", fake.written[0].Tags["alias"])
+	assert.True(t, now.Equal(fake.written[0].Time))
+	assert.Equal(t, InfluxEventHeating, fake.written[1].Tags["event"])
+	assert.Equal(t, true, fake.written[1].Fields["value"])
+	assert.Equal(t, 0, GetWriterHealth()["influx"].Spooled)
+	_, err := os.Stat(spool)
+	assert.True(t, os.IsNotExist(err))
+
+	// Points Influx rejects are dropped rather than spooled, so they don't hold up the rest
+	fake.mu.Lock()
+	fake.err = &InfluxWriteError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request", Message: "field type conflict", Points: 1}
+	fake.mu.Unlock()
+	w.HandleEvent(Event{Type: EventState, Sensor: bar, State: State{Alias: "bar", Temp: 11, When: now}})
+	assert.NotEqual(t, nil, w.Flush())
+	health = GetWriterHealth()["influx"]
+	assert.False(t, health.Healthy)
+	assert.Equal(t, 0, health.Spooled)
+	assert.Equal(t, 1, health.Rejected)
+
+	fake.mu.Lock()
+	fake.err = nil
+	fake.written = nil
+	fake.mu.Unlock()
+	w.HandleEvent(Event{Type: EventState, Sensor: bar, State: State{Alias: "bar", Temp: 12, When: now}})
+	assert.Equal(t, nil, w.Flush())
+	assert.Equal(t, 1, len(fake.written))
+	assert.Equal(t, 12.0, fake.written[0].Fields["value"])
+}
+
+func Test_Spool(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "influx.spool")
+	now := time.Now().Truncate(time.Second)
+	points := []InfluxPoint{InfluxPoint{
+		Measurement: "m",
+		Tags:        map[string]string{"alias": "foo"},
+		Fields:      map[string]interface{}{"f": 1.5, "i": int64(3), "b": true, "s": "on"},
+		Time:        now,
+	}}
+
+	// A missing spool is empty
+	read, err := readSpool(spool)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(read))
+
+	// Fields keep their types, and lines cut short are skipped
+	assert.Equal(t, nil, appendSpool(spool, points))
+	f, _ := os.OpenFile(spool, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"measurement": "m", "tags"`)
+	f.Close()
+	read, err = readSpool(spool)
 	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(read))
+	assert.Equal(t, points[0].Fields, read[0].Fields)
+	assert.True(t, now.Equal(read[0].Time))
 }
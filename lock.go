@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrLocked is returned by LockOutputs when another process is driving the outputs
+var ErrLocked = errors.New("Another tempgopher is running with this configuration")
+
+// LockFilePath returns the path of the lock held while driving the outputs of a configuration,
+// next to its state file
+func LockFilePath(configPath string, config *Config) string {
+	return StateFilePath(configPath, config) + ".lock"
+}
+
+// OutputLock is held by the process driving the outputs of a configuration
+type OutputLock struct {
+	f *os.File
+}
+
+// LockOutputs takes the lock at path, so that only one process drives the outputs at a time. It
+// returns ErrLocked if another process holds it.
+func LockOutputs(path string) (*OutputLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &OutputLock{f: f}, nil
+}
+
+// Unlock releases the lock
+func (l *OutputLock) Unlock() error {
+	return l.f.Close()
+}
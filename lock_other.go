@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// lockFile does nothing; locking is only supported on Linux
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LockFilePath(t *testing.T) {
+	assert.Equal(t, "/etc/tempgopher/state.json.lock", LockFilePath("/etc/tempgopher/config.yml", &Config{}))
+	assert.Equal(t, "/var/lib/state.json.lock", LockFilePath("config.yml", &Config{StateFile: "/var/lib/state.json"}))
+}
+
+func Test_LockOutputs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Locking is only supported on Linux")
+	}
+
+	dir, err := ioutil.TempDir("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json.lock")
+
+	lock, err := LockOutputs(path)
+	assert.Equal(t, nil, err)
+
+	// Only one holder at a time
+	_, err = LockOutputs(path)
+	assert.Equal(t, ErrLocked, err)
+
+	// Until it's released
+	assert.Equal(t, nil, lock.Unlock())
+	lock, err = LockOutputs(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, lock.Unlock())
+}
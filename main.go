@@ -4,7 +4,6 @@ import (
 	"sync"
 
 	"github.com/alexflint/go-arg"
-	"github.com/stianeikeland/go-rpio"
 )
 
 // Version is the current code version of tempgopher
@@ -12,37 +11,60 @@ const Version = "0.4.0"
 
 func main() {
 	var args struct {
-		Action     string `arg:"required,positional" help:"run config"`
+		Action     string `arg:"required,positional" help:"run config simulate autotune calibrate"`
 		ConfigFile string `arg:"-c,required" help:"path to config file"`
+		Sensor     string `arg:"-s" help:"alias of the sensor to autotune or calibrate"`
+		Apply      bool   `help:"write autotuned gains to the config file"`
 	}
 
 	p := arg.MustParse(&args)
-	if args.Action != "run" && args.Action != "config" {
-		p.Fail("ACTION must be run or config")
+	if args.Action != "run" && args.Action != "config" && args.Action != "simulate" && args.Action != "autotune" && args.Action != "calibrate" {
+		p.Fail("ACTION must be run, config, simulate, autotune or calibrate")
 	}
+	configFilePath = args.ConfigFile
 
 	if args.Action == "config" {
 		ConfigCLI(args.ConfigFile)
 		return
 	}
 
-	// Create a channel for receiving of state
-	sc := make(chan State)
+	if args.Action == "autotune" {
+		if args.Sensor == "" {
+			p.Fail("--sensor is required to autotune")
+		}
+		AutotuneCLI(args.ConfigFile, args.Sensor, args.Apply)
+		return
+	}
+
+	if args.Action == "calibrate" {
+		if args.Sensor == "" {
+			p.Fail("--sensor is required to calibrate")
+		}
+		CalibrateCLI(args.ConfigFile, args.Sensor)
+		return
+	}
+
+	if args.Action == "simulate" {
+		simulateAll = true
+	}
+
+	// Share states between the thermostats and everything watching them
+	hub := NewHub()
 
 	// Use to track running routines
 	var wg sync.WaitGroup
 
 	// Launch the thermostat go routines
 	wg.Add(1)
-	go RunThermostat(args.ConfigFile, sc, &wg)
+	go RunThermostat(args.ConfigFile, hub, &wg)
 
 	// Launch the web frontend
 	wg.Add(1)
-	RunWeb(args.ConfigFile, sc, &wg)
+	RunWeb(args.ConfigFile, hub, &wg)
 
 	// Wait for all threads to stop
 	wg.Wait()
 
-	// Close the GPIO access
-	rpio.Close()
+	// Release any switches still open
+	CloseSwitches()
 }
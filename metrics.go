@@ -0,0 +1,115 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics defines the Prometheus endpoint. It needs the users of the API, unless it has users of its
+// own or is public.
+type Metrics struct {
+	Users  []User `json:"-" yaml:"users,omitempty"`
+	Public bool   `json:"-" yaml:"public,omitempty"`
+}
+
+// Counters of things that happen while running, exported with the state of each sensor
+var (
+	sensorReadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tempgopher_read_errors_total",
+		Help: "Failed or rejected reads of a sensor.",
+	}, []string{"alias"})
+	relayCycles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tempgopher_relay_cycles_total",
+		Help: "Times an output of a sensor was switched on.",
+	}, []string{"alias", "output"})
+	influxWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tempgopher_influx_write_errors_total",
+		Help: "Failed writes to Influx.",
+	})
+)
+
+// countCycles counts the outputs switched on between two states of a sensor
+func countCycles(alias string, prev State, state State) {
+	if state.Heating && !prev.Heating {
+		relayCycles.WithLabelValues(alias, "heat").Inc()
+	}
+	if state.Cooling && !prev.Cooling {
+		relayCycles.WithLabelValues(alias, "cool").Inc()
+	}
+}
+
+var (
+	tempDesc        = prometheus.NewDesc("tempgopher_temperature_celsius", "Temperature of a sensor.", []string{"alias"}, nil)
+	heatingDesc     = prometheus.NewDesc("tempgopher_heating", "Whether heating is on.", []string{"alias"}, nil)
+	coolingDesc     = prometheus.NewDesc("tempgopher_cooling", "Whether cooling is on.", []string{"alias"}, nil)
+	faultDesc       = prometheus.NewDesc("tempgopher_fault", "Whether a sensor is faulted.", []string{"alias"}, nil)
+	highTempDesc    = prometheus.NewDesc("tempgopher_high_temperature_celsius", "Temperature above which a sensor is cooled.", []string{"alias"}, nil)
+	lowTempDesc     = prometheus.NewDesc("tempgopher_low_temperature_celsius", "Temperature below which a sensor is heated.", []string{"alias"}, nil)
+	lastReadingDesc = prometheus.NewDesc("tempgopher_last_reading_age_seconds", "Seconds since a sensor was last read.", []string{"alias"}, nil)
+)
+
+// stateCollector exports the latest state of every sensor in a Hub when scraped
+type stateCollector struct {
+	hub *Hub
+}
+
+func (c stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tempDesc
+	ch <- heatingDesc
+	ch <- coolingDesc
+	ch <- faultDesc
+	ch <- highTempDesc
+	ch <- lowTempDesc
+	ch <- lastReadingDesc
+}
+
+func (c stateCollector) Collect(ch chan<- prometheus.Metric) {
+	config := c.hub.Config()
+	if config == nil {
+		return
+	}
+
+	now := time.Now()
+	for _, v := range config.Sensors {
+		state, ok := c.hub.State(v.Alias)
+		if !ok {
+			continue
+		}
+
+		// Export the band the sensor is following, which may come from its profile
+		sensor, _ := ApplyProfile(v, config.Profiles, now)
+		high, low := sensor.HighTemp, sensor.LowTemp
+		if sensor.Mode == ModePID {
+			high, low = sensor.SetPoint, sensor.SetPoint
+		}
+
+		// A faulted sensor's last temperature is stale, so leave it out
+		if !state.Fault {
+			ch <- prometheus.MustNewConstMetric(tempDesc, prometheus.GaugeValue, state.Temp, v.Alias)
+		}
+		ch <- prometheus.MustNewConstMetric(heatingDesc, prometheus.GaugeValue, boolGauge(state.Heating), v.Alias)
+		ch <- prometheus.MustNewConstMetric(coolingDesc, prometheus.GaugeValue, boolGauge(state.Cooling), v.Alias)
+		ch <- prometheus.MustNewConstMetric(faultDesc, prometheus.GaugeValue, boolGauge(state.Fault), v.Alias)
+		ch <- prometheus.MustNewConstMetric(highTempDesc, prometheus.GaugeValue, high, v.Alias)
+		ch <- prometheus.MustNewConstMetric(lowTempDesc, prometheus.GaugeValue, low, v.Alias)
+		ch <- prometheus.MustNewConstMetric(lastReadingDesc, prometheus.GaugeValue, now.Sub(state.When).Seconds(), v.Alias)
+	}
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// MetricsHandler responds to GET requests with the states of the sensors, and counters, for Prometheus
+func MetricsHandler(hub *Hub) gin.HandlerFunc {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(stateCollector{hub: hub}, sensorReadErrors, relayCycles, influxWriteErrors)
+
+	return gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MetricsHandler(t *testing.T) {
+	hub := NewHub()
+
+	r := gin.New()
+	r.GET("/metrics", MetricsHandler(hub))
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	// Nothing is exported before there's a configuration
+	assert.False(t, strings.Contains(scrape(), "tempgopher_temperature_celsius"))
+
+	hub.PublishConfig(&Config{Sensors: []Sensor{
+		Sensor{Alias: "foo", HighTemp: 20, LowTemp: 18},
+		Sensor{Alias: "pid", Mode: ModePID, SetPoint: 12},
+		Sensor{Alias: "unread"},
+	}})
+	hub.PublishState(Sensor{}, State{Alias: "foo", Temp: 19.5, Heating: true, When: time.Now().Add(-time.Minute)})
+	hub.PublishState(Sensor{}, State{Alias: "pid", Temp: 12, Cooling: true, Fault: true, When: time.Now()})
+
+	body := scrape()
+	assert.True(t, strings.Contains(body, `tempgopher_temperature_celsius{alias="foo"} 19.5`))
+	assert.True(t, strings.Contains(body, `tempgopher_heating{alias="foo"} 1`))
+	assert.True(t, strings.Contains(body, `tempgopher_cooling{alias="foo"} 0`))
+	assert.True(t, strings.Contains(body, `tempgopher_high_temperature_celsius{alias="foo"} 20`))
+	assert.True(t, strings.Contains(body, `tempgopher_low_temperature_celsius{alias="foo"} 18`))
+	assert.True(t, strings.Contains(body, `tempgopher_last_reading_age_seconds{alias="foo"} 60`))
+
+	// PID sensors export their setpoint as the band
+	assert.True(t, strings.Contains(body, `tempgopher_high_temperature_celsius{alias="pid"} 12`))
+	assert.True(t, strings.Contains(body, `tempgopher_low_temperature_celsius{alias="pid"} 12`))
+	assert.True(t, strings.Contains(body, `tempgopher_fault{alias="pid"} 1`))
+
+	// A faulted sensor's stale temperature isn't exported
+	assert.False(t, strings.Contains(body, `tempgopher_temperature_celsius{alias="pid"}`))
+
+	// Sensors without a state yet are left out
+	assert.False(t, strings.Contains(body, `alias="unread"`))
+
+	// Counters are exported too
+	assert.True(t, strings.Contains(body, "tempgopher_influx_write_errors_total"))
+}
+
+func Test_MetricsCounters(t *testing.T) {
+	defer CloseSwitches()
+
+	sensor := Sensor{ID: "metrics", Alias: "metrics", SwitchType: "fake", GPIOChip: "metrics", HighTemp: 20, LowTemp: 10, CoolGPIO: 1, HeatGPIO: 2}
+
+	// Switching an output on is a cycle, staying on isn't
+	cycles := testutil.ToFloat64(relayCycles.WithLabelValues("metrics", "cool"))
+	state, err := ProcessSensor(sensor, State{}, 25)
+	assert.Equal(t, nil, err)
+	state, err = ProcessSensor(sensor, state, 25)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, cycles+1, testutil.ToFloat64(relayCycles.WithLabelValues("metrics", "cool")))
+
+	// Each failed read is counted
+	readErrors := testutil.ToFloat64(sensorReadErrors.WithLabelValues("metrics"))
+	FailSensor(sensor, state, errors.New("broken"))
+	assert.Equal(t, readErrors+1, testutil.ToFloat64(sensorReadErrors.WithLabelValues("metrics")))
+
+	// And failed writes to Influx
+	writeErrors := testutil.ToFloat64(influxWriteErrors)
+	influx := NewInfluxWriter("metrics", filepath.Join(t.TempDir(), "influx.spool"), Influx{Addr: "http://localhost:1"})
+	defer influx.Close()
+	influx.write = func(config Influx, points []InfluxPoint) error { return errors.New("unreachable") }
+	influx.HandleEvent(Event{Type: EventState, State: state})
+	assert.NotEqual(t, nil, influx.Flush())
+	assert.Equal(t, writeErrors+1, testutil.ToFloat64(influxWriteErrors))
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DefaultMQTTTopic is the prefix of every topic when one isn't configured
+const DefaultMQTTTopic = "tempgopher"
+
+// mqttTimeout is how long to wait for the broker to accept a message
+const mqttTimeout = 10 * time.Second
+
+// Payloads of the availability topic
+const (
+	MQTTOnline  = "online"
+	MQTTOffline = "offline"
+)
+
+// Which outputs of a sensor are enabled, named as Home Assistant names its modes
+const (
+	OutputsOff      = "off"
+	OutputsHeat     = "heat"
+	OutputsCool     = "cool"
+	OutputsHeatCool = "heat_cool"
+)
+
+// MQTT defines an MQTT broker configuration
+type MQTT struct {
+	Broker          string `json:"broker"          yaml:"broker"`
+	ClientID        string `json:"clientid"        yaml:"clientid"`
+	Username        string `json:"username"        yaml:"username"`
+	Password        string `json:"-"               yaml:"password"`
+	Topic           string `json:"topic"           yaml:"topic"`
+	Discovery       bool   `json:"discovery"       yaml:"discovery"`
+	DiscoveryPrefix string `json:"discoveryprefix" yaml:"discoveryprefix"`
+}
+
+// MQTTState is published to the state topic of a sensor. Along with its State, it has the
+// settings the sensor is running with.
+type MQTTState struct {
+	State
+	Outputs  string  `json:"outputs"`
+	HighTemp float64 `json:"hightemp"`
+	LowTemp  float64 `json:"lowtemp"`
+	SetPoint float64 `json:"setpoint"`
+}
+
+// MQTTSet is a change to a sensor received on its set topic. Missing fields are left as they are.
+// Enable turns heating and cooling on or off together, and Outputs chooses which are on.
+type MQTTSet struct {
+	HighTemp *float64 `json:"hightemp"`
+	LowTemp  *float64 `json:"lowtemp"`
+	SetPoint *float64 `json:"setpoint"`
+	Enable   *bool    `json:"enable"`
+	Outputs  *string  `json:"outputs"`
+}
+
+// SensorOutputs returns which outputs of a sensor are enabled
+func SensorOutputs(sensor Sensor) string {
+	switch {
+	case sensor.HeatDisable && sensor.CoolDisable:
+		return OutputsOff
+	case sensor.CoolDisable:
+		return OutputsHeat
+	case sensor.HeatDisable:
+		return OutputsCool
+	default:
+		return OutputsHeatCool
+	}
+}
+
+// setSensorOutputs enables the outputs of a sensor named by outputs, and disables the rest
+func setSensorOutputs(sensor *Sensor, outputs string) error {
+	switch outputs {
+	case OutputsOff, OutputsHeat, OutputsCool, OutputsHeatCool:
+	default:
+		return fmt.Errorf("Unknown outputs: %s", outputs)
+	}
+	sensor.HeatDisable = outputs == OutputsOff || outputs == OutputsCool
+	sensor.CoolDisable = outputs == OutputsOff || outputs == OutputsHeat
+	return nil
+}
+
+func mqttPrefix(config MQTT) string {
+	if config.Topic != "" {
+		return strings.TrimSuffix(config.Topic, "/")
+	}
+	return DefaultMQTTTopic
+}
+
+// MQTTStateTopic returns the topic the states of a sensor are published to
+func MQTTStateTopic(config MQTT, alias string) string {
+	return mqttPrefix(config) + "/" + alias + "/state"
+}
+
+// MQTTSetTopic returns the topic that changes to a sensor are received on
+func MQTTSetTopic(config MQTT, alias string) string {
+	return mqttPrefix(config) + "/" + alias + "/set"
+}
+
+// MQTTAvailabilityTopic returns the topic saying whether TempGopher is online. The broker
+// publishes offline to it if the connection is lost.
+func MQTTAvailabilityTopic(config MQTT) string {
+	return mqttPrefix(config) + "/status"
+}
+
+// ApplyMQTTSet writes a change received over MQTT to the stored configuration of a sensor
+func ApplyMQTTSet(alias string, set MQTTSet) error {
+	return modifyConfig(func(config *Config) error {
+		for i := range config.Sensors {
+			s := &config.Sensors[i]
+			if s.Alias != alias {
+				continue
+			}
+			if set.HighTemp != nil {
+				s.HighTemp = *set.HighTemp
+			}
+			if set.LowTemp != nil {
+				s.LowTemp = *set.LowTemp
+			}
+			if set.SetPoint != nil {
+				s.SetPoint = *set.SetPoint
+			}
+			if set.Enable != nil {
+				s.HeatDisable = !*set.Enable
+				s.CoolDisable = !*set.Enable
+			}
+			if set.Outputs != nil {
+				if err := setSensorOutputs(s, *set.Outputs); err != nil {
+					return err
+				}
+			}
+			if s.HighTemp < s.LowTemp {
+				return errors.New("The high temperature must not be below the low temperature")
+			}
+			return nil
+		}
+
+		return fmt.Errorf("Sensor %s not found", alias)
+	})
+}
+
+// handleMQTTSet returns a handler for messages on the set topics
+func handleMQTTSet(config MQTT) mqtt.MessageHandler {
+	return func(c mqtt.Client, m mqtt.Message) {
+		// A retained change would be made again on every reconnect
+		if m.Retained() {
+			return
+		}
+
+		alias := strings.TrimPrefix(m.Topic(), mqttPrefix(config)+"/")
+		alias = strings.TrimSuffix(alias, "/set")
+
+		var set MQTTSet
+		if err := json.Unmarshal(m.Payload(), &set); err != nil {
+			log.Printf("%s Invalid MQTT set message: %v", alias, err)
+			return
+		}
+		if err := ApplyMQTTSet(alias, set); err != nil {
+			log.Printf("%s Unable to apply MQTT set message: %v", alias, err)
+		}
+	}
+}
+
+// waitMQTT logs any error from a token without holding up the caller
+func waitMQTT(t mqtt.Token, what string) {
+	go func() {
+		if !t.WaitTimeout(mqttTimeout) {
+			log.Println("Timed out waiting to", what)
+		} else if t.Error() != nil {
+			log.Printf("Unable to %s: %v", what, t.Error())
+		}
+	}()
+}
+
+// newMQTTClient creates an MQTT client, and is replaced in tests
+var newMQTTClient = mqtt.NewClient
+
+// MQTTPublisher publishes states to an MQTT broker, and applies changes received from it. With
+// Discovery set, it announces each sensor to Home Assistant. It follows configuration reloads, and
+// nothing is published without a Broker. The zero value is ready to use.
+type MQTTPublisher struct {
+	config MQTT
+	client mqtt.Client
+
+	// The sensors to announce, and the IDs of those announced so far. They are also used when
+	// the client reconnects, so mu must be held.
+	mu         sync.Mutex
+	sensors    []Sensor
+	discovered map[string]bool
+}
+
+// HandleEvent publishes state events, and connects to the broker of config events, so the publisher
+// can subscribe to a Hub
+func (p *MQTTPublisher) HandleEvent(e Event) {
+	switch e.Type {
+	case EventConfig:
+		p.mu.Lock()
+		p.sensors = e.Config.Sensors
+		p.mu.Unlock()
+
+		if p.client == nil || e.Config.MQTT != p.config {
+			p.Close()
+			p.config = e.Config.MQTT
+			if p.config.Broker != "" {
+				p.connect()
+			}
+		} else if p.client.IsConnectionOpen() {
+			p.publishDiscovery(p.client, p.config)
+		}
+	case EventState:
+		// States are retained, so one missed while disconnected is replaced by the next
+		if p.client == nil || !p.client.IsConnectionOpen() {
+			return
+		}
+		data, err := json.Marshal(MQTTState{
+			State:    e.State,
+			Outputs:  SensorOutputs(e.Sensor),
+			HighTemp: e.Sensor.HighTemp,
+			LowTemp:  e.Sensor.LowTemp,
+			SetPoint: e.Sensor.SetPoint,
+		})
+		if err != nil {
+			log.Println("Unable to publish to MQTT:", err)
+			return
+		}
+		t := p.client.Publish(MQTTStateTopic(p.config, e.State.Alias), 1, true, data)
+		if !t.WaitTimeout(mqttTimeout) {
+			log.Println("Timed out publishing to MQTT")
+		} else if t.Error() != nil {
+			log.Println("Unable to publish to MQTT:", t.Error())
+		}
+	}
+}
+
+// connect starts connecting to the broker in the background, retrying until it succeeds
+func (p *MQTTPublisher) connect() {
+	config := p.config
+
+	clientID := config.ClientID
+	if clientID == "" {
+		host, _ := os.Hostname()
+		clientID = "tempgopher-" + host
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(config.Broker)
+	opts.SetClientID(clientID)
+	opts.SetUsername(config.Username)
+	opts.SetPassword(config.Password)
+	opts.SetWill(MQTTAvailabilityTopic(config), MQTTOffline, 1, true)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Println("Connected to MQTT broker", config.Broker)
+		waitMQTT(c.Publish(MQTTAvailabilityTopic(config), 1, true, MQTTOnline), "publish availability")
+		waitMQTT(c.Subscribe(MQTTSetTopic(config, "+"), 1, handleMQTTSet(config)), "subscribe to MQTT")
+		p.publishDiscovery(c, config)
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Println("Lost connection to MQTT broker:", err)
+	})
+
+	p.client = newMQTTClient(opts)
+	p.client.Connect()
+}
+
+// publishDiscovery announces the sensors to Home Assistant, and removes any no longer configured
+func (p *MQTTPublisher) publishDiscovery(c mqtt.Client, config MQTT) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var sensors []Sensor
+	if config.Discovery {
+		sensors = p.sensors
+	}
+
+	messages, err := DiscoveryMessages(config, sensors, p.discovered)
+	if err != nil {
+		log.Println("Unable to publish discovery:", err)
+		return
+	}
+	for topic, m := range messages {
+		waitMQTT(c.Publish(topic, 1, true, m), "publish discovery")
+	}
+
+	p.discovered = make(map[string]bool)
+	for _, s := range sensors {
+		p.discovered[s.ID] = true
+	}
+}
+
+// Close marks TempGopher offline and disconnects from the broker
+func (p *MQTTPublisher) Close() {
+	if p.client == nil {
+		return
+	}
+
+	if p.client.IsConnectionOpen() {
+		p.client.Publish(MQTTAvailabilityTopic(p.config), 1, true, MQTTOffline).WaitTimeout(mqttTimeout)
+	}
+	p.client.Disconnect(250)
+	p.client = nil
+}
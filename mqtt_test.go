@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MQTTTopics(t *testing.T) {
+	assert.Equal(t, "tempgopher/foo/state", MQTTStateTopic(MQTT{}, "foo"))
+	assert.Equal(t, "tempgopher/foo/set", MQTTSetTopic(MQTT{}, "foo"))
+	assert.Equal(t, "tempgopher/status", MQTTAvailabilityTopic(MQTT{}))
+	assert.Equal(t, "brewery/fermenters/foo/state", MQTTStateTopic(MQTT{Topic: "brewery/fermenters/"}, "foo"))
+}
+
+// fakeMQTTToken is a token that is already complete
+type fakeMQTTToken struct {
+	mqtt.Token
+	err error
+}
+
+func (f fakeMQTTToken) Wait() bool                       { return true }
+func (f fakeMQTTToken) WaitTimeout(d time.Duration) bool { return true }
+func (f fakeMQTTToken) Error() error                     { return f.err }
+
+// fakeMQTTMessage is a message received from a broker
+type fakeMQTTMessage struct {
+	mqtt.Message
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (f fakeMQTTMessage) Topic() string   { return f.topic }
+func (f fakeMQTTMessage) Payload() []byte { return f.payload }
+func (f fakeMQTTMessage) Retained() bool  { return f.retained }
+
+// fakeMQTTClient records what is published, and connects straight away
+type fakeMQTTClient struct {
+	mqtt.Client
+	opts         *mqtt.ClientOptions
+	mu           sync.Mutex
+	connected    bool
+	published    map[string]string
+	subscribed   map[string]mqtt.MessageHandler
+	disconnected bool
+}
+
+func (f *fakeMQTTClient) Connect() mqtt.Token {
+	f.mu.Lock()
+	f.connected = true
+	f.mu.Unlock()
+	f.opts.OnConnect(f)
+	return fakeMQTTToken{}
+}
+
+func (f *fakeMQTTClient) IsConnectionOpen() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connected
+}
+
+func (f *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch p := payload.(type) {
+	case string:
+		f.published[topic] = p
+	case []byte:
+		f.published[topic] = string(p)
+	}
+	return fakeMQTTToken{}
+}
+
+func (f *fakeMQTTClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribed[topic] = callback
+	return fakeMQTTToken{}
+}
+
+func (f *fakeMQTTClient) Disconnect(quiesce uint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = false
+	f.disconnected = true
+}
+
+func (f *fakeMQTTClient) get(topic string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.published[topic]
+}
+
+func Test_MQTTPublisher(t *testing.T) {
+	newClient := newMQTTClient
+	defer func() { newMQTTClient = newClient }()
+
+	var clients []*fakeMQTTClient
+	newMQTTClient = func(opts *mqtt.ClientOptions) mqtt.Client {
+		c := &fakeMQTTClient{opts: opts, published: make(map[string]string), subscribed: make(map[string]mqtt.MessageHandler)}
+		clients = append(clients, c)
+		return c
+	}
+
+	// Nothing happens without a broker
+	var p MQTTPublisher
+	p.HandleEvent(Event{Type: EventConfig, Config: &Config{}})
+	p.HandleEvent(Event{Type: EventState, State: State{Alias: "foo"}})
+	assert.Equal(t, 0, len(clients))
+
+	// Connecting sets the will, says we're online and listens for changes
+	config := MQTT{Broker: "tcp://localhost:1883", ClientID: "test", Topic: "brewery"}
+	p.HandleEvent(Event{Type: EventConfig, Config: &Config{MQTT: config}})
+	assert.Equal(t, 1, len(clients))
+	c := clients[0]
+	assert.Equal(t, "test", c.opts.ClientID)
+	assert.Equal(t, "brewery/status", c.opts.WillTopic)
+	assert.Equal(t, MQTTOffline, string(c.opts.WillPayload))
+	assert.True(t, c.opts.WillRetained)
+	assert.Equal(t, MQTTOnline, c.get("brewery/status"))
+	c.mu.Lock()
+	_, ok := c.subscribed["brewery/+/set"]
+	c.mu.Unlock()
+	assert.True(t, ok)
+
+	// States are published as JSON, with the settings of the sensor
+	p.HandleEvent(Event{Type: EventState, State: State{Alias: "foo", Temp: 18.5}, Sensor: Sensor{Alias: "foo", HighTemp: 20, HeatDisable: true}})
+	var s MQTTState
+	assert.Equal(t, nil, json.Unmarshal([]byte(c.get("brewery/foo/state")), &s))
+	assert.Equal(t, 18.5, s.Temp)
+	assert.Equal(t, 20.0, s.HighTemp)
+	assert.Equal(t, OutputsCool, s.Outputs)
+
+	// Sensors are only announced to Home Assistant when asked
+	assert.Equal(t, "", c.get("homeassistant/climate/tempgopher_foo/config"))
+
+	// The same settings keep the connection, but new ones reconnect
+	p.HandleEvent(Event{Type: EventConfig, Config: &Config{MQTT: config}})
+	assert.Equal(t, 1, len(clients))
+	config.Topic = "cellar"
+	p.HandleEvent(Event{Type: EventConfig, Config: &Config{MQTT: config}})
+	assert.Equal(t, 2, len(clients))
+	assert.True(t, c.disconnected)
+	assert.Equal(t, MQTTOffline, c.get("brewery/status"))
+
+	// Announcing sensors, and removing them when they're no longer configured
+	config.Discovery = true
+	sensors := []Sensor{Sensor{ID: "foo", Alias: "foo"}, Sensor{ID: "bar", Alias: "bar"}}
+	p.HandleEvent(Event{Type: EventConfig, Config: &Config{MQTT: config, Sensors: sensors}})
+	assert.Equal(t, 3, len(clients))
+	c = clients[2]
+	var d ClimateDiscovery
+	assert.Equal(t, nil, json.Unmarshal([]byte(c.get("homeassistant/climate/tempgopher_bar/config")), &d))
+	assert.Equal(t, "cellar/bar/set", d.ModeCommandTopic)
+	p.HandleEvent(Event{Type: EventConfig, Config: &Config{MQTT: config, Sensors: sensors[:1]}})
+	assert.Equal(t, 3, len(clients))
+	assert.Equal(t, "", c.get("homeassistant/climate/tempgopher_bar/config"))
+	assert.NotEqual(t, "", c.get("homeassistant/climate/tempgopher_foo/config"))
+
+	// Closing says we're offline
+	p.Close()
+	assert.True(t, c.disconnected)
+	assert.Equal(t, MQTTOffline, c.get("cellar/status"))
+	p.Close()
+}
+
+func Test_ApplyMQTTSet(t *testing.T) {
+	testConfig := Config{
+		Sensors:    []Sensor{Sensor{ID: "foo", Alias: "foo", HighTemp: 20, LowTemp: 18}},
+		Users:      []User{},
+		ListenAddr: ":8080",
+	}
+
+	tmpfile, err := ioutil.TempFile("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.Remove(tmpfile.Name())
+	configFilePath = tmpfile.Name()
+	assert.Equal(t, nil, SaveConfig(tmpfile.Name(), testConfig))
+
+	// Capture the SIGHUPs sent on each change
+	sig := make(chan os.Signal, 10)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	high, low, enable := 10.0, 8.0, false
+	assert.Equal(t, nil, ApplyMQTTSet("foo", MQTTSet{LowTemp: &low}))
+	config, _ := LoadConfig(tmpfile.Name())
+	assert.Equal(t, 20.0, config.Sensors[0].HighTemp)
+	assert.Equal(t, 8.0, config.Sensors[0].LowTemp)
+
+	assert.Equal(t, nil, ApplyMQTTSet("foo", MQTTSet{HighTemp: &high, Enable: &enable}))
+	config, _ = LoadConfig(tmpfile.Name())
+	assert.Equal(t, 10.0, config.Sensors[0].HighTemp)
+	assert.True(t, config.Sensors[0].HeatDisable)
+	assert.True(t, config.Sensors[0].CoolDisable)
+
+	// Home Assistant sets the outputs and setpoint
+	outputs, setpoint := OutputsHeat, 15.0
+	assert.Equal(t, nil, ApplyMQTTSet("foo", MQTTSet{Outputs: &outputs, SetPoint: &setpoint}))
+	config, _ = LoadConfig(tmpfile.Name())
+	assert.False(t, config.Sensors[0].HeatDisable)
+	assert.True(t, config.Sensors[0].CoolDisable)
+	assert.Equal(t, 15.0, config.Sensors[0].SetPoint)
+	outputs = "auto"
+	assert.NotEqual(t, nil, ApplyMQTTSet("foo", MQTTSet{Outputs: &outputs}))
+
+	// The band can't be upside down, and the sensor must exist
+	low = 12
+	assert.NotEqual(t, nil, ApplyMQTTSet("foo", MQTTSet{LowTemp: &low}))
+	assert.NotEqual(t, nil, ApplyMQTTSet("DNE", MQTTSet{}))
+
+	// Messages are applied, unless they're retained or can't be read
+	handler := handleMQTTSet(MQTT{})
+	handler(nil, fakeMQTTMessage{topic: "tempgopher/foo/set", payload: []byte(`{"enable": true}`)})
+	config, _ = LoadConfig(tmpfile.Name())
+	assert.False(t, config.Sensors[0].HeatDisable)
+	handler(nil, fakeMQTTMessage{topic: "tempgopher/foo/set", payload: []byte(`{"enable": false}`), retained: true})
+	handler(nil, fakeMQTTMessage{topic: "tempgopher/foo/set", payload: []byte(`foo`)})
+	config, _ = LoadConfig(tmpfile.Name())
+	assert.False(t, config.Sensors[0].HeatDisable)
+
+	// Validate SIGHUP
+	assert.Equal(t, syscall.SIGHUP, <-sig)
+}
+
+func Test_MQTTBroker(t *testing.T) {
+	broker := os.Getenv("MQTT_BROKER")
+	if broker == "" {
+		t.Skip("MQTT_BROKER is not set")
+	}
+
+	config := MQTT{Broker: broker, ClientID: "tempgopher-test", Topic: "tempgopher-test"}
+	var p MQTTPublisher
+	p.HandleEvent(Event{Type: EventConfig, Config: &Config{MQTT: config}})
+	defer p.Close()
+
+	// Listen for our own states
+	opts := mqtt.NewClientOptions().AddBroker(broker).SetClientID("tempgopher-test-listener")
+	listener := mqtt.NewClient(opts)
+	assert.True(t, listener.Connect().WaitTimeout(mqttTimeout))
+	defer listener.Disconnect(250)
+	received := make(chan []byte, 10)
+	listener.Subscribe(MQTTStateTopic(config, "foo"), 1, func(c mqtt.Client, m mqtt.Message) {
+		received <- m.Payload()
+	}).WaitTimeout(mqttTimeout)
+
+	deadline := time.Now().Add(mqttTimeout)
+	for !p.client.IsConnectionOpen() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	p.HandleEvent(Event{Type: EventState, State: State{Alias: "foo", Temp: 12}})
+
+	select {
+	case payload := <-received:
+		var s State
+		assert.Equal(t, nil, json.Unmarshal(payload, &s))
+		assert.Equal(t, 12.0, s.Temp)
+	case <-time.After(mqttTimeout):
+		t.Fatal("Timed out waiting for the state")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Control modes for a sensor
+const (
+	ModeHysteresis = "hysteresis"
+	ModePID        = "pid"
+)
+
+// pidMaxGap is the longest time between readings that the controller will integrate over
+const pidMaxGap = 5 * time.Minute
+
+// DefaultWindowMinutes is the time proportioning window used when a sensor does not specify one.
+const DefaultWindowMinutes = 10.0
+
+// PIDState tracks a PID controller between readings. Output is a percentage, positive
+// for heating and negative for cooling. Duty is the output latched for the current window.
+type PIDState struct {
+	Integral    float64   `json:"integral"`
+	LastTemp    float64   `json:"lasttemp"`
+	LastTime    time.Time `json:"lasttime"`
+	Output      float64   `json:"output"`
+	Duty        float64   `json:"duty"`
+	WindowStart time.Time `json:"windowstart"`
+}
+
+// UpdatePID advances a PID controller with a new reading. Gains are applied to the error
+// in degrees celsius, with the integral and derivative taken over seconds.
+func UpdatePID(sensor Sensor, pid PIDState, temp float64, now time.Time) PIDState {
+	// Limit the output to the outputs that are enabled
+	max, min := 100.0, -100.0
+	if sensor.HeatDisable {
+		max = 0
+	}
+	if sensor.CoolDisable {
+		min = 0
+	}
+
+	err := sensor.SetPoint - temp
+
+	// Readings far apart, like either side of a restart, don't count towards the integral or derivative
+	var dt, derivative float64
+	if !pid.LastTime.IsZero() && now.Sub(pid.LastTime) <= pidMaxGap {
+		dt = now.Sub(pid.LastTime).Seconds()
+	}
+	if dt > 0 {
+		// Derivative on measurement, so changing the setpoint doesn't kick the output
+		derivative = -(temp - pid.LastTemp) / dt
+	}
+
+	integral := pid.Integral + err*dt
+	output := sensor.Kp*err + sensor.Ki*integral + sensor.Kd*derivative
+
+	// Only keep integrating while the output isn't saturated
+	if output > max || output < min {
+		output = math.Max(min, math.Min(max, output))
+	} else {
+		pid.Integral = integral
+	}
+
+	pid.Output = output
+	pid.LastTemp = temp
+	pid.LastTime = now
+	return pid
+}
+
+// TimeProportion converts a PID output into on/off switch states using a slow PWM window.
+// The duty is latched at the start of each window, and the output is on for that share of the window.
+func TimeProportion(sensor Sensor, pid PIDState, now time.Time) (PIDState, bool, bool) {
+	window := sensor.WindowMinutes
+	if window <= 0 {
+		window = DefaultWindowMinutes
+	}
+	length := time.Duration(window * float64(time.Minute))
+
+	if pid.WindowStart.IsZero() || now.Sub(pid.WindowStart) >= length || now.Before(pid.WindowStart) {
+		pid.WindowStart = now
+		pid.Duty = pid.Output
+	}
+
+	on := now.Sub(pid.WindowStart) < time.Duration(math.Abs(pid.Duty)/100*float64(length))
+	heating := on && pid.Duty > 0 && !sensor.HeatDisable
+	cooling := on && pid.Duty < 0 && !sensor.CoolDisable
+
+	return pid, heating, cooling
+}
+
+// processPID runs the PID controller for a sensor, and decides which outputs should be on.
+func processPID(sensor Sensor, state State, temp float64) State {
+	now := time.Now()
+	state.PID = UpdatePID(sensor, state.PID, temp, now)
+
+	var heating, cooling bool
+	state.PID, heating, cooling = TimeProportion(sensor, state.PID, now)
+	if heating != state.Heating || cooling != state.Cooling {
+		state.Changed = now
+	}
+	state.Heating = heating
+	state.Cooling = cooling
+
+	return state
+}
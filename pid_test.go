@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_UpdatePID(t *testing.T) {
+	now := time.Now()
+	sensor := Sensor{SetPoint: 20, Kp: 10, Ki: 0.1, Kd: 60}
+
+	// First reading only has a proportional term
+	pid := UpdatePID(sensor, PIDState{}, 18, now)
+	assert.InDelta(t, 20, pid.Output, 0.001)
+	assert.Equal(t, 0.0, pid.Integral)
+
+	// Integral accumulates error over seconds, derivative opposes the rise in temperature
+	pid = UpdatePID(sensor, pid, 19, now.Add(60*time.Second))
+	assert.InDelta(t, 60, pid.Integral, 0.001)
+	assert.InDelta(t, 10+6-1, pid.Output, 0.001)
+
+	// Output is limited, and the integral stops growing while saturated
+	pid = UpdatePID(sensor, pid, 0, now.Add(120*time.Second))
+	assert.Equal(t, 100.0, pid.Output)
+	assert.InDelta(t, 60, pid.Integral, 0.001)
+
+	// Disabled outputs limit the output to zero
+	sensor.CoolDisable = true
+	pid = UpdatePID(sensor, PIDState{}, 30, now)
+	assert.Equal(t, 0.0, pid.Output)
+	sensor.CoolDisable = false
+	sensor.HeatDisable = true
+	pid = UpdatePID(sensor, PIDState{}, 10, now)
+	assert.Equal(t, 0.0, pid.Output)
+}
+
+func Test_TimeProportion(t *testing.T) {
+	now := time.Now()
+	sensor := Sensor{WindowMinutes: 10}
+
+	// 30% heating is on for the first three minutes of the window
+	pid, heating, cooling := TimeProportion(sensor, PIDState{Output: 30}, now)
+	assert.Equal(t, 30.0, pid.Duty)
+	assert.True(t, heating)
+	assert.False(t, cooling)
+
+	// Changes to the output wait for the next window
+	pid.Output = -50
+	pid, heating, cooling = TimeProportion(sensor, pid, now.Add(2*time.Minute))
+	assert.True(t, heating)
+	pid, heating, cooling = TimeProportion(sensor, pid, now.Add(4*time.Minute))
+	assert.False(t, heating)
+	assert.False(t, cooling)
+
+	// A new window starts cooling
+	pid, heating, cooling = TimeProportion(sensor, pid, now.Add(10*time.Minute))
+	assert.Equal(t, -50.0, pid.Duty)
+	assert.False(t, heating)
+	assert.True(t, cooling)
+
+	// Nothing is on with no output
+	_, heating, cooling = TimeProportion(sensor, PIDState{}, now)
+	assert.False(t, heating)
+	assert.False(t, cooling)
+}
+
+func Test_ProcessSensorPID(t *testing.T) {
+	defer CloseSwitches()
+
+	sensor := Sensor{
+		ID:         "pid",
+		Alias:      "pid",
+		SwitchType: "fake",
+		Mode:       ModePID,
+		SetPoint:   20,
+		Kp:         25,
+		HeatGPIO:   1,
+		CoolGPIO:   2,
+	}
+
+	state, err := ProcessSensor(sensor, State{}, 18)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 50.0, state.PID.Output)
+	assert.True(t, state.Heating)
+	assert.False(t, state.Cooling)
+
+	heat, _ := HeatSwitch(sensor)
+	on, _ := heat.State()
+	assert.True(t, on)
+}
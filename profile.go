@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Segment is one part of a temperature profile. A step holds Temp for Hours, while a ramp moves
+// steadily from the previous temperature to Temp over Hours. The last segment of a profile
+// holds its temperature indefinitely.
+type Segment struct {
+	Ramp  bool    `json:"ramp"  yaml:"ramp"`
+	Temp  float64 `json:"temp"  yaml:"temp"`
+	Hours float64 `json:"hours" yaml:"hours"`
+}
+
+// Profile is a named schedule of temperatures that a sensor can follow
+type Profile struct {
+	Name     string    `json:"name"     yaml:"name"`
+	Segments []Segment `json:"segments" yaml:"segments"`
+}
+
+// ProfileProgress reports where a sensor is in its profile
+type ProfileProgress struct {
+	Name    string    `json:"name"`
+	Started time.Time `json:"started"`
+	Segment int       `json:"segment"`
+	Target  float64   `json:"target"`
+	Done    bool      `json:"done"`
+}
+
+// Target returns the temperature the profile calls for after running for elapsed, along with the
+// index of the current segment and whether the profile has finished. from is the temperature a
+// ramp in the first segment starts at.
+func (p Profile) Target(elapsed time.Duration, from float64) (float64, int, bool) {
+	hours := elapsed.Hours()
+	for i, seg := range p.Segments {
+		last := i == len(p.Segments)-1
+		if hours < seg.Hours || last {
+			temp := seg.Temp
+			if seg.Ramp && seg.Hours > 0 && hours < seg.Hours {
+				temp = from + (seg.Temp-from)*hours/seg.Hours
+			}
+			return temp, i, last && hours >= seg.Hours
+		}
+		hours -= seg.Hours
+		from = seg.Temp
+	}
+
+	return from, 0, true
+}
+
+// FindProfile returns the profile with the given name
+func FindProfile(profiles []Profile, name string) (Profile, bool) {
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// ApplyProfile returns a copy of a sensor with its temperatures set by its profile. In PID mode the
+// setpoint follows the profile, otherwise the band between LowTemp and HighTemp is centered on it.
+// Sensors without a running profile are returned unchanged, with nil progress.
+func ApplyProfile(sensor Sensor, profiles []Profile, now time.Time) (Sensor, *ProfileProgress) {
+	if sensor.Profile == "" || sensor.ProfileStart == nil {
+		return sensor, nil
+	}
+
+	profile, ok := FindProfile(profiles, sensor.Profile)
+	if !ok || len(profile.Segments) == 0 {
+		log.Printf("%s Profile %s not found", sensor.Alias, sensor.Profile)
+		return sensor, nil
+	}
+
+	half := (sensor.HighTemp - sensor.LowTemp) / 2
+	from := sensor.LowTemp + half
+	if sensor.Mode == ModePID {
+		from = sensor.SetPoint
+	}
+
+	target, segment, done := profile.Target(now.Sub(*sensor.ProfileStart), from)
+	if sensor.Mode == ModePID {
+		sensor.SetPoint = target
+	} else {
+		sensor.LowTemp = target - half
+		sensor.HighTemp = target + half
+	}
+
+	return sensor, &ProfileProgress{
+		Name:    profile.Name,
+		Started: *sensor.ProfileStart,
+		Segment: segment,
+		Target:  target,
+		Done:    done,
+	}
+}
+
+// UpdateProfileConfig adds a profile to the configuration, or replaces the one with the same name, and writes to disk
+func UpdateProfileConfig(p Profile) error {
+	if p.Name == "" {
+		return errors.New("Profile name cannot be blank")
+	}
+	if len(p.Segments) == 0 {
+		return errors.New("Profile needs at least one segment")
+	}
+
+	return modifyConfig(func(config *Config) error {
+		found := false
+		for i := range config.Profiles {
+			if config.Profiles[i].Name == p.Name {
+				config.Profiles[i] = p
+				found = true
+			}
+		}
+		if !found {
+			config.Profiles = append(config.Profiles, p)
+		}
+		return nil
+	})
+}
+
+// DeleteProfileConfig removes a profile from the configuration, and stops it on any sensor following it
+func DeleteProfileConfig(name string) error {
+	return modifyConfig(func(config *Config) error {
+		if _, ok := FindProfile(config.Profiles, name); !ok {
+			return fmt.Errorf("Profile %s not found", name)
+		}
+
+		var profiles []Profile
+		for _, p := range config.Profiles {
+			if p.Name != name {
+				profiles = append(profiles, p)
+			}
+		}
+		config.Profiles = profiles
+
+		for i := range config.Sensors {
+			if config.Sensors[i].Profile == name {
+				config.Sensors[i].Profile = ""
+				config.Sensors[i].ProfileStart = nil
+			}
+		}
+		return nil
+	})
+}
+
+// StartProfile sets a sensor to follow a profile from the given time. The start time is stored in
+// the configuration, so progress survives restarts.
+func StartProfile(name string, alias string, start time.Time) error {
+	return modifyConfig(func(config *Config) error {
+		if _, ok := FindProfile(config.Profiles, name); !ok {
+			return fmt.Errorf("Profile %s not found", name)
+		}
+
+		for i := range config.Sensors {
+			if config.Sensors[i].Alias == alias {
+				config.Sensors[i].Profile = name
+				config.Sensors[i].ProfileStart = &start
+				return nil
+			}
+		}
+
+		return fmt.Errorf("Sensor %s not found", alias)
+	})
+}
+
+// Errors returned by StopProfile
+var (
+	ErrSensorNotFound    = errors.New("Sensor not found")
+	ErrProfileNotRunning = errors.New("Sensor is not running that profile")
+)
+
+// StopProfile stops a sensor following the named profile. The sensor goes back to its own
+// temperatures. It returns ErrSensorNotFound if there is no such sensor, and ErrProfileNotRunning
+// if it isn't following that profile.
+func StopProfile(name string, alias string) error {
+	return modifyConfig(func(config *Config) error {
+		for i := range config.Sensors {
+			if config.Sensors[i].Alias == alias {
+				if config.Sensors[i].Profile != name {
+					return ErrProfileNotRunning
+				}
+				config.Sensors[i].Profile = ""
+				config.Sensors[i].ProfileStart = nil
+				return nil
+			}
+		}
+
+		return ErrSensorNotFound
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testProfile = Profile{
+	Name: "ale",
+	Segments: []Segment{
+		Segment{Temp: 18, Hours: 120},
+		Segment{Ramp: true, Temp: 21, Hours: 144},
+		Segment{Temp: 2},
+	},
+}
+
+func Test_ProfileTarget(t *testing.T) {
+	hour := time.Hour
+
+	temp, segment, done := testProfile.Target(0, 10)
+	assert.Equal(t, 18.0, temp)
+	assert.Equal(t, 0, segment)
+	assert.False(t, done)
+
+	// Halfway through the ramp
+	temp, segment, done = testProfile.Target(192*hour, 10)
+	assert.InDelta(t, 19.5, temp, 0.0001)
+	assert.Equal(t, 1, segment)
+	assert.False(t, done)
+
+	// The last segment holds forever
+	temp, segment, done = testProfile.Target(1000*hour, 10)
+	assert.Equal(t, 2.0, temp)
+	assert.Equal(t, 2, segment)
+	assert.True(t, done)
+
+	// A ramp in the first segment starts from the supplied temperature
+	p := Profile{Segments: []Segment{Segment{Ramp: true, Temp: 20, Hours: 10}}}
+	temp, _, done = p.Target(5*hour, 10)
+	assert.Equal(t, 15.0, temp)
+	assert.False(t, done)
+	temp, _, done = p.Target(10*hour, 10)
+	assert.Equal(t, 20.0, temp)
+	assert.True(t, done)
+}
+
+func Test_ApplyProfile(t *testing.T) {
+	now := time.Now()
+	start := now.Add(-192 * time.Hour)
+	profiles := []Profile{testProfile}
+
+	// No profile leaves the sensor alone
+	sensor := Sensor{HighTemp: 20, LowTemp: 18}
+	applied, progress := ApplyProfile(sensor, profiles, now)
+	assert.Equal(t, sensor, applied)
+	assert.Nil(t, progress)
+
+	// The band is centered on the target
+	sensor.Profile = "ale"
+	sensor.ProfileStart = &start
+	applied, progress = ApplyProfile(sensor, profiles, now)
+	assert.InDelta(t, 20.5, applied.HighTemp, 0.0001)
+	assert.InDelta(t, 18.5, applied.LowTemp, 0.0001)
+	assert.Equal(t, "ale", progress.Name)
+	assert.Equal(t, 1, progress.Segment)
+	assert.InDelta(t, 19.5, progress.Target, 0.0001)
+
+	// The setpoint follows the profile in PID mode
+	sensor.Mode = ModePID
+	applied, _ = ApplyProfile(sensor, profiles, now)
+	assert.InDelta(t, 19.5, applied.SetPoint, 0.0001)
+	assert.Equal(t, 20.0, applied.HighTemp)
+
+	// Unknown profiles are ignored
+	sensor.Profile = "DNE"
+	applied, progress = ApplyProfile(sensor, profiles, now)
+	assert.Equal(t, sensor, applied)
+	assert.Nil(t, progress)
+}
+
+func Test_ProfileConfig(t *testing.T) {
+	testConfig := Config{
+		Sensors:    []Sensor{Sensor{ID: "foo", Alias: "foo"}},
+		Users:      []User{},
+		ListenAddr: ":8080",
+	}
+
+	tmpfile, err := ioutil.TempFile("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.Remove(tmpfile.Name())
+	configFilePath = tmpfile.Name()
+	err = SaveConfig(tmpfile.Name(), testConfig)
+	assert.Equal(t, nil, err)
+
+	// Capture the SIGHUPs sent on each change
+	sig := make(chan os.Signal, 10)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	// Bad profiles
+	assert.NotEqual(t, nil, UpdateProfileConfig(Profile{Segments: testProfile.Segments}))
+	assert.NotEqual(t, nil, UpdateProfileConfig(Profile{Name: "empty"}))
+
+	// Add, then replace
+	assert.Equal(t, nil, UpdateProfileConfig(Profile{Name: "ale", Segments: []Segment{Segment{Temp: 1}}}))
+	assert.Equal(t, nil, UpdateProfileConfig(testProfile))
+	config, err := LoadConfig(tmpfile.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []Profile{testProfile}, config.Profiles)
+
+	// Start and stop
+	start := time.Date(2018, 11, 1, 12, 0, 0, 0, time.UTC)
+	assert.NotEqual(t, nil, StartProfile("DNE", "foo", start))
+	assert.NotEqual(t, nil, StartProfile("ale", "DNE", start))
+	assert.Equal(t, nil, StartProfile("ale", "foo", start))
+	config, _ = LoadConfig(tmpfile.Name())
+	assert.Equal(t, "ale", config.Sensors[0].Profile)
+	assert.True(t, start.Equal(*config.Sensors[0].ProfileStart))
+
+	assert.Equal(t, ErrSensorNotFound, StopProfile("ale", "DNE"))
+	assert.Equal(t, ErrProfileNotRunning, StopProfile("lager", "foo"))
+	assert.Equal(t, nil, StopProfile("ale", "foo"))
+	config, _ = LoadConfig(tmpfile.Name())
+	assert.Equal(t, "", config.Sensors[0].Profile)
+	assert.Nil(t, config.Sensors[0].ProfileStart)
+
+	// Deleting stops the profile on its sensors
+	assert.Equal(t, nil, StartProfile("ale", "foo", start))
+	assert.NotEqual(t, nil, DeleteProfileConfig("DNE"))
+	assert.Equal(t, nil, DeleteProfileConfig("ale"))
+	config, _ = LoadConfig(tmpfile.Name())
+	assert.Empty(t, config.Profiles)
+	assert.Equal(t, "", config.Sensors[0].Profile)
+
+	// Validate SIGHUP
+	ret := <-sig
+	assert.Equal(t, syscall.SIGHUP, ret)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+)
+
+// ProtectOutputs enforces the minimum on and off times of a sensor's outputs, so compressors
+// aren't short cycled. prev is the state before the control logic ran, and next is what it
+// decided. Changes that come too soon are held back, and the time remaining is recorded in
+// CoolLockout and HeatLockout. Heating and cooling never run together, so while one is held on,
+// the other waits for it. While a change is held back, Changed keeps its previous value, so the
+// controller's timers still run from when the band was crossed.
+func ProtectOutputs(sensor Sensor, prev State, next State, now time.Time) State {
+	want := next
+	next.Cooling, next.CoolChanged, next.CoolLockout = protectOutput(
+		next.Cooling, prev.Cooling, prev.CoolChanged, sensor.CoolOnMinutes, sensor.CoolOffMinutes, now)
+	next.Heating, next.HeatChanged, next.HeatLockout = protectOutput(
+		next.Heating, prev.Heating, prev.HeatChanged, sensor.HeatOnMinutes, sensor.HeatOffMinutes, now)
+
+	if next.Cooling && next.Heating {
+		if prev.Heating && !prev.Cooling {
+			next.Cooling, next.CoolChanged, next.CoolLockout = false, prev.CoolChanged, next.HeatLockout
+		} else {
+			next.Heating, next.HeatChanged, next.HeatLockout = false, prev.HeatChanged, next.CoolLockout
+		}
+	}
+
+	if next.Cooling != want.Cooling || next.Heating != want.Heating {
+		next.Changed = prev.Changed
+	}
+
+	return next
+}
+
+// protectOutput decides whether a single output may change from on to want. It returns the
+// resulting output, when it last changed, and how many seconds a change is being held back for.
+func protectOutput(want, on bool, changed time.Time, minOn, minOff float64, now time.Time) (bool, time.Time, float64) {
+	if want == on {
+		return on, changed, 0
+	}
+
+	// Turning on is limited by the minimum off time, and turning off by the minimum on time
+	limit := minOn
+	if want {
+		limit = minOff
+	}
+
+	remaining := time.Duration(limit*float64(time.Minute)) - now.Sub(changed)
+	if changed.IsZero() || remaining <= 0 {
+		return want, now, 0
+	}
+
+	return on, changed, remaining.Seconds()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ProtectOutputs(t *testing.T) {
+	now := time.Now()
+	sensor := Sensor{CoolOnMinutes: 5, CoolOffMinutes: 10, HeatOffMinutes: 1}
+
+	// Cooling turned off 4 minutes ago can't turn back on yet
+	prev := State{CoolChanged: now.Add(-4 * time.Minute)}
+	next := ProtectOutputs(sensor, prev, State{Cooling: true}, now)
+	assert.False(t, next.Cooling)
+	assert.InDelta(t, 360, next.CoolLockout, 0.001)
+	assert.Equal(t, prev.CoolChanged, next.CoolChanged)
+
+	// After 10 minutes, it can
+	prev = State{CoolChanged: now.Add(-10 * time.Minute)}
+	next = ProtectOutputs(sensor, prev, State{Cooling: true}, now)
+	assert.True(t, next.Cooling)
+	assert.Equal(t, 0.0, next.CoolLockout)
+	assert.Equal(t, now, next.CoolChanged)
+
+	// Cooling turned on a minute ago must stay on
+	prev = State{Cooling: true, CoolChanged: now.Add(-1 * time.Minute)}
+	next = ProtectOutputs(sensor, prev, State{Cooling: false}, now)
+	assert.True(t, next.Cooling)
+	assert.InDelta(t, 240, next.CoolLockout, 0.001)
+
+	// Outputs that aren't changing have no lockout
+	next = ProtectOutputs(sensor, prev, State{Cooling: true}, now)
+	assert.True(t, next.Cooling)
+	assert.Equal(t, 0.0, next.CoolLockout)
+
+	// Heating waits while cooling is held on, since they never run together
+	prev = State{Cooling: true, CoolChanged: now, HeatChanged: now.Add(-2 * time.Minute)}
+	next = ProtectOutputs(sensor, prev, State{Heating: true}, now)
+	assert.False(t, next.Heating)
+	assert.True(t, next.Cooling)
+	assert.InDelta(t, 300, next.HeatLockout, 0.001)
+	assert.Equal(t, prev.HeatChanged, next.HeatChanged)
+	next = ProtectOutputs(sensor, prev, State{Heating: true}, now.Add(5*time.Minute))
+	assert.True(t, next.Heating)
+	assert.False(t, next.Cooling)
+
+	// And cooling waits while heating is held on
+	heatOn := Sensor{HeatOnMinutes: 5}
+	prev = State{Heating: true, HeatChanged: now}
+	next = ProtectOutputs(heatOn, prev, State{Cooling: true}, now)
+	assert.True(t, next.Heating)
+	assert.False(t, next.Cooling)
+	assert.InDelta(t, 300, next.CoolLockout, 0.001)
+
+	// A zero limit never holds anything back
+	sensor.CoolOnMinutes = 0
+	next = ProtectOutputs(sensor, State{Cooling: true, CoolChanged: now}, State{}, now)
+	assert.False(t, next.Cooling)
+
+	// Outputs that have never changed are free to change
+	next = ProtectOutputs(sensor, State{}, State{Cooling: true}, now)
+	assert.True(t, next.Cooling)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is how often sensors are read when neither the sensor nor the config sets an interval
+const DefaultInterval = 5 * time.Second
+
+// DefaultReadTimeout is how long a read may take when the config doesn't set readtimeout
+const DefaultReadTimeout = 10 * time.Second
+
+// intervalJitter is the largest fraction of an interval that reads are moved by, so sensors
+// sharing an interval don't all hit the bus at the same moment.
+const intervalJitter = 0.1
+
+// scheduleTick is how often the thermostat checks for sensors that are due to be read
+var scheduleTick = 250 * time.Millisecond
+
+// SensorInterval returns how often a sensor should be read
+func SensorInterval(sensor Sensor, config *Config) time.Duration {
+	if sensor.Interval > 0 {
+		return time.Duration(sensor.Interval * float64(time.Second))
+	}
+	if config.Interval > 0 {
+		return time.Duration(config.Interval * float64(time.Second))
+	}
+	return DefaultInterval
+}
+
+// ReadTimeout returns how long a read may take before it is treated as failed
+func ReadTimeout(config *Config) time.Duration {
+	if config.ReadTimeout > 0 {
+		return time.Duration(config.ReadTimeout * float64(time.Second))
+	}
+	return DefaultReadTimeout
+}
+
+// nextRead returns when a sensor should next be read, an interval from now give or take the jitter
+func nextRead(now time.Time, interval time.Duration) time.Time {
+	jitter := (rand.Float64()*2 - 1) * intervalJitter * float64(interval)
+	return now.Add(interval + time.Duration(jitter))
+}
+
+// Reading is the result of reading a sensor
+type Reading struct {
+	Temp float64
+	Err  error
+}
+
+// errReadTimeout is returned for reads that take longer than the timeout
+var errReadTimeout = errors.New("Timed out reading sensor")
+
+// errReadBusy is returned for sensors still busy with a read that timed out earlier
+var errReadBusy = errors.New("Sensor is still busy with an earlier read")
+
+// busySensors are the IDs of sensors with a read still running
+var (
+	busySensors   = make(map[string]bool)
+	busySensorsMu sync.Mutex
+)
+
+// ReadSensors reads every sensor at once, waiting up to timeout for them. Readings are keyed
+// by sensor ID. A read that times out is left to finish in the background, and until it does
+// the sensor fails with errReadBusy rather than piling up more reads.
+func ReadSensors(sensors []Sensor, timeout time.Duration) map[string]Reading {
+	type result struct {
+		id      string
+		reading Reading
+	}
+	results := make(chan result, len(sensors))
+
+	readings := make(map[string]Reading)
+	pending := 0
+	for _, sensor := range sensors {
+		busySensorsMu.Lock()
+		busy := busySensors[sensor.ID]
+		busySensors[sensor.ID] = true
+		busySensorsMu.Unlock()
+
+		if busy {
+			readings[sensor.ID] = Reading{Err: errReadBusy}
+			continue
+		}
+
+		pending++
+		go func(sensor Sensor) {
+			temp, err := ReadSensor(sensor)
+
+			busySensorsMu.Lock()
+			delete(busySensors, sensor.ID)
+			busySensorsMu.Unlock()
+
+			results <- result{id: sensor.ID, reading: Reading{Temp: temp, Err: err}}
+		}(sensor)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for ; pending > 0; pending-- {
+		select {
+		case r := <-results:
+			readings[r.id] = r.reading
+		case <-timer.C:
+			// Anything not back yet has timed out
+			for _, sensor := range sensors {
+				if _, ok := readings[sensor.ID]; !ok {
+					readings[sensor.ID] = Reading{Err: errReadTimeout}
+				}
+			}
+			return readings
+		}
+	}
+
+	return readings
+}
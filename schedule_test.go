@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingSource waits for its channel before returning a temperature
+type blockingSource chan float64
+
+func (b blockingSource) Temperature() (float64, error) {
+	return <-b, nil
+}
+
+func Test_SensorInterval(t *testing.T) {
+	assert.Equal(t, DefaultInterval, SensorInterval(Sensor{}, &Config{}))
+	assert.Equal(t, 30*time.Second, SensorInterval(Sensor{}, &Config{Interval: 30}))
+	assert.Equal(t, 1500*time.Millisecond, SensorInterval(Sensor{Interval: 1.5}, &Config{Interval: 30}))
+
+	assert.Equal(t, DefaultReadTimeout, ReadTimeout(&Config{}))
+	assert.Equal(t, 2*time.Second, ReadTimeout(&Config{ReadTimeout: 2}))
+}
+
+func Test_nextRead(t *testing.T) {
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		next := nextRead(now, 10*time.Second)
+		assert.False(t, next.Before(now.Add(9*time.Second)))
+		assert.False(t, next.After(now.Add(11*time.Second)))
+	}
+}
+
+func Test_readGroups(t *testing.T) {
+	beer := Sensor{ID: "beer", AirID: "air"}
+	wort := Sensor{ID: "wort", AirID: "air"}
+	air := Sensor{ID: "air"}
+	other := Sensor{ID: "other"}
+
+	// Sensors sharing an air probe, or that are one, are read together
+	groups := readGroups([]Sensor{beer, other, wort, air})
+	assert.Equal(t, [][]Sensor{[]Sensor{beer, wort, air}, []Sensor{other}}, groups)
+
+	// Reading each probe once
+	reads := sensorsToRead(groups[0])
+	assert.Equal(t, 3, len(reads))
+	reads = sensorsToRead([]Sensor{beer, wort})
+	assert.Equal(t, 3, len(reads))
+	assert.Equal(t, "air", reads[2].ID)
+}
+
+func Test_ReadSensors(t *testing.T) {
+	slow := make(blockingSource)
+	RegisterSource("schedulefixed", func(sensor Sensor) (TemperatureSource, error) {
+		return fixedSource(12), nil
+	})
+	RegisterSource("scheduleslow", func(sensor Sensor) (TemperatureSource, error) {
+		return slow, nil
+	})
+	RegisterSource("schedulebroken", func(sensor Sensor) (TemperatureSource, error) {
+		return nil, errors.New("broken")
+	})
+
+	fixed := Sensor{ID: "fixed", Type: "schedulefixed"}
+	blocked := Sensor{ID: "slow", Type: "scheduleslow"}
+	broken := Sensor{ID: "broken", Type: "schedulebroken"}
+
+	// Sensors are read at once, and slow ones time out without holding up the rest
+	start := time.Now()
+	readings := ReadSensors([]Sensor{blocked, fixed, broken}, 50*time.Millisecond)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 3, len(readings))
+	assert.Equal(t, nil, readings["fixed"].Err)
+	assert.Equal(t, 12.0, readings["fixed"].Temp)
+	assert.Equal(t, errReadTimeout, readings["slow"].Err)
+	assert.NotEqual(t, nil, readings["broken"].Err)
+
+	// A sensor with a read still running isn't read again
+	readings = ReadSensors([]Sensor{blocked}, 50*time.Millisecond)
+	assert.Equal(t, errReadBusy, readings["slow"].Err)
+
+	// Once it finishes, it can be read again
+	slow <- 10
+	for i := 0; i < 100; i++ {
+		busySensorsMu.Lock()
+		busy := busySensors["slow"]
+		busySensorsMu.Unlock()
+		if !busy {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	go func() { slow <- 11 }()
+	readings = ReadSensors([]Sensor{blocked}, time.Second)
+	assert.Equal(t, nil, readings["slow"].Err)
+	assert.Equal(t, 11.0, readings["slow"].Temp)
+}
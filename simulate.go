@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Vessel defines the physical properties of a simulated vessel. Ambient and Start are pointers, so
+// that 0°C can be told apart from unset.
+type Vessel struct {
+	Ambient     *float64 `json:"ambient,omitempty" yaml:"ambient,omitempty"`
+	Start       *float64 `json:"start,omitempty"   yaml:"start,omitempty"`
+	ThermalMass float64  `json:"thermalmass"       yaml:"thermalmass"`
+	Loss        float64  `json:"loss"              yaml:"loss"`
+	HeatWatts   float64  `json:"heatwatts"         yaml:"heatwatts"`
+	CoolWatts   float64  `json:"coolwatts"         yaml:"coolwatts"`
+}
+
+// Defaults for a simulated vessel: 20 liters of water in a room, with a small heater and chiller.
+const (
+	defaultAmbient     = 20.0
+	defaultThermalMass = 83720.0 // J/°C, 20 kg of water
+	defaultLoss        = 5.0     // W/°C exchanged with the ambient air
+	defaultHeatWatts   = 100.0
+	defaultCoolWatts   = 100.0
+)
+
+// simulatedReadDelay mimics the time a DS18B20 takes to convert a reading.
+var simulatedReadDelay = 750 * time.Millisecond
+
+// simulateAll is set when tempgopher is started with the simulate action.
+var simulateAll bool
+
+var (
+	vesselsMu sync.Mutex
+	vessels   = make(map[string]*vessel)
+)
+
+func init() {
+	RegisterSource("simulated", newSimulatedSource)
+}
+
+// SimulateSensor returns a copy of a sensor that reads from a simulated vessel and drives in-memory switches.
+func SimulateSensor(sensor Sensor) Sensor {
+	sensor.Type = "simulated"
+	sensor.SwitchType = "fake"
+	sensor.GPIOChip = "simulated/" + sensor.ID
+	return sensor
+}
+
+// SimulateConfig replaces every sensor in a configuration with a simulated one.
+func SimulateConfig(config *Config) {
+	for i := range config.Sensors {
+		config.Sensors[i] = SimulateSensor(config.Sensors[i])
+	}
+}
+
+// vessel is a lump of liquid that exchanges heat with the ambient air, a heater and a chiller.
+type vessel struct {
+	mu      sync.Mutex
+	params  Vessel
+	ambient float64
+	temp    float64
+	last    time.Time
+	heat    Switch
+	cool    Switch
+}
+
+func newSimulatedSource(sensor Sensor) (TemperatureSource, error) {
+	params := sensor.Vessel
+	ambient := defaultAmbient
+	if params.Ambient != nil {
+		ambient = *params.Ambient
+	}
+	if params.ThermalMass <= 0 {
+		params.ThermalMass = defaultThermalMass
+	}
+	if params.Loss <= 0 {
+		params.Loss = defaultLoss
+	}
+	if params.HeatWatts == 0 {
+		params.HeatWatts = defaultHeatWatts
+	}
+	if params.CoolWatts == 0 {
+		params.CoolWatts = defaultCoolWatts
+	}
+	start := ambient
+	if params.Start != nil {
+		start = *params.Start
+	}
+
+	var heat, cool Switch
+	var err error
+	if !sensor.HeatDisable {
+		if heat, err = HeatSwitch(sensor); err != nil {
+			return nil, err
+		}
+	}
+	if !sensor.CoolDisable {
+		if cool, err = CoolSwitch(sensor); err != nil {
+			return nil, err
+		}
+	}
+
+	vesselsMu.Lock()
+	defer vesselsMu.Unlock()
+
+	v, ok := vessels[sensor.ID]
+	if !ok {
+		v = &vessel{temp: start, last: time.Now()}
+		vessels[sensor.ID] = v
+	}
+
+	// Pick up any configuration changes
+	v.mu.Lock()
+	v.params = params
+	v.ambient = ambient
+	v.heat = heat
+	v.cool = cool
+	v.mu.Unlock()
+
+	return v, nil
+}
+
+// Temperature advances the simulation to now and returns the vessel temperature.
+func (v *vessel) Temperature() (float64, error) {
+	time.Sleep(simulatedReadDelay)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	if err := v.advance(now.Sub(v.last)); err != nil {
+		return 0.0, err
+	}
+	v.last = now
+
+	return v.temp, nil
+}
+
+// advance moves the simulation forward by dt, holding the switches as they are now.
+func (v *vessel) advance(dt time.Duration) error {
+	var power float64
+	if v.heat != nil {
+		on, err := v.heat.State()
+		if err != nil {
+			return err
+		}
+		if on {
+			power += v.params.HeatWatts
+		}
+	}
+	if v.cool != nil {
+		on, err := v.cool.State()
+		if err != nil {
+			return err
+		}
+		if on {
+			power -= v.params.CoolWatts
+		}
+	}
+
+	// With constant power, the temperature decays exponentially towards equilibrium
+	equilibrium := v.ambient + power/v.params.Loss
+	v.temp = equilibrium + (v.temp-equilibrium)*math.Exp(-v.params.Loss*dt.Seconds()/v.params.ThermalMass)
+	return nil
+}
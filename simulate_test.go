@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SimulateConfig(t *testing.T) {
+	config := Config{Sensors: []Sensor{Sensor{ID: "foo", Type: "hwmon", SwitchType: "rpio"}}}
+	SimulateConfig(&config)
+
+	assert.Equal(t, "simulated", config.Sensors[0].Type)
+	assert.Equal(t, "fake", config.Sensors[0].SwitchType)
+	assert.Equal(t, "simulated/foo", config.Sensors[0].GPIOChip)
+}
+
+func Test_vessel(t *testing.T) {
+	defer CloseSwitches()
+	delay := simulatedReadDelay
+	simulatedReadDelay = 0
+	defer func() { simulatedReadDelay = delay }()
+
+	// Start from fresh vessels, so the test can run again
+	vesselsMu.Lock()
+	vessels = make(map[string]*vessel)
+	vesselsMu.Unlock()
+
+	ambient, start := 20.0, 18.0
+	sensor := SimulateSensor(Sensor{
+		ID:       "vessel",
+		HeatGPIO: 1,
+		CoolGPIO: 2,
+		Vessel:   Vessel{Ambient: &ambient, Start: &start, ThermalMass: 1000, Loss: 10, HeatWatts: 100, CoolWatts: 200},
+	})
+
+	// Reads start at the configured temperature
+	temp, err := ReadSensor(sensor)
+	assert.Equal(t, nil, err)
+	assert.InDelta(t, 18, temp, 0.01)
+
+	source, _ := NewTemperatureSource(sensor)
+	v := source.(*vessel)
+	heat, _ := HeatSwitch(sensor)
+	cool, _ := CoolSwitch(sensor)
+
+	// With everything off, the vessel settles at ambient
+	v.advance(time.Hour)
+	assert.InDelta(t, 20, v.temp, 0.01)
+
+	// The heater settles 10 degrees above ambient
+	heat.On()
+	v.advance(time.Hour)
+	assert.InDelta(t, 30, v.temp, 0.01)
+
+	// Heater and chiller together settle 10 degrees below ambient
+	cool.On()
+	v.advance(time.Hour)
+	assert.InDelta(t, 10, v.temp, 0.01)
+
+	// Short steps only move part of the way
+	heat.Off()
+	cool.Off()
+	v.advance(time.Minute)
+	assert.True(t, v.temp > 10 && v.temp < 20)
+}
+
+func Test_vesselDefaults(t *testing.T) {
+	defer CloseSwitches()
+	delay := simulatedReadDelay
+	simulatedReadDelay = 0
+	defer func() { simulatedReadDelay = delay }()
+
+	// Unset, the vessel starts at the default ambient
+	temp, err := ReadSensor(SimulateSensor(Sensor{ID: "default", HeatGPIO: 1, CoolGPIO: 2}))
+	assert.Equal(t, nil, err)
+	assert.InDelta(t, defaultAmbient, temp, 0.01)
+
+	// But 0°C can be configured, and the start defaults to the ambient
+	ambient := 0.0
+	sensor := SimulateSensor(Sensor{ID: "cold", HeatGPIO: 1, CoolGPIO: 2, Vessel: Vessel{Ambient: &ambient}})
+	temp, err = ReadSensor(sensor)
+	assert.Equal(t, nil, err)
+	assert.InDelta(t, 0, temp, 0.01)
+
+	source, _ := NewTemperatureSource(sensor)
+	v := source.(*vessel)
+	v.advance(time.Hour)
+	assert.InDelta(t, 0, v.temp, 0.01)
+}
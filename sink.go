@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsSink is somewhere states are sent, like a database. It receives every event published to
+// the Hub, and is closed when it's removed from the configuration or TempGopher stops.
+type MetricsSink interface {
+	HandleEvent(e Event)
+	Close() error
+}
+
+// SinkFactory creates a MetricsSink from its configuration. configPath is the path of the
+// configuration file, next to which any files may be kept.
+type SinkFactory func(configPath string, sink Sink) (MetricsSink, error)
+
+// Sink defines where states are sent. Type chooses the kind of sink, and Name tells sinks of the same
+// type apart, defaulting to the type. Graphite and StatsD send to Addr, prefixing each metric with
+// Prefix, and CSV writes to Path.
+type Sink struct {
+	Type   string `json:"type"   yaml:"type"`
+	Name   string `json:"name"   yaml:"name"`
+	Addr   string `json:"addr"   yaml:"addr"`
+	Prefix string `json:"prefix" yaml:"prefix"`
+	Path   string `json:"path"   yaml:"path"`
+	Influx Influx `json:"influx" yaml:"influx"`
+}
+
+// DefaultSinkPrefix is the prefix of metrics sent to Graphite and StatsD when one isn't configured
+const DefaultSinkPrefix = "tempgopher"
+
+// sinkTimeout is how long to wait to connect to, or send to, a sink
+const sinkTimeout = 5 * time.Second
+
+var (
+	sinksMu   sync.RWMutex
+	sinkTypes = map[string]SinkFactory{
+		"influx":   newInfluxSink,
+		"graphite": newGraphiteSink,
+		"statsd":   newStatsDSink,
+		"csv":      newCSVSink,
+	}
+)
+
+// RegisterSink makes a sink available to the configuration with the given type. Registering a type
+// that already exists replaces it.
+func RegisterSink(name string, factory SinkFactory) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	sinkTypes[name] = factory
+}
+
+// NewMetricsSink returns the MetricsSink configured by sink
+func NewMetricsSink(configPath string, sink Sink) (MetricsSink, error) {
+	sinksMu.RLock()
+	factory, ok := sinkTypes[sink.Type]
+	sinksMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown sink type: %s", sink.Type)
+	}
+
+	return factory(configPath, sink)
+}
+
+// ConfiguredSinks returns the sinks of a configuration, each with a name. A database set in the
+// influx block is a sink called influx.
+func ConfiguredSinks(config *Config) []Sink {
+	var sinks []Sink
+	if config.Influx.Addr != "" {
+		sinks = append(sinks, Sink{Type: "influx", Name: "influx", Influx: config.Influx})
+	}
+	for _, s := range config.Sinks {
+		if s.Name == "" {
+			s.Name = s.Type
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks
+}
+
+// CheckSinks returns an error if the sinks of a configuration are of unknown types, share a name,
+// or are missing where to send states
+func CheckSinks(config *Config) error {
+	names := make(map[string]bool)
+	for _, s := range ConfiguredSinks(config) {
+		sinksMu.RLock()
+		_, ok := sinkTypes[s.Type]
+		sinksMu.RUnlock()
+		if !ok {
+			return fmt.Errorf("Unknown sink type: %s", s.Type)
+		}
+
+		if names[s.Name] {
+			return fmt.Errorf("Duplicate sink name found in configuration: %s", s.Name)
+		}
+		names[s.Name] = true
+
+		switch s.Type {
+		case "influx":
+			if s.Influx.Addr == "" {
+				return fmt.Errorf("Sink %s needs an Influx addr", s.Name)
+			}
+			if err := CheckInflux(s.Influx); err != nil {
+				return err
+			}
+		case "graphite", "statsd":
+			if s.Addr == "" {
+				return fmt.Errorf("Sink %s needs an addr", s.Name)
+			}
+		case "csv":
+			if s.Path == "" {
+				return fmt.Errorf("Sink %s needs a path", s.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// runningSink is a sink subscribed to a Hub
+type runningSink struct {
+	config      Sink
+	sink        MetricsSink
+	unsubscribe func()
+}
+
+// Sinks starts the configured sinks, each subscribed to a Hub, and follows configuration reloads.
+// Sinks whose configuration is unchanged keep running.
+type Sinks struct {
+	path string
+	hub  *Hub
+
+	mu      sync.Mutex
+	running map[string]runningSink
+}
+
+// NewSinks starts the sinks of config, for the configuration file at path
+func NewSinks(path string, hub *Hub, config *Config) *Sinks {
+	s := &Sinks{path: path, hub: hub, running: make(map[string]runningSink)}
+	s.apply(config, nil)
+	return s
+}
+
+// HandleEvent starts and stops sinks on config events, so it can subscribe to a Hub
+func (s *Sinks) HandleEvent(e Event) {
+	if e.Type == EventConfig {
+		s.apply(e.Config, &e)
+	}
+}
+
+// apply starts the sinks of config that aren't running, and stops those no longer configured. New
+// sinks are given e, since they weren't subscribed when it was published.
+func (s *Sinks) apply(config *Config, e *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	configured := make(map[string]bool)
+	for _, c := range ConfiguredSinks(config) {
+		configured[c.Name] = true
+		if r, ok := s.running[c.Name]; ok {
+			if reflect.DeepEqual(r.config, c) {
+				continue
+			}
+			s.stop(c.Name)
+		}
+
+		sink, err := NewMetricsSink(s.path, c)
+		if err != nil {
+			log.Printf("Unable to start sink %s: %v", c.Name, err)
+			continue
+		}
+		if e != nil {
+			sink.HandleEvent(*e)
+		}
+		s.running[c.Name] = runningSink{config: c, sink: sink, unsubscribe: s.hub.Handle(sink.HandleEvent)}
+	}
+
+	for name := range s.running {
+		if !configured[name] {
+			s.stop(name)
+		}
+	}
+}
+
+// stop unsubscribes and closes a sink. s.mu must be held.
+func (s *Sinks) stop(name string) {
+	r := s.running[name]
+	r.unsubscribe()
+	if err := r.sink.Close(); err != nil {
+		log.Printf("Unable to close sink %s: %v", name, err)
+	}
+	delete(s.running, name)
+	RemoveWriterHealth(name)
+}
+
+// Close stops every sink
+func (s *Sinks) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name := range s.running {
+		s.stop(name)
+	}
+}
+
+// stateMetrics returns the values sent to Graphite and StatsD for a state of sensor
+func stateMetrics(sensor Sensor, s State) map[string]float64 {
+	m := map[string]float64{
+		"temp":     s.Temp,
+		"raw":      s.Raw,
+		"heating":  boolGauge(s.Heating),
+		"cooling":  boolGauge(s.Cooling),
+		"fault":    boolGauge(s.Fault),
+		"hightemp": sensor.HighTemp,
+		"lowtemp":  sensor.LowTemp,
+	}
+	if sensor.Mode == ModePID {
+		m["setpoint"] = sensor.SetPoint
+	}
+	return m
+}
+
+// metricInvalid matches the characters not allowed in a part of a Graphite or StatsD metric name
+var metricInvalid = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// metricNames returns the names of metrics, sorted, with the full name of each
+func metricNames(prefix string, alias string, metrics map[string]float64) ([]string, map[string]string) {
+	if prefix == "" {
+		prefix = DefaultSinkPrefix
+	}
+	prefix = strings.TrimSuffix(prefix, ".") + "." + metricInvalid.ReplaceAllString(alias, "_") + "."
+
+	keys := make([]string, 0, len(metrics))
+	full := make(map[string]string, len(metrics))
+	for k := range metrics {
+		keys = append(keys, k)
+		full[k] = prefix + k
+	}
+	sort.Strings(keys)
+	return keys, full
+}
+
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// sinkHealth records the health of a sink that writes each state as it arrives
+func sinkHealth(name string, health *WriterHealth, err error) {
+	health.Enabled = true
+	if err != nil {
+		health.LastError = err.Error()
+		health.ErrorTime = time.Now()
+	} else {
+		health.LastWrite = time.Now()
+		health.LastError = ""
+	}
+	health.Healthy = health.LastError == ""
+	SetWriterHealth(name, *health)
+}
+
+// graphiteSink sends states to Graphite with its plaintext protocol. The connection is kept open,
+// and made again after an error. States sent while Graphite is unreachable are lost.
+type graphiteSink struct {
+	name   string
+	addr   string
+	prefix string
+	conn   net.Conn
+	health WriterHealth
+}
+
+func newGraphiteSink(configPath string, sink Sink) (MetricsSink, error) {
+	if sink.Addr == "" {
+		return nil, errors.New("Graphite needs an addr")
+	}
+	return &graphiteSink{name: sink.Name, addr: sink.Addr, prefix: sink.Prefix}, nil
+}
+
+// GraphiteLines returns the lines sent to Graphite for a state of sensor
+func GraphiteLines(prefix string, sensor Sensor, s State) string {
+	metrics := stateMetrics(sensor, s)
+	keys, names := metricNames(prefix, sensor.Alias, metrics)
+
+	var b strings.Builder
+	when := strconv.FormatInt(s.When.Unix(), 10)
+	for _, k := range keys {
+		b.WriteString(names[k] + " " + formatMetric(metrics[k]) + " " + when + "\n")
+	}
+	return b.String()
+}
+
+func (g *graphiteSink) HandleEvent(e Event) {
+	if e.Type != EventState {
+		return
+	}
+
+	err := g.send(GraphiteLines(g.prefix, e.Sensor, e.State))
+	if err != nil {
+		log.Printf("Unable to send to %s: %v", g.name, err)
+	}
+	sinkHealth(g.name, &g.health, err)
+}
+
+func (g *graphiteSink) send(lines string) error {
+	if g.conn == nil {
+		conn, err := net.DialTimeout("tcp", g.addr, sinkTimeout)
+		if err != nil {
+			return err
+		}
+		g.conn = conn
+	}
+
+	g.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+	if _, err := g.conn.Write([]byte(lines)); err != nil {
+		g.conn.Close()
+		g.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (g *graphiteSink) Close() error {
+	if g.conn == nil {
+		return nil
+	}
+	err := g.conn.Close()
+	g.conn = nil
+	return err
+}
+
+// statsDSink sends states to StatsD as gauges, over UDP
+type statsDSink struct {
+	name   string
+	prefix string
+	conn   net.Conn
+	health WriterHealth
+}
+
+func newStatsDSink(configPath string, sink Sink) (MetricsSink, error) {
+	if sink.Addr == "" {
+		return nil, errors.New("StatsD needs an addr")
+	}
+	conn, err := net.Dial("udp", sink.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsDSink{name: sink.Name, prefix: sink.Prefix, conn: conn}, nil
+}
+
+// StatsDGauges returns the packet sent to StatsD for a state of sensor. A gauge with a sign changes
+// by that amount, so negative values are sent after setting the gauge to zero.
+func StatsDGauges(prefix string, sensor Sensor, s State) string {
+	metrics := stateMetrics(sensor, s)
+	keys, names := metricNames(prefix, sensor.Alias, metrics)
+
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if metrics[k] < 0 {
+			lines = append(lines, names[k]+":0|g")
+		}
+		lines = append(lines, names[k]+":"+formatMetric(metrics[k])+"|g")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (d *statsDSink) HandleEvent(e Event) {
+	if e.Type != EventState {
+		return
+	}
+
+	d.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+	_, err := d.conn.Write([]byte(StatsDGauges(d.prefix, e.Sensor, e.State)))
+	if err != nil {
+		log.Printf("Unable to send to %s: %v", d.name, err)
+	}
+	sinkHealth(d.name, &d.health, err)
+}
+
+func (d *statsDSink) Close() error {
+	return d.conn.Close()
+}
+
+// csvHeader is the first row of a CSV file of states
+var csvHeader = []string{"time", "alias", "id", "temp", "raw", "heating", "cooling", "fault", "hightemp", "lowtemp", "setpoint"}
+
+// csvSink appends states to a CSV file, writing a header when the file is new
+type csvSink struct {
+	name   string
+	f      *os.File
+	w      *csv.Writer
+	health WriterHealth
+}
+
+func newCSVSink(configPath string, sink Sink) (MetricsSink, error) {
+	if sink.Path == "" {
+		return nil, errors.New("CSV needs a path")
+	}
+
+	f, err := os.OpenFile(sink.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c := &csvSink{name: sink.Name, f: f, w: csv.NewWriter(f)}
+	if info.Size() == 0 {
+		c.w.Write(csvHeader)
+		c.w.Flush()
+		if err := c.w.Error(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// CSVRecord returns the row written to a CSV file for a state of sensor
+func CSVRecord(sensor Sensor, s State) []string {
+	setpoint := ""
+	if sensor.Mode == ModePID {
+		setpoint = formatMetric(sensor.SetPoint)
+	}
+	return []string{
+		s.When.Format(time.RFC3339),
+		sensor.Alias,
+		sensor.ID,
+		formatMetric(s.Temp),
+		formatMetric(s.Raw),
+		strconv.FormatBool(s.Heating),
+		strconv.FormatBool(s.Cooling),
+		strconv.FormatBool(s.Fault),
+		formatMetric(sensor.HighTemp),
+		formatMetric(sensor.LowTemp),
+		setpoint,
+	}
+}
+
+func (c *csvSink) HandleEvent(e Event) {
+	if e.Type != EventState {
+		return
+	}
+
+	c.w.Write(CSVRecord(e.Sensor, e.State))
+	c.w.Flush()
+	err := c.w.Error()
+	if err != nil {
+		log.Printf("Unable to write to %s: %v", c.name, err)
+	}
+	sinkHealth(c.name, &c.health, err)
+}
+
+func (c *csvSink) Close() error {
+	return c.f.Close()
+}
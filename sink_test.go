@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CheckSinks(t *testing.T) {
+	// The influx block is a sink of its own
+	config := &Config{
+		Influx: Influx{Addr: "http://influx:8086"},
+		Sinks:  []Sink{Sink{Type: "graphite", Addr: "graphite:2003"}, Sink{Type: "csv", Name: "log", Path: "/tmp/log.csv"}},
+	}
+	sinks := ConfiguredSinks(config)
+	assert.Equal(t, 3, len(sinks))
+	assert.Equal(t, "influx", sinks[0].Name)
+	assert.Equal(t, "http://influx:8086", sinks[0].Influx.Addr)
+	assert.Equal(t, "graphite", sinks[1].Name)
+	assert.Equal(t, "log", sinks[2].Name)
+	assert.Equal(t, nil, CheckSinks(config))
+	assert.Equal(t, 0, len(ConfiguredSinks(&Config{})))
+
+	bad := []Sink{
+		Sink{Type: "DNE"},
+		Sink{Type: "influx"},
+		Sink{Type: "influx", Name: "cloud", Influx: Influx{Addr: "http://influx:8086", Version: InfluxV2}},
+		Sink{Type: "graphite"},
+		Sink{Type: "statsd"},
+		Sink{Type: "csv"},
+		Sink{Type: "graphite", Name: "influx", Addr: "graphite:2003"},
+	}
+	for _, s := range bad {
+		assert.NotEqual(t, nil, CheckSinks(&Config{Influx: Influx{Addr: "http://influx:8086"}, Sinks: []Sink{s}}), s)
+	}
+}
+
+func Test_SinkFormats(t *testing.T) {
+	when := time.Unix(1540000000, 0)
+	sensor := Sensor{ID: "28-foo", Alias: "big beer", HighTemp: 20, LowTemp: -1.5}
+	state := State{Temp: 18.5, Raw: 18.75, Heating: true, When: when}
+
+	lines := strings.Split(strings.TrimSpace(GraphiteLines("", sensor, state)), "\n")
+	assert.Equal(t, 7, len(lines))
+	assert.Equal(t, "tempgopher.big_beer.cooling 0 1540000000", lines[0])
+	assert.Equal(t, "tempgopher.big_beer.heating 1 1540000000", lines[2])
+	assert.Equal(t, "tempgopher.big_beer.temp 18.5 1540000000", lines[6])
+
+	// Negative gauges are set from zero, since a sign changes the gauge instead
+	gauges := strings.Split(StatsDGauges("brewery.", sensor, state), "\n")
+	assert.Equal(t, 8, len(gauges))
+	assert.Contains(t, gauges, "brewery.big_beer.temp:18.5|g")
+	assert.Contains(t, gauges, "brewery.big_beer.lowtemp:0|g")
+	assert.Contains(t, gauges, "brewery.big_beer.lowtemp:-1.5|g")
+
+	assert.Equal(t, []string{"2018-10-20T01:46:40Z", "big beer", "28-foo", "18.5", "18.75", "true", "false", "false", "20", "-1.5", ""}, CSVRecord(sensor, State{Temp: 18.5, Raw: 18.75, Heating: true, When: when.UTC()}))
+	sensor.Mode = ModePID
+	sensor.SetPoint = 19
+	assert.Equal(t, "19", CSVRecord(sensor, state)[10])
+}
+
+func Test_GraphiteSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	received := make(chan string, 20)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+	}()
+
+	sink, err := NewMetricsSink("", Sink{Type: "graphite", Name: "graphite", Addr: l.Addr().String(), Prefix: "brewery"})
+	assert.Equal(t, nil, err)
+	defer sink.Close()
+
+	// Only states are sent
+	sink.HandleEvent(Event{Type: EventConfig, Config: &Config{}})
+	sink.HandleEvent(Event{Type: EventState, Sensor: Sensor{Alias: "foo"}, State: State{Temp: 18, When: time.Unix(1540000000, 0)}})
+	assert.Equal(t, "brewery.foo.cooling 0 1540000000", <-received)
+	assert.True(t, GetWriterHealth()["graphite"].Healthy)
+}
+
+func Test_StatsDSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+
+	sink, err := NewMetricsSink("", Sink{Type: "statsd", Name: "statsd", Addr: conn.LocalAddr().String()})
+	assert.Equal(t, nil, err)
+	defer sink.Close()
+
+	sink.HandleEvent(Event{Type: EventState, Sensor: Sensor{Alias: "foo"}, State: State{Temp: 18}})
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.Equal(t, nil, err)
+	assert.Contains(t, strings.Split(string(buf[:n]), "\n"), "tempgopher.foo.temp:18|g")
+	assert.True(t, GetWriterHealth()["statsd"].Healthy)
+}
+
+func Test_CSVSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "states.csv")
+	config := Sink{Type: "csv", Name: "csv", Path: path}
+	state := Event{Type: EventState, Sensor: Sensor{ID: "28-foo", Alias: "foo"}, State: State{Temp: 18}}
+
+	// The header is only written to a new file
+	for i := 0; i < 2; i++ {
+		sink, err := NewMetricsSink("", config)
+		assert.Equal(t, nil, err)
+		sink.HandleEvent(state)
+		assert.Equal(t, nil, sink.Close())
+	}
+
+	data, err := ioutil.ReadFile(path)
+	assert.Equal(t, nil, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, strings.Join(csvHeader, ","), lines[0])
+	assert.True(t, strings.HasPrefix(lines[2], "0001-01-01T00:00:00Z,foo,28-foo,18,"))
+}
+
+// recordingSink records the events it receives
+type recordingSink struct {
+	mu     sync.Mutex
+	config Sink
+	events []Event
+	closed bool
+}
+
+func (r *recordingSink) HandleEvent(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recordingSink) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *recordingSink) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+func (r *recordingSink) event(i int) Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events[i]
+}
+
+func (r *recordingSink) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.events)
+}
+
+func Test_Sinks(t *testing.T) {
+	var mu sync.Mutex
+	var created []*recordingSink
+	RegisterSink("recording", func(configPath string, sink Sink) (MetricsSink, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		r := &recordingSink{config: sink}
+		created = append(created, r)
+		return r, nil
+	})
+	get := func(i int) *recordingSink {
+		mu.Lock()
+		defer mu.Unlock()
+		return created[i]
+	}
+	wait := func(cond func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	hub := NewHub()
+	config := &Config{Sinks: []Sink{Sink{Type: "recording", Name: "a"}, Sink{Type: "recording", Name: "b", Prefix: "b"}}}
+	sinks := NewSinks("", hub, config)
+	defer sinks.Close()
+	defer hub.Handle(sinks.HandleEvent)()
+
+	// Every sink receives every event
+	assert.Equal(t, 2, len(created))
+	hub.PublishConfig(config)
+	hub.PublishState(Sensor{Alias: "foo"}, State{Alias: "foo"})
+	wait(func() bool { return get(0).count() == 2 && get(1).count() == 2 })
+	assert.Equal(t, EventState, get(0).event(1).Type)
+	assert.Equal(t, EventState, get(1).event(1).Type)
+
+	// Changed sinks are started again, and removed sinks stopped. New sinks get the config event.
+	config = &Config{Sinks: []Sink{Sink{Type: "recording", Name: "a"}, Sink{Type: "recording", Name: "b", Prefix: "c"}}}
+	hub.PublishConfig(config)
+	wait(func() bool { mu.Lock(); defer mu.Unlock(); return len(created) == 3 })
+	assert.False(t, get(0).isClosed())
+	assert.True(t, get(1).isClosed())
+	wait(func() bool { return get(2).count() == 1 })
+	assert.Equal(t, EventConfig, get(2).event(0).Type)
+	assert.Equal(t, "c", get(2).config.Prefix)
+
+	SetWriterHealth("b", WriterHealth{Enabled: true})
+	hub.PublishConfig(&Config{Sinks: []Sink{Sink{Type: "recording", Name: "a"}}})
+	wait(get(2).isClosed)
+	assert.True(t, get(2).isClosed())
+	_, ok := GetWriterHealth()["b"]
+	assert.False(t, ok)
+
+	sinks.Close()
+	assert.True(t, get(0).isClosed())
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TemperatureSource is anything that can provide a temperature reading (in degrees celsius).
+type TemperatureSource interface {
+	Temperature() (float64, error)
+}
+
+// SourceFactory creates a TemperatureSource from a sensor's configuration.
+type SourceFactory func(sensor Sensor) (TemperatureSource, error)
+
+// DefaultSourceType is used when a sensor does not specify a type.
+const DefaultSourceType = "ds18b20"
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = map[string]SourceFactory{
+		"ds18b20": newDS18B20Source,
+		"hwmon":   newHwmonSource,
+		"command": newCommandSource,
+		"http":    newHTTPSource,
+	}
+)
+
+// RegisterSource makes a temperature source available to sensors with the given type.
+// Registering a type that already exists replaces it.
+func RegisterSource(name string, factory SourceFactory) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources[name] = factory
+}
+
+// NewTemperatureSource returns the TemperatureSource configured for a sensor.
+func NewTemperatureSource(sensor Sensor) (TemperatureSource, error) {
+	name := sensor.Type
+	if name == "" {
+		name = DefaultSourceType
+	}
+
+	sourcesMu.RLock()
+	factory, ok := sources[name]
+	sourcesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown sensor type: %s", name)
+	}
+
+	return factory(sensor)
+}
+
+// ReadSensor returns the current temperature (in degrees celsius) of a sensor using its configured source.
+func ReadSensor(sensor Sensor) (float64, error) {
+	source, err := NewTemperatureSource(sensor)
+	if err != nil {
+		return 0.0, err
+	}
+
+	return source.Temperature()
+}
+
+// ds18b20Source reads a DS18B20 sensor on the 1-wire bus.
+type ds18b20Source struct {
+	id string
+}
+
+func newDS18B20Source(sensor Sensor) (TemperatureSource, error) {
+	return ds18b20Source{id: sensor.ID}, nil
+}
+
+func (s ds18b20Source) Temperature() (float64, error) {
+	return ReadTemperature(s.id)
+}
+
+// hwmonSource reads a sysfs hwmon file, which reports millidegrees celsius.
+type hwmonSource struct {
+	path string
+}
+
+func newHwmonSource(sensor Sensor) (TemperatureSource, error) {
+	if sensor.Path == "" {
+		return nil, errors.New("hwmon sensor requires a path")
+	}
+	return hwmonSource{path: sensor.Path}, nil
+}
+
+func (s hwmonSource) Temperature() (float64, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return 0.0, err
+	}
+
+	milli, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0.0, err
+	}
+
+	return milli / 1000, nil
+}
+
+// commandSource runs a shell command which prints the temperature in degrees celsius.
+type commandSource struct {
+	command string
+}
+
+func newCommandSource(sensor Sensor) (TemperatureSource, error) {
+	if sensor.Command == "" {
+		return nil, errors.New("command sensor requires a command")
+	}
+	return commandSource{command: sensor.Command}, nil
+}
+
+func (s commandSource) Temperature() (float64, error) {
+	out, err := exec.Command("sh", "-c", s.command).Output()
+	if err != nil {
+		return 0.0, err
+	}
+
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+// httpSource fetches a JSON document and extracts the temperature from it.
+type httpSource struct {
+	url string
+	key string
+}
+
+func newHTTPSource(sensor Sensor) (TemperatureSource, error) {
+	if sensor.URL == "" {
+		return nil, errors.New("http sensor requires a url")
+	}
+	return httpSource{url: sensor.URL, key: sensor.JSONKey}, nil
+}
+
+func (s httpSource) Temperature() (float64, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(s.url)
+	if err != nil {
+		return 0.0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0.0, fmt.Errorf("Unexpected status from %s: %s", s.url, resp.Status)
+	}
+
+	var doc interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return 0.0, err
+	}
+
+	return jsonNumber(doc, s.key)
+}
+
+// jsonNumber walks a decoded JSON document along a dot separated key and returns the number found there.
+// An empty key means the document itself is the number.
+func jsonNumber(doc interface{}, key string) (float64, error) {
+	if key != "" {
+		for _, part := range strings.Split(key, ".") {
+			obj, ok := doc.(map[string]interface{})
+			if !ok {
+				return 0.0, fmt.Errorf("Key %s not found", key)
+			}
+			if doc, ok = obj[part]; !ok {
+				return 0.0, fmt.Errorf("Key %s not found", key)
+			}
+		}
+	}
+
+	switch v := doc.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0.0, fmt.Errorf("Value at %s is not a number", key)
+	}
+}
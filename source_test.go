@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fixedSource float64
+
+func (f fixedSource) Temperature() (float64, error) {
+	return float64(f), nil
+}
+
+func Test_NewTemperatureSource(t *testing.T) {
+	// Default type is a DS18B20
+	source, err := NewTemperatureSource(Sensor{ID: "28-000008083108"})
+	assert.Equal(t, nil, err)
+	assert.IsType(t, ds18b20Source{}, source)
+
+	// Unknown types fail
+	_, err = NewTemperatureSource(Sensor{Type: "DNE"})
+	assert.NotEqual(t, nil, err)
+
+	// Types missing required settings fail
+	_, err = NewTemperatureSource(Sensor{Type: "hwmon"})
+	assert.NotEqual(t, nil, err)
+	_, err = NewTemperatureSource(Sensor{Type: "command"})
+	assert.NotEqual(t, nil, err)
+	_, err = NewTemperatureSource(Sensor{Type: "http"})
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_RegisterSource(t *testing.T) {
+	RegisterSource("fixed", func(sensor Sensor) (TemperatureSource, error) {
+		return fixedSource(12.5), nil
+	})
+
+	temp, err := ReadSensor(Sensor{Type: "fixed"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 12.5, temp)
+}
+
+func Test_hwmonSource(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.Remove(tmpfile.Name())
+	tmpfile.WriteString("21500\n")
+	tmpfile.Close()
+
+	temp, err := ReadSensor(Sensor{Type: "hwmon", Path: tmpfile.Name()})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 21.5, temp)
+
+	_, err = ReadSensor(Sensor{Type: "hwmon", Path: "/does/not/exist"})
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_commandSource(t *testing.T) {
+	temp, err := ReadSensor(Sensor{Type: "command", Command: "echo 18.25"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 18.25, temp)
+
+	_, err = ReadSensor(Sensor{Type: "command", Command: "echo foo"})
+	assert.NotEqual(t, nil, err)
+}
+
+func Test_httpSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data": {"temp": 19.5, "name": "probe"}}`))
+	}))
+	defer ts.Close()
+
+	temp, err := ReadSensor(Sensor{Type: "http", URL: ts.URL, JSONKey: "data.temp"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 19.5, temp)
+
+	// Not a number
+	_, err = ReadSensor(Sensor{Type: "http", URL: ts.URL, JSONKey: "data.name"})
+	assert.NotEqual(t, nil, err)
+
+	// Key not found
+	_, err = ReadSensor(Sensor{Type: "http", URL: ts.URL, JSONKey: "data.DNE"})
+	assert.NotEqual(t, nil, err)
+
+	// Bad status
+	_, err = ReadSensor(Sensor{Type: "http", URL: ts.URL + "/missing"})
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateFileInterval is how often states are written even if nothing important changed,
+// so slowly changing values like the PID integral are kept reasonably fresh.
+const stateFileInterval = time.Minute
+
+// StateFile persists the state of each thermostat, keyed by sensor ID, so that
+// timers and controller progress survive a restart.
+type StateFile struct {
+	path    string
+	states  map[string]State
+	written time.Time
+}
+
+// StateFilePath returns where states should be stored for a configuration. Unless
+// configured, it is state.json next to the config file.
+func StateFilePath(configPath string, config *Config) string {
+	if config.StateFile != "" {
+		return config.StateFile
+	}
+	return filepath.Join(filepath.Dir(configPath), "state.json")
+}
+
+// LoadStateFile reads the states stored at path. A missing file is not an error; it
+// just means there is nothing to restore. If the file can't be read, an empty
+// StateFile is returned along with the error.
+func LoadStateFile(path string) (*StateFile, error) {
+	f := &StateFile{path: path, states: make(map[string]State)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return f, err
+	}
+
+	if err = json.Unmarshal(data, &f.states); err != nil {
+		f.states = make(map[string]State)
+		return f, err
+	}
+
+	return f, nil
+}
+
+// Get returns the stored state of a sensor
+func (f *StateFile) Get(id string) (State, bool) {
+	s, ok := f.states[id]
+	return s, ok
+}
+
+// Restore returns the state a sensor starts with. A saved state carries on where it left
+// off, including any cycle in progress, but the outputs were turned off when TempGopher
+// stopped, and their minimum off times count from then. Without a clean shutdown, that is
+// only known to be now.
+func (f *StateFile) Restore(id string, alias string, now time.Time) State {
+	state, ok := f.Get(id)
+	if !ok {
+		// Everything was just turned off, so the minimum off times apply
+		return State{Alias: alias, When: now, Changed: now, CoolChanged: now, HeatChanged: now}
+	}
+
+	state.Alias = alias
+	if state.Stopped.IsZero() && (state.Cooling || state.Heating) {
+		state.Stopped = now
+	}
+	return state
+}
+
+// Stop records that the outputs of every sensor were turned off at now, and writes the states
+func (f *StateFile) Stop(now time.Time) error {
+	for id, s := range f.states {
+		if s.Cooling || s.Heating {
+			s.Stopped = now
+			f.states[id] = s
+		}
+	}
+	return f.Save()
+}
+
+// Update records the state of a sensor. The file is written when an output or
+// timer changes, or when it hasn't been written for a while.
+func (f *StateFile) Update(id string, s State) error {
+	old, ok := f.states[id]
+	f.states[id] = s
+
+	if ok && !stateChanged(old, s) && time.Since(f.written) < stateFileInterval {
+		return nil
+	}
+
+	return f.Save()
+}
+
+// Save writes all states to disk. The file is replaced atomically, so a power
+// failure leaves either the old or the new states behind.
+func (f *StateFile) Save() error {
+	data, err := json.Marshal(f.states)
+	if err != nil {
+		return err
+	}
+
+	// The new states must be on disk before they replace the old ones
+	tmp := f.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, f.path); err != nil {
+		return err
+	}
+
+	f.written = time.Now()
+	return nil
+}
+
+// stateChanged is true if anything other than the reading itself differs between two states
+func stateChanged(a State, b State) bool {
+	return a.Cooling != b.Cooling ||
+		a.Heating != b.Heating ||
+		!a.Changed.Equal(b.Changed) ||
+		!a.CoolChanged.Equal(b.CoolChanged) ||
+		!a.HeatChanged.Equal(b.HeatChanged) ||
+		!a.Stopped.Equal(b.Stopped) ||
+		a.PID.Duty != b.PID.Duty ||
+		a.Fault != b.Fault ||
+		a.AirFault != b.AirFault ||
+		!a.PID.WindowStart.Equal(b.PID.WindowStart)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_StateFilePath(t *testing.T) {
+	assert.Equal(t, "/etc/tempgopher/state.json", StateFilePath("/etc/tempgopher/config.yml", &Config{}))
+	assert.Equal(t, "/var/lib/state.json", StateFilePath("config.yml", &Config{StateFile: "/var/lib/state.json"}))
+}
+
+func Test_StateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	// A missing file has nothing to restore
+	f, err := LoadStateFile(path)
+	assert.Equal(t, nil, err)
+	_, ok := f.Get("foo")
+	assert.False(t, ok)
+
+	// The first state of a sensor is always written
+	changed := time.Date(2018, 11, 1, 12, 0, 0, 0, time.UTC)
+	state := State{Alias: "foo", Temp: 10, Cooling: true, Changed: changed, PID: PIDState{Integral: 5}}
+	assert.Equal(t, nil, f.Update("foo", state))
+
+	f, err = LoadStateFile(path)
+	assert.Equal(t, nil, err)
+	saved, ok := f.Get("foo")
+	assert.True(t, ok)
+	assert.True(t, saved.Cooling)
+	assert.True(t, changed.Equal(saved.Changed))
+	assert.Equal(t, 5.0, saved.PID.Integral)
+
+	// New readings alone aren't written straight away
+	f.written = time.Now()
+	state.Temp = 11
+	assert.Equal(t, nil, f.Update("foo", state))
+	f2, _ := LoadStateFile(path)
+	saved, _ = f2.Get("foo")
+	assert.Equal(t, 10.0, saved.Temp)
+
+	// Unless it has been a while
+	f.written = time.Now().Add(-2 * stateFileInterval)
+	assert.Equal(t, nil, f.Update("foo", state))
+	f2, _ = LoadStateFile(path)
+	saved, _ = f2.Get("foo")
+	assert.Equal(t, 11.0, saved.Temp)
+
+	// Changes to the outputs are
+	f.written = time.Now()
+	state.Cooling = false
+	assert.Equal(t, nil, f.Update("foo", state))
+	f2, _ = LoadStateFile(path)
+	saved, _ = f2.Get("foo")
+	assert.False(t, saved.Cooling)
+
+	// Corrupt files return an empty set of states
+	ioutil.WriteFile(path, []byte("foobar"), 0644)
+	f, err = LoadStateFile(path)
+	assert.NotEqual(t, nil, err)
+	_, ok = f.Get("foo")
+	assert.False(t, ok)
+
+	// Unwritable paths fail to save
+	f, _ = LoadStateFile(filepath.Join(dir, "DNE", "state.json"))
+	assert.NotEqual(t, nil, f.Update("foo", state))
+}
+
+func Test_StateFileRestore(t *testing.T) {
+	now := time.Date(2018, 11, 2, 12, 0, 0, 0, time.UTC)
+	changed := now.Add(-time.Hour)
+	stopped := now.Add(-time.Minute)
+	f := &StateFile{states: map[string]State{
+		"foo": {Alias: "old", Cooling: true, Changed: changed, CoolChanged: changed, HeatChanged: changed, PID: PIDState{Integral: 5}},
+		"bar": {Alias: "bar", Heating: true, Changed: changed, HeatChanged: changed, Stopped: stopped},
+	}}
+
+	// Sensors without a saved state start afresh, with the minimum off times applying
+	state := f.Restore("baz", "baz", now)
+	assert.Equal(t, State{Alias: "baz", When: now, Changed: now, CoolChanged: now, HeatChanged: now}, state)
+
+	// Saved states carry on, cycles included. Without a clean shutdown, the outputs have been
+	// off since now.
+	state = f.Restore("foo", "new", now)
+	assert.Equal(t, "new", state.Alias)
+	assert.True(t, state.Cooling)
+	assert.Equal(t, changed, state.Changed)
+	assert.Equal(t, changed, state.CoolChanged)
+	assert.Equal(t, now, state.Stopped)
+	assert.Equal(t, 5.0, state.PID.Integral)
+
+	// After one, they have been off since it stopped
+	state = f.Restore("bar", "bar", now)
+	assert.True(t, state.Heating)
+	assert.Equal(t, stopped, state.Stopped)
+}
+
+func Test_StateFileStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	f, _ := LoadStateFile(path)
+	f.Update("foo", State{Alias: "foo", Cooling: true})
+	f.Update("bar", State{Alias: "bar"})
+
+	// Only the outputs that were running are stopped
+	now := time.Date(2018, 11, 2, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, nil, f.Stop(now))
+	f, _ = LoadStateFile(path)
+	saved, _ := f.Get("foo")
+	assert.True(t, now.Equal(saved.Stopped))
+	assert.True(t, saved.Cooling)
+	saved, _ = f.Get("bar")
+	assert.True(t, saved.Stopped.IsZero())
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/stianeikeland/go-rpio"
+)
+
+// Switch turns a piece of equipment, such as a heater or chiller, on or off.
+type Switch interface {
+	On() error
+	Off() error
+	State() (bool, error)
+}
+
+// SwitchFactory opens the switch attached to a pin on a GPIO chip.
+type SwitchFactory func(chip string, pin int32) (Switch, error)
+
+// DefaultSwitchType is used when a sensor does not specify a switch type.
+const DefaultSwitchType = "rpio"
+
+// DefaultGPIOChip is the GPIO character device used when a sensor does not specify one.
+const DefaultGPIOChip = "/dev/gpiochip0"
+
+var (
+	switchesMu sync.Mutex
+	switches   = make(map[string]Switch)
+	rpioOpen   bool
+
+	switchFactories = map[string]SwitchFactory{
+		"rpio":     newRPIOSwitch,
+		"gpiochip": newGPIOChipSwitch,
+		"fake":     newFakeSwitch,
+	}
+)
+
+// RegisterSwitch makes a switch implementation available to sensors with the given switch type.
+// Registering a type that already exists replaces it.
+func RegisterSwitch(name string, factory SwitchFactory) {
+	switchesMu.Lock()
+	defer switchesMu.Unlock()
+	switchFactories[name] = factory
+}
+
+// CheckSwitchType returns an error if no switch implementation is registered for name.
+func CheckSwitchType(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	switchesMu.Lock()
+	defer switchesMu.Unlock()
+	if _, ok := switchFactories[name]; !ok {
+		return fmt.Errorf("Unknown switch type: %s", name)
+	}
+	return nil
+}
+
+// OpenSwitch returns the switch for a pin, opening it on first use. Switches stay
+// open until CloseSwitches is called. If invert is true, the returned switch
+// drives the pin low when turned on, and high when turned off.
+func OpenSwitch(kind string, chip string, pin int32, invert bool) (Switch, error) {
+	if kind == "" {
+		kind = DefaultSwitchType
+	}
+	if chip == "" {
+		chip = DefaultGPIOChip
+	}
+
+	switchesMu.Lock()
+	defer switchesMu.Unlock()
+
+	key := fmt.Sprintf("%s:%s:%d", kind, chip, pin)
+	sw, ok := switches[key]
+	if !ok {
+		factory, ok := switchFactories[kind]
+		if !ok {
+			return nil, fmt.Errorf("Unknown switch type: %s", kind)
+		}
+
+		var err error
+		if sw, err = factory(chip, pin); err != nil {
+			return nil, err
+		}
+		switches[key] = sw
+	}
+
+	if invert {
+		return invertedSwitch{sw}, nil
+	}
+	return sw, nil
+}
+
+// CloseSwitches releases every open switch. It does not change their state.
+func CloseSwitches() {
+	switchesMu.Lock()
+	defer switchesMu.Unlock()
+
+	for key, sw := range switches {
+		if c, ok := sw.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+		delete(switches, key)
+	}
+
+	if rpioOpen {
+		rpio.Close()
+		rpioOpen = false
+	}
+}
+
+// CoolSwitch returns the switch driving the cooling output of a sensor.
+func CoolSwitch(sensor Sensor) (Switch, error) {
+	return OpenSwitch(sensor.SwitchType, sensor.GPIOChip, sensor.CoolGPIO, sensor.CoolInvert)
+}
+
+// HeatSwitch returns the switch driving the heating output of a sensor.
+func HeatSwitch(sensor Sensor) (Switch, error) {
+	return OpenSwitch(sensor.SwitchType, sensor.GPIOChip, sensor.HeatGPIO, sensor.HeatInvert)
+}
+
+// SetSwitch turns a switch on or off. A nil switch is ignored.
+func SetSwitch(sw Switch, on bool) error {
+	if sw == nil {
+		return nil
+	}
+	if on {
+		return sw.On()
+	}
+	return sw.Off()
+}
+
+// invertedSwitch reverses the logic level of another switch.
+type invertedSwitch struct {
+	sw Switch
+}
+
+func (s invertedSwitch) On() error {
+	return s.sw.Off()
+}
+
+func (s invertedSwitch) Off() error {
+	return s.sw.On()
+}
+
+func (s invertedSwitch) State() (bool, error) {
+	on, err := s.sw.State()
+	return !on, err
+}
+
+// rpioSwitch drives a Raspberry Pi GPIO pin through /dev/gpiomem.
+type rpioSwitch struct {
+	pin rpio.Pin
+}
+
+// newRPIOSwitch must be called with switchesMu held.
+func newRPIOSwitch(chip string, pin int32) (Switch, error) {
+	if !rpioOpen {
+		if err := rpio.Open(); err != nil {
+			return nil, err
+		}
+		rpioOpen = true
+	}
+
+	p := rpio.Pin(pin)
+	p.Output()
+	return rpioSwitch{pin: p}, nil
+}
+
+func (s rpioSwitch) On() error {
+	s.pin.High()
+	return nil
+}
+
+func (s rpioSwitch) Off() error {
+	s.pin.Low()
+	return nil
+}
+
+func (s rpioSwitch) State() (bool, error) {
+	return s.pin.Read() == rpio.High, nil
+}
+
+// fakeSwitch only remembers whether it is on. It is useful for testing, or for
+// running without any hardware attached.
+type fakeSwitch struct {
+	mu sync.Mutex
+	on bool
+}
+
+func newFakeSwitch(chip string, pin int32) (Switch, error) {
+	return &fakeSwitch{}, nil
+}
+
+func (s *fakeSwitch) On() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.on = true
+	return nil
+}
+
+func (s *fakeSwitch) Off() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.on = false
+	return nil
+}
+
+func (s *fakeSwitch) State() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.on, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OpenSwitch(t *testing.T) {
+	defer CloseSwitches()
+
+	// Unknown types fail
+	_, err := OpenSwitch("DNE", "", 1, false)
+	assert.NotEqual(t, nil, err)
+
+	// The same pin returns the same switch
+	a, err := OpenSwitch("fake", "", 1, false)
+	assert.Equal(t, nil, err)
+	b, err := OpenSwitch("fake", "", 1, false)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, a, b)
+
+	assert.Equal(t, nil, a.On())
+	on, err := b.State()
+	assert.Equal(t, nil, err)
+	assert.True(t, on)
+
+	// An inverted switch drives the same pin the other way
+	inv, err := OpenSwitch("fake", "", 1, true)
+	assert.Equal(t, nil, err)
+	on, _ = inv.State()
+	assert.False(t, on)
+	assert.Equal(t, nil, inv.On())
+	on, _ = a.State()
+	assert.False(t, on)
+
+	// Closing forgets all switches
+	CloseSwitches()
+	c, err := OpenSwitch("fake", "", 1, false)
+	assert.Equal(t, nil, err)
+	on, _ = c.State()
+	assert.False(t, on)
+}
+
+func Test_SetSwitch(t *testing.T) {
+	sw, _ := newFakeSwitch("", 0)
+
+	assert.Equal(t, nil, SetSwitch(sw, true))
+	on, _ := sw.State()
+	assert.True(t, on)
+
+	assert.Equal(t, nil, SetSwitch(sw, false))
+	on, _ = sw.State()
+	assert.False(t, on)
+
+	// nil switches are ignored
+	assert.Equal(t, nil, SetSwitch(nil, true))
+}
+
+func Test_CheckSwitchType(t *testing.T) {
+	assert.Equal(t, nil, CheckSwitchType(""))
+	assert.Equal(t, nil, CheckSwitchType("gpiochip"))
+	assert.NotEqual(t, nil, CheckSwitchType("DNE"))
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"log"
 	"os"
 	"os/signal"
@@ -9,7 +8,6 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/stianeikeland/go-rpio"
 	"github.com/yryz/ds18b20"
 )
 
@@ -21,67 +19,137 @@ type State struct {
 	Heating bool      `json:"heating"`
 	When    time.Time `json:"reading"`
 	Changed time.Time `json:"changed"`
+	PID     PIDState  `json:"pid"`
+
+	CoolChanged time.Time `json:"coolchanged"`
+	CoolLockout float64   `json:"coollockout"`
+	HeatChanged time.Time `json:"heatchanged"`
+	HeatLockout float64   `json:"heatlockout"`
+
+	// Stopped is when the outputs were turned off by a shutdown. Cooling and Heating still say
+	// what was running, so the cycle can carry on once the minimum off times allow.
+	Stopped time.Time `json:"stopped"`
+
+	Profile *ProfileProgress `json:"profile"`
+
+	Fault    bool   `json:"fault"`
+	Failures int    `json:"failures"`
+	Error    string `json:"error"`
+
+	Raw     float64   `json:"raw"`
+	Samples []float64 `json:"samples"`
+
+	Cascade   bool    `json:"cascade"`
+	AirTemp   float64 `json:"airtemp"`
+	AirTarget float64 `json:"airtarget"`
+	AirFault  bool    `json:"airfault"`
 }
 
 // ReadTemperature will return the current temperature (in degrees celsius) of a specific sensor.
+// The sensor is read directly, rather than listing every device on the bus first.
 func ReadTemperature(id string) (float64, error) {
-	sensors, err := ds18b20.Sensors()
+	return ds18b20.Temperature(id)
+}
+
+// ProcessSensor uses the current temperature and last state to determine if changes need to be made to switches.
+func ProcessSensor(sensor Sensor, state State, temp float64) (State, error) {
+	prev := state
+	state = controlSensor(sensor, state, temp)
+
+	state, err := applyOutputs(sensor, prev, state)
 	if err != nil {
-		return 0.0, err
+		return state, err
 	}
 
-	for _, sensor := range sensors {
-		if sensor != id {
-			continue
-		}
-		return ds18b20.Temperature(sensor)
+	state.Temp = temp
+	state.Cascade = false
+	if sensor.Verbose {
+		log.Printf("%s Temp: %.2f, Cooling: %t, Heating: %t, Output: %.1f", sensor.Alias, state.Temp, state.Cooling, state.Heating, state.PID.Output)
 	}
 
-	return 0.0, errors.New("Sensor not found")
+	return state, nil
 }
 
-// PinSwitch is used to turn a pin on or off.
-// If invert is false, the pin will be high turned on, and low when turned off.
-func PinSwitch(pin rpio.Pin, on bool, invert bool) {
-	switch {
-	case on && !invert:
-		pin.High()
-	case on && invert:
-		pin.Low()
-	case !on && invert:
-		pin.High()
-	default:
-		pin.Low()
+// controlSensor decides which outputs should be on for a new temperature, using the sensor's mode
+func controlSensor(sensor Sensor, state State, temp float64) State {
+	state.When = time.Now()
+
+	// Readings are back, so any fault is over
+	if state.Fault {
+		log.Printf("%s Sensor recovered after %d failed reads", sensor.Alias, state.Failures)
 	}
-}
+	state.Fault = false
+	state.AirFault = false
+	state.Failures = 0
+	state.Error = ""
 
-// ProcessSensor uses the current temperature and last state to determine if changes need to be made to switches.
-func ProcessSensor(sensor Sensor, state State) (State, error) {
-	// Read the current temperature
-	temp, err := ReadTemperature(sensor.ID)
-	if err != nil {
-		log.Panicln(err)
+	switch sensor.Mode {
+	case ModePID:
+		return processPID(sensor, state, temp)
+	default:
+		return processHysteresis(sensor, state, temp)
 	}
+}
 
-	// When things reach the right temperature, set the duration to the future
-	// TODO: Better handling of this. Changed should maintain when the state changed.
-	//       Probably need a new flag in the State struct.
-	future := time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC)
+// applyOutputs protects compressors from short cycling, then sets the switches to match the new state
+func applyOutputs(sensor Sensor, prev State, state State) (State, error) {
+	prev, state = resumeOutputs(prev, state)
+	return setOutputs(sensor, prev, ProtectOutputs(sensor, prev, state, time.Now()))
+}
 
-	state.When = time.Now()
+// resumeOutputs carries on from a state restored after a shutdown. The outputs that were
+// running have really been off since it stopped, which the minimum off times count from.
+func resumeOutputs(prev State, state State) (State, State) {
+	if prev.Stopped.IsZero() {
+		return prev, state
+	}
+	if prev.Cooling {
+		prev.Cooling, prev.CoolChanged = false, prev.Stopped
+	}
+	if prev.Heating {
+		prev.Heating, prev.HeatChanged = false, prev.Stopped
+	}
+	prev.Stopped = time.Time{}
+	state.Stopped = time.Time{}
+	return prev, state
+}
 
-	var cpin rpio.Pin
-	var hpin rpio.Pin
-	// Initialize the pins
+// setOutputs sets the switches to match the new state
+func setOutputs(sensor Sensor, prev State, state State) (State, error) {
+	var cool, heat Switch
+	var err error
+	// Initialize the switches
 	if !sensor.CoolDisable {
-		cpin = rpio.Pin(sensor.CoolGPIO)
-		cpin.Output()
+		if cool, err = CoolSwitch(sensor); err != nil {
+			return prev, err
+		}
 	}
 
 	if !sensor.HeatDisable {
-		hpin = rpio.Pin(sensor.HeatGPIO)
-		hpin.Output()
+		if heat, err = HeatSwitch(sensor); err != nil {
+			return prev, err
+		}
+	}
+
+	// Apply the state to the switches
+	if err = SetSwitch(cool, state.Cooling); err != nil {
+		return state, err
+	}
+	if err = SetSwitch(heat, state.Heating); err != nil {
+		return state, err
 	}
+	countCycles(sensor.Alias, prev, state)
+
+	return state, nil
+}
+
+// processHysteresis switches heating or cooling on when the temperature leaves the band between
+// LowTemp and HighTemp, and keeps them on for HeatMinutes or CoolMinutes after it returns.
+func processHysteresis(sensor Sensor, state State, temp float64) State {
+	// When things reach the right temperature, set the duration to the future
+	// TODO: Better handling of this. Changed should maintain when the state changed.
+	//       Probably need a new flag in the State struct.
+	future := time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC)
 
 	// Calculate duration
 	duration := time.Since(state.Changed).Minutes()
@@ -91,26 +159,20 @@ func ProcessSensor(sensor Sensor, state State) (State, error) {
 		log.Println("Invalid state! Temperature is too high AND too low!")
 	// Temperature too high, start cooling
 	case temp > sensor.HighTemp && !sensor.CoolDisable:
-		PinSwitch(cpin, true, sensor.CoolInvert)
 		state.Cooling = true
-		PinSwitch(hpin, false, sensor.HeatInvert) // Ensure the heater is off
-		state.Heating = false
+		state.Heating = false // Ensure the heater is off
 		state.Changed = future
 	// Temperature too low, start heating
 	case temp < sensor.LowTemp && !sensor.HeatDisable:
-		PinSwitch(hpin, true, sensor.HeatInvert)
 		state.Heating = true
-		PinSwitch(cpin, false, sensor.CoolInvert) // Ensure the chiller is off
-		state.Cooling = false
+		state.Cooling = false // Ensure the chiller is off
 		state.Changed = future
 	// Temperature is good and cooling has been happening long enough
 	case temp < sensor.HighTemp && state.Cooling && duration > sensor.CoolMinutes:
-		PinSwitch(cpin, false, sensor.CoolInvert)
 		state.Cooling = false
 		state.Changed = future
 	// Temperature is good and heating has been happening long enough
 	case temp > sensor.LowTemp && state.Heating && duration > sensor.HeatMinutes:
-		PinSwitch(hpin, false, sensor.HeatInvert)
 		state.Heating = false
 		state.Changed = future
 	// Temperature just crossed high threshold
@@ -123,25 +185,32 @@ func ProcessSensor(sensor Sensor, state State) (State, error) {
 		break
 	}
 
-	state.Temp = temp
 	if sensor.Verbose {
-		log.Printf("%s Temp: %.2f, Cooling: %t, Heating: %t, Duration: %.1f", sensor.Alias, state.Temp, state.Cooling, state.Heating, duration)
+		log.Printf("%s Duration: %.1f", sensor.Alias, duration)
 	}
 
-	return state, nil
+	return state
 }
 
 // TurnOffSensor turns off all switches for an individual sensor
 func TurnOffSensor(sensor Sensor) {
 	if !sensor.CoolDisable {
-		cpin := rpio.Pin(sensor.CoolGPIO)
-		cpin.Output()
-		PinSwitch(cpin, false, sensor.CoolInvert)
+		cool, err := CoolSwitch(sensor)
+		if err == nil {
+			err = SetSwitch(cool, false)
+		}
+		if err != nil {
+			log.Println(err)
+		}
 	}
 	if !sensor.HeatDisable {
-		hpin := rpio.Pin(sensor.HeatGPIO)
-		hpin.Output()
-		PinSwitch(hpin, false, sensor.HeatInvert)
+		heat, err := HeatSwitch(sensor)
+		if err == nil {
+			err = SetSwitch(heat, false)
+		}
+		if err != nil {
+			log.Println(err)
+		}
 	}
 }
 
@@ -152,8 +221,49 @@ func TurnOffSensors(config Config) {
 	}
 }
 
+// TurnOffDisabled turns off the outputs that old had enabled and config disables, as nothing
+// switches a disabled output, and clears them in the states of their sensors.
+func TurnOffDisabled(old *Config, config *Config, states map[string]State) {
+	prev := make(map[string]Sensor)
+	for _, v := range old.Sensors {
+		prev[v.ID] = v
+	}
+
+	now := time.Now()
+	for _, v := range config.Sensors {
+		was, ok := prev[v.ID]
+		if !ok {
+			continue
+		}
+
+		// Switch off with the old settings, which still have these outputs enabled
+		off := was
+		off.CoolDisable = was.CoolDisable || !v.CoolDisable
+		off.HeatDisable = was.HeatDisable || !v.HeatDisable
+		if off.CoolDisable && off.HeatDisable {
+			continue
+		}
+		TurnOffSensor(off)
+
+		state, ok := states[v.ID]
+		if !ok {
+			continue
+		}
+		if !off.CoolDisable && state.Cooling {
+			state.Cooling = false
+			state.CoolChanged = now
+		}
+		if !off.HeatDisable && state.Heating {
+			state.Heating = false
+			state.HeatChanged = now
+		}
+		states[v.ID] = state
+	}
+}
+
 // RunThermostat monitors the temperature of the supplied sensor and does its best to keep it at the desired state.
-func RunThermostat(path string, sc chan<- State, wg *sync.WaitGroup) {
+// States are published to hub, along with the configuration each time it is loaded.
+func RunThermostat(path string, hub *Hub, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	// Load Config
@@ -161,77 +271,261 @@ func RunThermostat(path string, sc chan<- State, wg *sync.WaitGroup) {
 	if err != nil {
 		log.Panicln(err)
 	}
+	if simulateAll || config.Simulate {
+		log.Println("Simulating all sensors")
+		SimulateConfig(config)
+	}
 
-	// Prep for GPIO access
-	err = rpio.Open()
+	// Only one process may drive the outputs, whether it's running or autotuning
+	lock, err := LockOutputs(LockFilePath(path, config))
 	if err != nil {
 		log.Panicln(err)
 	}
-	defer rpio.Close()
-	defer TurnOffSensors(*config)
+	defer lock.Unlock()
+
+	// Restore the states saved before the last shutdown
+	stateFile, err := LoadStateFile(StateFilePath(path, config))
+	if err != nil {
+		log.Println("Unable to restore states:", err)
+	}
+
+	// Keep a history of each sensor for charts
+	history, err := NewHistoryWriter(HistoryPath(path, config))
+	if err != nil {
+		log.Println("Unable to record history:", err)
+	} else {
+		defer history.Flush()
+		defer hub.Handle(history.HandleEvent)()
+	}
+
+	// Send states to the configured sinks, like Influx
+	sinks := NewSinks(path, hub, config)
+	defer sinks.Close()
+	defer hub.Handle(sinks.HandleEvent)()
 
-	// Track if thermostats should run
-	run := true
+	// And MQTT
+	var mqttPublisher MQTTPublisher
+	defer mqttPublisher.Close()
+	defer hub.Handle(mqttPublisher.HandleEvent)()
+
+	hub.PublishConfig(config)
+
+	// Let someone know when things go wrong
+	alerter := NewAlerter(config)
+	defer alerter.Close()
+	alerter.Restart(time.Now())
+
+	// At shutdown, turn everything off before waiting on the sinks, MQTT and alerts, then release
+	// the switches. The config may be reloaded by then.
+	defer CloseSwitches()
+	defer func() {
+		TurnOffSensors(*config)
+		if err := stateFile.Stop(time.Now()); err != nil {
+			log.Println("Unable to save state:", err)
+		}
+	}()
 
 	// Start with everything off
 	TurnOffSensors(*config)
 
-	// Listen for SIGHUP to reload config
+	// Listen for SIGHUP to reload config. The new config is handed to the loop, which owns it.
+	reload := make(chan *Config, 1)
 	hup := make(chan os.Signal)
 	signal.Notify(hup, os.Interrupt, syscall.SIGHUP)
+	defer signal.Stop(hup)
 	go func() {
 		for {
 			<-hup
 			log.Println("Reloading configuration")
-			config, err = LoadConfig(path)
+			nc, err := LoadConfig(path)
 			if err != nil {
-				log.Panicln(err)
+				log.Println("Unable to reload configuration, keeping the old one:", err)
+				continue
+			}
+			if simulateAll || nc.Simulate {
+				SimulateConfig(nc)
 			}
+			reload <- nc
 		}
 	}()
 
 	// Listen for SIGTERM & SIGINT to quit
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-	signal.Notify(sig, os.Interrupt, syscall.SIGINT)
-	go func() {
-		<-sig
-		run = false
-	}()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(quit, os.Interrupt, syscall.SIGINT)
+	defer signal.Stop(quit)
+
+	// Read each sensor on its own schedule. Reads run in the background, so a slow sensor doesn't
+	// hold up the others, or quitting and reloading, and each sensor is processed once it is read.
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+	next := make(map[string]time.Time)
+	reading := make(map[string]bool)
+	results := make(chan sensorReadings)
+	stopped := make(chan struct{})
+	defer close(stopped)
 
 	states := make(map[string]State)
-	// For each sensor, run through the thermostat logic
-	for run {
-		for _, v := range config.Sensors {
-			// Create an initial state if there's not one already
-			if _, ok := states[v.ID]; !ok {
-				state := State{
-					Alias:   v.Alias,
-					When:    time.Now(),
-					Changed: time.Now(),
+	for {
+		select {
+		case <-quit:
+			log.Println("Shutting down thermostat")
+			return
+		case nc := <-reload:
+			TurnOffDisabled(config, nc, states)
+			config = nc
+			hub.PublishConfig(config)
+			alerter.SetConfig(config)
+			hub.PublishAlerts(alerter.Active())
+			next = make(map[string]time.Time) // Intervals may have changed
+		case r := <-results:
+			now := time.Now()
+			for _, v := range r.sensors {
+				delete(reading, v.ID)
+
+				// The sensor may have been changed or removed while it was read
+				v, ok := findSensor(config.Sensors, v.ID)
+				if !ok {
+					continue
+				}
+
+				// Create an initial state if there's not one already
+				if _, ok := states[v.ID]; !ok {
+					states[v.ID] = stateFile.Restore(v.ID, v.Alias, now)
+				}
+
+				sensor, state, retry := controlReading(v, states[v.ID], config.Profiles, r.readings, now)
+				if retry {
+					next[v.ID] = now.Add(RetryDelay(state.Failures))
 				}
 				states[v.ID] = state
-			}
 
-			// Process the sensor
-			states[v.ID], err = ProcessSensor(v, states[v.ID])
-			if err != nil {
-				log.Panicln(err)
-			}
+				if err := stateFile.Update(v.ID, states[v.ID]); err != nil {
+					log.Println("Unable to save state:", err)
+				}
 
-			// Write the returned state to the channel (don't block if nothing is available to listen)
-			select {
-			case sc <- states[v.ID]:
-				break
-			default:
-				break
+				hub.PublishState(sensor, states[v.ID])
+				if alerter.Check(sensor, states[v.ID], now) {
+					hub.PublishAlerts(alerter.Active())
+				}
+			}
+		case <-ticker.C:
+			// Find the sensors due to be read, leaving any being autotuned or still being read alone
+			now := time.Now()
+			var due []Sensor
+			for _, v := range config.Sensors {
+				if !now.Before(next[v.ID]) && !IsTuning(v.Alias) && !reading[v.ID] {
+					due = append(due, v)
+					reading[v.ID] = true
+					next[v.ID] = nextRead(now, SensorInterval(v, config))
+				}
 			}
 
-			if config.Influx.Addr != "" {
-				go WriteStateToInflux(states[v.ID], config.Influx)
+			timeout := ReadTimeout(config)
+			for _, group := range readGroups(due) {
+				go func(group []Sensor) {
+					r := sensorReadings{sensors: group, readings: ReadSensors(sensorsToRead(group), timeout)}
+					select {
+					case results <- r:
+					case <-stopped:
+					}
+				}(group)
 			}
 		}
 	}
+}
+
+// sensorReadings are the readings of a group of sensors, and of their air probes, keyed by sensor ID
+type sensorReadings struct {
+	sensors  []Sensor
+	readings map[string]Reading
+}
+
+// readGroups splits the sensors due to be read into groups that are read together. Sensors are
+// grouped with their air probes, so each probe is only read once.
+func readGroups(due []Sensor) [][]Sensor {
+	var groups [][]Sensor
+	group := make(map[string]int) // The group reading each ID
+	for _, v := range due {
+		i, ok := group[v.ID]
+		if !ok && v.AirID != "" {
+			i, ok = group[v.AirID]
+		}
+		if !ok {
+			i = len(groups)
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], v)
+		group[v.ID] = i
+		if v.AirID != "" {
+			group[v.AirID] = i
+		}
+	}
+	return groups
+}
+
+// sensorsToRead returns the sensors of a group along with their air probes, reading each probe once
+func sensorsToRead(group []Sensor) []Sensor {
+	reads := make(map[string]bool)
+	var all []Sensor
+	for _, v := range group {
+		reads[v.ID] = true
+		all = append(all, v)
+	}
+	for _, v := range group {
+		if v.AirID != "" && !reads[v.AirID] {
+			reads[v.AirID] = true
+			all = append(all, AirSensor(v))
+		}
+	}
+	return all
+}
+
+// findSensor returns the sensor with an ID
+func findSensor(sensors []Sensor, id string) (Sensor, bool) {
+	for _, v := range sensors {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return Sensor{}, false
+}
+
+// controlReading runs the control of a sensor on its latest readings, following its profile and
+// filtering the reading first. It returns the sensor as it was controlled, its new state, and
+// whether the read failed, so it should be retried sooner.
+func controlReading(v Sensor, state State, profiles []Profile, readings map[string]Reading, now time.Time) (Sensor, State, bool) {
+	// Follow the sensor's profile, if it has one
+	sensor, progress := ApplyProfile(v, profiles, now)
+	state.Profile = progress
+
+	// Filter out implausible readings, which are treated like failed reads
+	reading := readings[v.ID]
+	var temp float64
+	if reading.Err == nil {
+		state, temp, reading.Err = FilterReading(sensor, state, reading.Temp, now)
+	}
+
+	// Process the sensor, or fall back to its fail-safe if it couldn't be read. Without its air
+	// probe, a sensor is controlled on its own temperature, with cooling set by its fail-safe.
+	var err error
+	if reading.Err == nil && sensor.AirID != "" {
+		air, airErr := CheckAirReading(sensor, readings[sensor.AirID])
+		if airErr == nil {
+			state, err = ProcessCascade(sensor, state, temp, air)
+		} else {
+			log.Printf("%s Unable to read air probe: %v", sensor.Alias, airErr)
+			sensorReadErrors.WithLabelValues(sensor.Alias).Inc()
+			state, err = ProcessAirFault(sensor, state, temp, airErr)
+		}
+	} else if reading.Err == nil {
+		state, err = ProcessSensor(sensor, state, temp)
+	} else {
+		state, err = FailSensor(sensor, state, reading.Err)
+	}
+	if err != nil {
+		state = SwitchFault(sensor, state, err)
+	}
 
-	log.Println("Shutting down thermostat")
+	return sensor, state, reading.Err != nil
 }
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -12,3 +18,305 @@ func Test_ReadTemperature(t *testing.T) {
 	assert.Equal(t, 0.0, data)
 	assert.NotEqual(t, nil, err)
 }
+
+func Test_ProcessSensor(t *testing.T) {
+	defer CloseSwitches()
+
+	var temp float64
+	sensor := Sensor{
+		ID:          "test",
+		Alias:       "test",
+		SwitchType:  "fake",
+		HighTemp:    10,
+		LowTemp:     5,
+		HeatGPIO:    1,
+		HeatMinutes: 1,
+		CoolGPIO:    2,
+		CoolMinutes: 1,
+	}
+	cool, _ := CoolSwitch(sensor)
+	heat, _ := HeatSwitch(sensor)
+	state := State{Alias: "test", Changed: time.Now()}
+
+	// Too warm, start cooling
+	temp = 12
+	state, err := ProcessSensor(sensor, state, temp)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 12.0, state.Temp)
+	assert.True(t, state.Cooling)
+	assert.False(t, state.Heating)
+	on, _ := cool.State()
+	assert.True(t, on)
+
+	// Crossed the threshold, keep cooling for CoolMinutes
+	temp = 9
+	state, err = ProcessSensor(sensor, state, temp)
+	assert.Equal(t, nil, err)
+	assert.True(t, state.Cooling)
+
+	// Cooled long enough
+	state.Changed = time.Now().Add(-2 * time.Minute)
+	state, err = ProcessSensor(sensor, state, temp)
+	assert.Equal(t, nil, err)
+	assert.False(t, state.Cooling)
+	on, _ = cool.State()
+	assert.False(t, on)
+
+	// Too cold, start heating
+	temp = 2
+	state, err = ProcessSensor(sensor, state, temp)
+	assert.Equal(t, nil, err)
+	assert.True(t, state.Heating)
+	on, _ = heat.State()
+	assert.True(t, on)
+
+	// Heating disabled leaves the heater alone
+	sensor.HeatDisable = true
+	state = State{Alias: "test", Changed: time.Now()}
+	heat.Off()
+	state, err = ProcessSensor(sensor, state, temp)
+	assert.Equal(t, nil, err)
+	assert.False(t, state.Heating)
+	on, _ = heat.State()
+	assert.False(t, on)
+}
+
+func Test_ProcessSensorHeldOn(t *testing.T) {
+	defer CloseSwitches()
+
+	sensor := Sensor{
+		Alias:         "held",
+		SwitchType:    "fake",
+		GPIOChip:      "held",
+		HighTemp:      10,
+		LowTemp:       5,
+		CoolGPIO:      2,
+		CoolMinutes:   2,
+		CoolOnMinutes: 10,
+		HeatDisable:   true,
+	}
+	cool, _ := CoolSwitch(sensor)
+
+	// The band was crossed 3 minutes ago, but the chiller has to stay on for 10
+	now := time.Now()
+	crossed := now.Add(-3 * time.Minute)
+	state := State{Alias: "held", Cooling: true, Changed: crossed, CoolChanged: now.Add(-5 * time.Minute)}
+	state, err := ProcessSensor(sensor, state, 8)
+	assert.Equal(t, nil, err)
+	assert.True(t, state.Cooling)
+	assert.Equal(t, crossed, state.Changed)
+
+	// Later readings keep the time the band was crossed
+	state, err = ProcessSensor(sensor, state, 8)
+	assert.Equal(t, nil, err)
+	assert.True(t, state.Cooling)
+	assert.Equal(t, crossed, state.Changed)
+
+	// So the chiller turns off as soon as the minimum on time is up, not CoolMinutes later
+	state.CoolChanged = now.Add(-11 * time.Minute)
+	state, err = ProcessSensor(sensor, state, 8)
+	assert.Equal(t, nil, err)
+	assert.False(t, state.Cooling)
+	on, _ := cool.State()
+	assert.False(t, on)
+}
+
+func Test_ProcessSensorResume(t *testing.T) {
+	defer CloseSwitches()
+
+	sensor := Sensor{
+		Alias:          "resume",
+		SwitchType:     "fake",
+		GPIOChip:       "resume",
+		HighTemp:       10,
+		LowTemp:        5,
+		CoolGPIO:       2,
+		CoolMinutes:    10,
+		CoolOffMinutes: 5,
+		HeatDisable:    true,
+	}
+	cool, _ := CoolSwitch(sensor)
+
+	// A restart during the cooling minutes carries on with the cycle, once the chiller has been
+	// off for long enough
+	crossed := time.Now().Add(-2 * time.Minute)
+	restored := State{Alias: "resume", Cooling: true, Changed: crossed, CoolChanged: crossed.Add(-time.Hour), Stopped: time.Now().Add(-time.Minute)}
+	state, err := ProcessSensor(sensor, restored, 8)
+	assert.Equal(t, nil, err)
+	assert.False(t, state.Cooling)
+	assert.True(t, state.CoolLockout > 200)
+	assert.True(t, state.Stopped.IsZero())
+	on, _ := cool.State()
+	assert.False(t, on)
+
+	restored.Stopped = time.Now().Add(-6 * time.Minute)
+	state, err = ProcessSensor(sensor, restored, 8)
+	assert.Equal(t, nil, err)
+	assert.True(t, state.Cooling)
+	assert.Equal(t, crossed, state.Changed)
+	on, _ = cool.State()
+	assert.True(t, on)
+}
+
+func Test_TurnOffSensor(t *testing.T) {
+	defer CloseSwitches()
+
+	sensor := Sensor{SwitchType: "fake", HeatGPIO: 1, CoolGPIO: 2, CoolInvert: true}
+	cool, _ := CoolSwitch(sensor)
+	heat, _ := HeatSwitch(sensor)
+	cool.On()
+	heat.On()
+
+	TurnOffSensor(sensor)
+	on, _ := cool.State()
+	assert.False(t, on)
+	on, _ = heat.State()
+	assert.False(t, on)
+}
+
+func Test_TurnOffDisabled(t *testing.T) {
+	defer CloseSwitches()
+
+	old := &Config{Sensors: []Sensor{
+		Sensor{ID: "foo", SwitchType: "fake", GPIOChip: "disabled", HeatGPIO: 1, CoolGPIO: 2},
+	}}
+	cool, _ := CoolSwitch(old.Sensors[0])
+	heat, _ := HeatSwitch(old.Sensors[0])
+	cool.On()
+	heat.On()
+	states := map[string]State{"foo": State{Cooling: true, Heating: true}}
+
+	// Disabling cooling turns off the chiller, and leaves the heater alone
+	config := &Config{Sensors: []Sensor{old.Sensors[0]}}
+	config.Sensors[0].CoolDisable = true
+	TurnOffDisabled(old, config, states)
+	on, _ := cool.State()
+	assert.False(t, on)
+	on, _ = heat.State()
+	assert.True(t, on)
+	assert.False(t, states["foo"].Cooling)
+	assert.False(t, states["foo"].CoolChanged.IsZero())
+	assert.True(t, states["foo"].Heating)
+
+	// Outputs that were already disabled aren't touched
+	cool.On()
+	TurnOffDisabled(config, config, states)
+	on, _ = cool.State()
+	assert.True(t, on)
+	on, _ = heat.State()
+	assert.True(t, on)
+}
+
+func Test_RunThermostat(t *testing.T) {
+	delay := simulatedReadDelay
+	simulatedReadDelay = 0
+	defer func() { simulatedReadDelay = delay }()
+
+	dir, err := ioutil.TempDir("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+
+	config := Config{
+		Sensors:  []Sensor{Sensor{ID: "run", Alias: "run", HighTemp: 20, LowTemp: 10, CoolGPIO: 1, HeatGPIO: 2, Interval: 0.1}},
+		Simulate: true,
+	}
+	assert.Equal(t, nil, SaveConfig(path, config))
+
+	hub := NewHub()
+	events, unsubscribe := hub.Subscribe()
+	defer unsubscribe()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go RunThermostat(path, hub, &wg)
+
+	// The config is published, then states as the loop runs
+	next := func(kind string) Event {
+		for {
+			select {
+			case e := <-events:
+				if e.Type == kind {
+					return e
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for a", kind, "event")
+			}
+		}
+	}
+	assert.Equal(t, "run", next(EventConfig).Config.Sensors[0].Alias)
+	e := next(EventState)
+	assert.Equal(t, "run", e.State.Alias)
+	assert.Equal(t, 20.0, e.Sensor.HighTemp)
+
+	// Reloading hands the new config to the loop
+	config.Sensors[0].HighTemp = 25
+	assert.Equal(t, nil, SaveConfig(path, config))
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	assert.Equal(t, 25.0, next(EventConfig).Config.Sensors[0].HighTemp)
+	assert.Equal(t, 25.0, next(EventState).Sensor.HighTemp)
+
+	// And it shuts down cleanly
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	wg.Wait()
+	_, ok := hub.State("run")
+	assert.True(t, ok)
+}
+
+func Test_RunThermostatSlowSensor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+
+	slow := make(blockingSource)
+	defer close(slow)
+	RegisterSource("runslow", func(sensor Sensor) (TemperatureSource, error) {
+		return slow, nil
+	})
+	RegisterSource("runfast", func(sensor Sensor) (TemperatureSource, error) {
+		return fixedSource(15), nil
+	})
+	config := Config{
+		Sensors: []Sensor{
+			Sensor{ID: "slow", Alias: "slow", Type: "runslow", SwitchType: "fake", GPIOChip: "slow", HighTemp: 20, LowTemp: 10, CoolGPIO: 1, HeatGPIO: 2, Interval: 0.1},
+			Sensor{ID: "fast", Alias: "fast", Type: "runfast", SwitchType: "fake", GPIOChip: "fast", HighTemp: 20, LowTemp: 10, CoolGPIO: 1, HeatGPIO: 2, Interval: 0.1},
+		},
+		ReadTimeout: 60,
+	}
+	assert.Equal(t, nil, SaveConfig(path, config))
+
+	hub := NewHub()
+	events, unsubscribe := hub.Subscribe()
+	defer unsubscribe()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go RunThermostat(path, hub, &wg)
+
+	// The fast sensor carries on while the slow one is still being read
+	for n := 0; n < 3; {
+		select {
+		case e := <-events:
+			assert.NotEqual(t, "slow", e.State.Alias)
+			if e.Type == EventState {
+				n++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the fast sensor")
+		}
+	}
+
+	// And quitting doesn't wait for the read
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the thermostat to quit")
+	}
+}
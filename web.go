@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -14,17 +15,28 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/gobuffalo/packr"
-	"github.com/jinzhu/copier"
 )
 
+// webConfigMu guards the configuration shared by the web handlers, which is replaced when
+// the configuration is reloaded
+var webConfigMu sync.RWMutex
+
+// webConfig returns a copy of the configuration shared by the web handlers
+func webConfig(config *Config) Config {
+	webConfigMu.RLock()
+	defer webConfigMu.RUnlock()
+	return *config
+}
+
 // PingHandler responds to GET requests with the message "pong".
 func PingHandler(c *gin.Context) {
 	c.String(http.StatusOK, "pong")
 }
 
 // ConfigHandler responds to GET requests with the current configuration.
-func ConfigHandler(config *Config) gin.HandlerFunc {
+func ConfigHandler(shared *Config) gin.HandlerFunc {
 	fn := func(c *gin.Context) {
+		config := webConfig(shared)
 		if c.Param("alias") != "/" && c.Param("alias") != "" {
 			alias := c.Param("alias")[1:]
 			found := false
@@ -40,7 +52,7 @@ func ConfigHandler(config *Config) gin.HandlerFunc {
 		} else if c.Param("alias") == "/" {
 			c.JSON(http.StatusOK, config.Sensors)
 		} else {
-			config.Users = nil // Never return the users in GET requests
+			config.Users = nil // Never return the users in GET requests, only this copy is changed
 			c.JSON(http.StatusOK, config)
 		}
 	}
@@ -58,7 +70,7 @@ func UpdateSensorsHandler(c *gin.Context) {
 
 	for _, s := range sensors {
 		if err := UpdateSensorConfig(s); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 	}
@@ -67,11 +79,11 @@ func UpdateSensorsHandler(c *gin.Context) {
 }
 
 // StatusHandler responds to GET requests with the current status of a sensor
-func StatusHandler(states *map[string]State) gin.HandlerFunc {
+func StatusHandler(hub *Hub) gin.HandlerFunc {
 	fn := func(c *gin.Context) {
 		if c.Param("alias") == "/" || c.Param("alias") == "" {
-			c.JSON(http.StatusOK, states)
-		} else if val, ok := (*states)[c.Param("alias")[1:]]; ok {
+			c.JSON(http.StatusOK, hub.States())
+		} else if val, ok := hub.State(c.Param("alias")[1:]); ok {
 			c.JSON(http.StatusOK, val)
 		} else {
 			c.String(http.StatusNotFound, "Not found")
@@ -81,14 +93,284 @@ func StatusHandler(states *map[string]State) gin.HandlerFunc {
 	return gin.HandlerFunc(fn)
 }
 
+// AutotuneHandler responds to GET requests with the status of the last autotune of a sensor
+func AutotuneHandler(c *gin.Context) {
+	if status, ok := GetAutotuneStatus(c.Param("alias")); ok {
+		c.JSON(http.StatusOK, status)
+	} else {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+	}
+}
+
+// StartAutotuneHandler responds to POST requests by starting an autotune of a sensor
+func StartAutotuneHandler(shared *Config) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		config := webConfig(shared)
+		var sensor *Sensor
+		for i := range config.Sensors {
+			if config.Sensors[i].Alias == c.Param("alias") {
+				sensor = &config.Sensors[i]
+			}
+		}
+		if sensor == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+			return
+		}
+
+		var req struct {
+			AutotuneOptions
+			Apply bool `json:"apply"`
+		}
+		req.AutotuneOptions = DefaultAutotuneOptions(*sensor)
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		run := *sensor
+		if simulateAll || config.Simulate {
+			run = SimulateSensor(run)
+		}
+
+		if err := StartAutotune(run, req.AutotuneOptions, req.Apply); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"status": "started"})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// StopAutotuneHandler responds to DELETE requests by stopping the autotune of a sensor
+func StopAutotuneHandler(c *gin.Context) {
+	if err := StopAutotune(c.Param("alias")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "stopping"})
+}
+
+// ProfilesHandler responds to GET requests with the configured profiles
+func ProfilesHandler(shared *Config) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		config := webConfig(shared)
+		if name := c.Param("name"); name != "" {
+			if p, ok := FindProfile(config.Profiles, name); ok {
+				c.JSON(http.StatusOK, p)
+			} else {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+			}
+		} else if config.Profiles == nil {
+			c.JSON(http.StatusOK, []Profile{})
+		} else {
+			c.JSON(http.StatusOK, config.Profiles)
+		}
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// UpdateProfileHandler responds to POST requests by adding or replacing a profile
+func UpdateProfileHandler(c *gin.Context) {
+	var p Profile
+
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := UpdateProfileConfig(p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "updated"})
+}
+
+// DeleteProfileHandler responds to DELETE requests by removing a profile
+func DeleteProfileHandler(c *gin.Context) {
+	if err := DeleteProfileConfig(c.Param("name")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// StartProfileHandler responds to PUT requests by starting a profile on a sensor
+func StartProfileHandler(c *gin.Context) {
+	if err := StartProfile(c.Param("name"), c.Param("alias"), time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "started"})
+}
+
+// StopProfileHandler responds to DELETE requests by stopping the profile of a sensor
+func StopProfileHandler(c *gin.Context) {
+	err := StopProfile(c.Param("name"), c.Param("alias"))
+	switch err {
+	case nil:
+	case ErrSensorNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case ErrProfileNotRunning:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "stopped"})
+}
+
+// parseHistoryTime reads a time from a query string, as either RFC 3339 or unix seconds
+func parseHistoryTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseHistoryStep reads a step from a query string, as either a duration like 5m or seconds
+func parseHistoryStep(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// HistoryHandler responds to GET requests with the recorded history of a sensor. The range
+// defaults to the last 24 hours.
+func HistoryHandler(shared *Config) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		config := webConfig(shared)
+		found := false
+		for _, s := range config.Sensors {
+			if s.Alias == c.Param("alias") {
+				found = true
+			}
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+			return
+		}
+
+		now := time.Now()
+		from, err := parseHistoryTime(c.Query("from"), now.Add(-24*time.Hour))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		to, err := parseHistoryTime(c.Query("to"), now)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		step, err := parseHistoryStep(c.Query("step"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		points, err := ReadHistory(HistoryPath(configFilePath, &config), c.Param("alias"), from, to, step)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if points == nil {
+			points = []HistoryPoint{}
+		}
+
+		c.JSON(http.StatusOK, points)
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// AlertsHandler responds to GET requests with the active alerts
+func AlertsHandler(hub *Hub) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		c.JSON(http.StatusOK, hub.Alerts())
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// HealthHandler responds to GET requests with the health of the writers to databases
+func HealthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, GetWriterHealth())
+}
+
+// eventKeepAlive is how often an idle event stream sends a comment, so proxies don't close it
+const eventKeepAlive = 30 * time.Second
+
+// EventsHandler responds to GET requests with a stream of server-sent events. Each new state
+// is sent as a state event, each configuration reload as a config event, and the active alerts
+// as an alerts event whenever they change. Streams end when shutdown is closed, as the server
+// doesn't end them itself.
+func EventsHandler(hub *Hub, shutdown <-chan struct{}) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		ch, unsubscribe := hub.Subscribe()
+		defer unsubscribe()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+
+		// Send the headers straight away, so clients know they're subscribed
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Writer.WriteHeaderNow()
+		c.Writer.Flush()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case e := <-ch:
+				switch e.Type {
+				case EventState:
+					c.SSEvent(e.Type, e.State)
+				case EventConfig:
+					c.SSEvent(e.Type, e.Config.Sensors) // Never send the users
+				case EventAlerts:
+					c.SSEvent(e.Type, e.Alerts)
+				}
+			case <-keepAlive.C:
+				io.WriteString(w, ": keepalive\n\n")
+			case <-c.Request.Context().Done():
+				return false
+			case <-shutdown:
+				return false
+			}
+			return true
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
 // GetBox returns a packr.Box object representing the static files.
 func GetBox() packr.Box {
 	return packr.NewBox("./html")
 }
 
 // JSConfigHandler responds to GET requests with the current configuration for the JS app
-func JSConfigHandler(config *Config) gin.HandlerFunc {
+func JSConfigHandler(shared *Config) gin.HandlerFunc {
 	fn := func(c *gin.Context) {
+		config := webConfig(shared)
 		jsconfig := "var jsconfig={baseurl:\"" + config.BaseURL + "\",fahrenheit:" + strconv.FormatBool(config.DisplayFahrenheit) + "};"
 		c.String(http.StatusOK, jsconfig)
 	}
@@ -105,16 +387,17 @@ func VersionHandler(c *gin.Context) {
 }
 
 // AppHandler returns 301 to /app
-func AppHandler(config *Config) gin.HandlerFunc {
+func AppHandler(shared *Config) gin.HandlerFunc {
 	fn := func(c *gin.Context) {
+		config := webConfig(shared)
 		c.Redirect(http.StatusPermanentRedirect, config.BaseURL+"/app/")
 	}
 
 	return fn
 }
 
-// SetupRouter initializes the gin router.
-func SetupRouter(config *Config, states *map[string]State) *gin.Engine {
+// SetupRouter initializes the gin router. Event streams are ended when shutdown is closed.
+func SetupRouter(config *Config, hub *Hub, shutdown <-chan struct{}) *gin.Engine {
 	// If not specified, put gin in release mode
 	if _, ok := os.LookupEnv("GIN_MODE"); !ok {
 		gin.SetMode(gin.ReleaseMode)
@@ -143,12 +426,35 @@ func SetupRouter(config *Config, states *map[string]State) *gin.Engine {
 		api.Use(BasicAuth(GetGinAccounts(config)))
 	}
 
-	api.GET("/status", StatusHandler(states))
-	api.GET("/status/*alias", StatusHandler(states))
+	api.GET("/status", StatusHandler(hub))
+	api.GET("/status/*alias", StatusHandler(hub))
+	api.GET("/events", EventsHandler(hub, shutdown))
+	api.GET("/alerts", AlertsHandler(hub))
+	api.GET("/health", HealthHandler)
 	api.GET("/version", VersionHandler)
 	api.GET("/config", ConfigHandler(config))
 	api.GET("/config/sensors/*alias", ConfigHandler(config))
 	api.POST("/config/sensors", UpdateSensorsHandler)
+	api.GET("/profiles", ProfilesHandler(config))
+	api.GET("/profiles/:name", ProfilesHandler(config))
+	api.POST("/profiles", UpdateProfileHandler)
+	api.DELETE("/profiles/:name", DeleteProfileHandler)
+	api.PUT("/profiles/:name/sensors/:alias", StartProfileHandler)
+	api.DELETE("/profiles/:name/sensors/:alias", StopProfileHandler)
+	api.GET("/history/:alias", HistoryHandler(config))
+	api.GET("/autotune/:alias", AutotuneHandler)
+	api.POST("/autotune/:alias", StartAutotuneHandler(config))
+	api.DELETE("/autotune/:alias", StopAutotuneHandler)
+
+	// Prometheus metrics, protected like the API unless they have users of their own or are public
+	switch {
+	case len(config.Metrics.Users) > 0:
+		r.GET("/metrics", BasicAuth(usersToAccounts(config.Metrics.Users)), MetricsHandler(hub))
+	case config.Metrics.Public || len(config.Users) == 0:
+		r.GET("/metrics", MetricsHandler(hub))
+	default:
+		r.GET("/metrics", BasicAuth(GetGinAccounts(config)), MetricsHandler(hub))
+	}
 
 	// App
 	r.GET("/jsconfig.js", JSConfigHandler(config))
@@ -167,54 +473,55 @@ func reloadWebConfig(c *Config, p string) error {
 		return err
 	}
 
-	copier.Copy(&c, &nc)
+	webConfigMu.Lock()
+	*c = *nc
+	webConfigMu.Unlock()
 
 	return nil
 }
 
 // GetGinAccounts returns a gin.Accounts struct with values pulled from a Config struct
 func GetGinAccounts(config *Config) gin.Accounts {
+	return usersToAccounts(config.Users)
+}
+
+// usersToAccounts returns a gin.Accounts struct for a list of users
+func usersToAccounts(users []User) gin.Accounts {
 	a := make(gin.Accounts)
-	for _, user := range config.Users {
+	for _, user := range users {
 		a[user.Name] = user.Password
 	}
 	return a
 }
 
-// RunWeb launches a web server. sc is used to update the states from the Thermostats.
-func RunWeb(configpath string, sc <-chan State, wg *sync.WaitGroup) {
-	// Update sensor states when a new state comes back from the thermostat.
-	states := make(map[string]State)
-	go func() {
-		for {
-			s := <-sc
-			states[s.Alias] = s
-		}
-	}()
-
+// RunWeb launches a web server. hub provides the states from the Thermostats.
+func RunWeb(configpath string, hub *Hub, wg *sync.WaitGroup) {
 	config, err := LoadConfig(configpath)
 	if err != nil {
 		log.Panicln(err)
 	}
+
+	// Launch the web server
+	shutdown := make(chan struct{})
+	r := SetupRouter(config, hub, shutdown)
+	srv := &http.Server{
+		Addr:    config.ListenAddr,
+		Handler: r,
+	}
+	srv.RegisterOnShutdown(func() { close(shutdown) })
+
+	// Reload only once the router has read the configuration
 	hup := make(chan os.Signal)
 	signal.Notify(hup, os.Interrupt, syscall.SIGHUP)
 	go func() {
 		for {
 			<-hup
-			err = reloadWebConfig(config, configpath)
-			if err != nil {
-				log.Panicln(err)
+			if err := reloadWebConfig(config, configpath); err != nil {
+				log.Println("Unable to reload configuration, keeping the old one:", err)
 			}
 		}
 	}()
 
-	// Launch the web server
-	r := SetupRouter(config, &states)
-	srv := &http.Server{
-		Addr:    config.ListenAddr,
-		Handler: r,
-	}
-
 	go func() {
 		// service connections
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -232,7 +539,7 @@ func RunWeb(configpath string, sc <-chan State, wg *sync.WaitGroup) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server Shutdown:", err)
+		log.Println("Server Shutdown:", err)
 	}
 	log.Println("Server exiting")
 	wg.Done()
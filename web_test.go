@@ -3,15 +3,19 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -36,7 +40,7 @@ func Test_ConfigHandler(t *testing.T) {
 				Alias: "foo",
 			},
 		},
-		Users:      []User{},
+		Users:      []User{User{Name: "mike", Password: "12345"}},
 		ListenAddr: ":8080",
 	}
 
@@ -44,13 +48,16 @@ func Test_ConfigHandler(t *testing.T) {
 	r.GET("/config", ConfigHandler(&testConfig))
 	r.GET("/config/sensors/*alias", ConfigHandler(&testConfig))
 
-	// Validate GET request /config
+	// Validate GET request /config, which leaves out the users without removing them
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/config", nil)
 	r.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusOK, w.Code)
-	jc, _ := json.Marshal(testConfig)
+	redacted := testConfig
+	redacted.Users = nil
+	jc, _ := json.Marshal(redacted)
 	assert.Equal(t, string(jc), w.Body.String())
+	assert.Equal(t, 1, len(testConfig.Users))
 
 	// Validate GET request to /config/sensors
 	w = httptest.NewRecorder()
@@ -122,6 +129,16 @@ func Test_UpdateSensorsHandler(t *testing.T) {
 	r.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusOK, w.Code)
 
+	// Test an invalid sensor isn't saved
+	j, _ = json.Marshal([]Sensor{Sensor{Alias: "bar", Mode: "bogus"}})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/config/sensors", bytes.NewReader(j))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "bogus"))
+	config, _ := LoadConfig(tmpfile.Name())
+	assert.Equal(t, "", config.Sensors[0].Mode)
+
 	// Test internal server error
 	configFilePath = "/this/does/not/exist"
 	j, _ = json.Marshal(newSensor)
@@ -134,12 +151,13 @@ func Test_UpdateSensorsHandler(t *testing.T) {
 }
 
 func Test_StatusHandler(t *testing.T) {
-	states := make(map[string]State)
-	states["foo"] = State{Temp: 5}
+	hub := NewHub()
+	hub.PublishState(Sensor{}, State{Alias: "foo", Temp: 5})
+	states := hub.States()
 
 	r := gin.New()
-	r.GET("/status", StatusHandler(&states))
-	r.GET("/status/*alias", StatusHandler(&states))
+	r.GET("/status", StatusHandler(hub))
+	r.GET("/status/*alias", StatusHandler(hub))
 
 	// Test all states retrieval
 	j, _ := (json.Marshal(states))
@@ -164,6 +182,47 @@ func Test_StatusHandler(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
 
+func Test_AlertsHandler(t *testing.T) {
+	hub := NewHub()
+
+	r := gin.New()
+	r.GET("/alerts", AlertsHandler(hub))
+
+	// No alerts is an empty list
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/alerts", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]", w.Body.String())
+
+	alerts := []Alert{Alert{Rule: "band", Alias: "foo", Message: "foo is too warm"}}
+	hub.PublishAlerts(alerts)
+	j, _ := json.Marshal(alerts)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/alerts", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(j), w.Body.String())
+}
+
+func Test_HealthHandler(t *testing.T) {
+	SetWriterHealth("test", WriterHealth{Enabled: true, Spooled: 3, LastError: "unreachable"})
+
+	r := gin.New()
+	r.GET("/health", HealthHandler)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/health", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var health map[string]WriterHealth
+	assert.Equal(t, nil, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.Equal(t, 3, health["test"].Spooled)
+	assert.Equal(t, "unreachable", health["test"].LastError)
+	assert.False(t, health["test"].Healthy)
+}
+
 func Test_JSConfigHandler(t *testing.T) {
 	testConfig := Config{
 		BaseURL:           "http://localhost:8080",
@@ -225,9 +284,6 @@ func Test_SetupRouter(t *testing.T) {
 		BaseURL:    "http://localhost:8080",
 	}
 
-	states := make(map[string]State)
-	states["foo"] = State{}
-
 	// Create a temp file
 	tmpfile, err := ioutil.TempFile("", "tempgopher")
 	assert.Equal(t, nil, err)
@@ -235,8 +291,48 @@ func Test_SetupRouter(t *testing.T) {
 	configFilePath = tmpfile.Name()
 
 	// Setup a router
-	r := SetupRouter(&testConfig, &states)
+	r := SetupRouter(&testConfig, NewHub(), make(chan struct{}))
 	assert.IsType(t, gin.New(), r)
+
+	// Metrics don't need authentication when the API doesn't
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Otherwise they need the API's users
+	testConfig.Users = []User{User{Name: "api", Password: "api"}}
+	r = SetupRouter(&testConfig, NewHub(), make(chan struct{}))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = httptest.NewRecorder()
+	req.SetBasicAuth("api", "api")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Unless they're public
+	testConfig.Metrics.Public = true
+	r = SetupRouter(&testConfig, NewHub(), make(chan struct{}))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	testConfig.Metrics.Public = false
+
+	// Or have users of their own, separate from the API's
+	testConfig.Metrics.Users = []User{User{Name: "prometheus", Password: "scrape"}}
+	r = SetupRouter(&testConfig, NewHub(), make(chan struct{}))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	req.SetBasicAuth("api", "api")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = httptest.NewRecorder()
+	req.SetBasicAuth("prometheus", "scrape")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
 }
 
 func Test_GetGinAccounts(t *testing.T) {
@@ -283,8 +379,315 @@ func Test_reloadWebConfig(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, testConfig, newConfig)
 
+	// Test that handlers can be served while reloading
+	r := gin.New()
+	r.GET("/config", ConfigHandler(&testConfig))
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			reloadWebConfig(&testConfig, tmpfile.Name())
+		}
+		done <- true
+	}()
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/config", nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	<-done
+
 	// Test the error case
 	err = reloadWebConfig(&testConfig, "/does/not/exist")
 	assert.NotEqual(t, nil, err)
 
 }
+
+func Test_AutotuneHandlers(t *testing.T) {
+	defer CloseSwitches()
+
+	RegisterSource("autotuneweb", func(sensor Sensor) (TemperatureSource, error) {
+		return fixedSource(15), nil
+	})
+	testConfig := Config{
+		Sensors: []Sensor{
+			Sensor{ID: "web", Alias: "web", Type: "autotuneweb", SwitchType: "fake", HeatGPIO: 1, CoolGPIO: 2},
+		},
+	}
+
+	r := gin.New()
+	r.GET("/autotune/:alias", AutotuneHandler)
+	r.POST("/autotune/:alias", StartAutotuneHandler(&testConfig))
+	r.DELETE("/autotune/:alias", StopAutotuneHandler)
+
+	// Test not found
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/autotune/DNE", nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	// Test bad request
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/autotune/web", bytes.NewBufferString("foobar"))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Test starting
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/autotune/web", bytes.NewBufferString(`{"setpoint": 18, "cycles": 2}`))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	// Test starting twice
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/autotune/web", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// Test status
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/autotune/web", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var status AutotuneStatus
+	json.Unmarshal(w.Body.Bytes(), &status)
+	assert.Equal(t, "web", status.Alias)
+	assert.True(t, status.Running)
+
+	// Test stopping
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/autotune/web", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func Test_ProfilesHandler(t *testing.T) {
+	testConfig := Config{}
+
+	r := gin.New()
+	r.GET("/profiles", ProfilesHandler(&testConfig))
+	r.GET("/profiles/:name", ProfilesHandler(&testConfig))
+
+	// Test empty list
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/profiles", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]", w.Body.String())
+
+	// Test list
+	testConfig.Profiles = []Profile{testProfile}
+	j, _ := json.Marshal(testConfig.Profiles)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/profiles", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(j), w.Body.String())
+
+	// Test specific profile
+	j, _ = json.Marshal(testProfile)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/profiles/ale", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(j), w.Body.String())
+
+	// Test not found
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/profiles/DNE", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func Test_ProfileUpdateHandlers(t *testing.T) {
+	r := gin.New()
+	r.POST("/profiles", UpdateProfileHandler)
+	r.DELETE("/profiles/:name", DeleteProfileHandler)
+	r.PUT("/profiles/:name/sensors/:alias", StartProfileHandler)
+	r.DELETE("/profiles/:name/sensors/:alias", StopProfileHandler)
+
+	testConfig := Config{
+		Sensors:    []Sensor{Sensor{ID: "foo", Alias: "foo"}},
+		Users:      []User{},
+		ListenAddr: ":8080",
+	}
+	tmpfile, err := ioutil.TempFile("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.Remove(tmpfile.Name())
+	configFilePath = tmpfile.Name()
+	SaveConfig(tmpfile.Name(), testConfig)
+
+	sig := make(chan os.Signal, 10)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	// Test bad request
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/profiles", bytes.NewBufferString("foobar"))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Test a POST call
+	j, _ := json.Marshal(testProfile)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/profiles", bytes.NewBuffer(j))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Test starting and stopping
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/profiles/ale/sensors/foo", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/profiles/ale/sensors/DNE", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/profiles/lager/sensors/foo", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/profiles/ale/sensors/DNE", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/profiles/ale/sensors/foo", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Test deleting
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/profiles/ale", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/profiles/ale", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func Test_HistoryHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tempgopher")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	testConfig := Config{
+		Sensors:    []Sensor{Sensor{ID: "foo", Alias: "foo", HighTemp: 20, LowTemp: 10}},
+		HistoryDir: dir,
+	}
+
+	hw, err := NewHistoryWriter(dir)
+	assert.Equal(t, nil, err)
+	start := time.Now().Add(-time.Hour).Truncate(time.Hour)
+	for i := 0; i < 10; i++ {
+		hw.Record(testConfig.Sensors[0], State{When: start.Add(time.Duration(i) * time.Minute), Temp: 15, Cooling: true})
+	}
+	hw.Flush()
+
+	r := gin.New()
+	r.GET("/history/:alias", HistoryHandler(&testConfig))
+
+	// Test not found
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/history/DNE", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Test bad parameters
+	for _, query := range []string{"from=foo", "to=foo", "step=foo", "from=2000&to=1000"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/history/foo?"+query, nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+
+	// Test the default range
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/history/foo", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var points []HistoryPoint
+	json.Unmarshal(w.Body.Bytes(), &points)
+	assert.Equal(t, 10, len(points))
+	assert.Equal(t, 15.0, points[0].Temp)
+	assert.Equal(t, 1.0, points[0].Cooling)
+	assert.Equal(t, 20.0, points[0].High)
+
+	// Test a range and step
+	from := strconv.FormatInt(start.Unix(), 10)
+	to := start.Add(5 * time.Minute).Format(time.RFC3339)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/history/foo?from="+from+"&to="+to+"&step=600", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &points)
+	assert.Equal(t, 1, len(points))
+
+	// Test an empty history
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/history/foo?from=1000&to=2000", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]", w.Body.String())
+}
+
+func Test_EventsHandler(t *testing.T) {
+	hub := NewHub()
+	r := gin.New()
+	r.GET("/events", EventsHandler(hub, make(chan struct{})))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events")
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The handler has subscribed once the headers arrive
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	hub.PublishState(Sensor{Alias: "foo"}, State{Alias: "foo", Temp: 12.5})
+
+	reader := bufio.NewReader(resp.Body)
+	line, _ := reader.ReadString('\n')
+	assert.Equal(t, "event:state\n", line)
+	line, _ = reader.ReadString('\n')
+	assert.Contains(t, line, `"alias":"foo"`)
+	assert.Contains(t, line, `"temp":12.5`)
+	reader.ReadString('\n')
+
+	// Config reloads send the sensors, but not the users
+	hub.PublishConfig(&Config{Sensors: []Sensor{Sensor{Alias: "foo"}}, Users: []User{User{Name: "secret"}}})
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, "event:config\n", line)
+	line, _ = reader.ReadString('\n')
+	assert.Contains(t, line, `"alias":"foo"`)
+	assert.NotContains(t, line, "secret")
+}
+
+func Test_EventsHandlerShutdown(t *testing.T) {
+	hub := NewHub()
+	shutdown := make(chan struct{})
+	r := gin.New()
+	r.GET("/events", EventsHandler(hub, shutdown))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	srv := &http.Server{Handler: r}
+	srv.RegisterOnShutdown(func() { close(shutdown) })
+	go srv.Serve(l)
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/events")
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Shutting down ends the stream, rather than waiting for the client to leave
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.Equal(t, nil, srv.Shutdown(ctx))
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.Equal(t, nil, err)
+}